@@ -0,0 +1,80 @@
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum LineEnding {
+    None,
+    Lf,
+    Crlf,
+    Mixed,
+}
+
+impl LineEnding {
+    // The line ending of text made of two parts with these line endings
+    pub fn combine(self, other: LineEnding) -> LineEnding {
+        match (self, other) {
+            (LineEnding::None, other) => other,
+            (this, LineEnding::None) => this,
+            (this, other) if this == other => this,
+            _ => LineEnding::Mixed,
+        }
+    }
+}
+
+#[derive(Debug, Default)]
+pub struct LineEndingStats {
+    pub lf: usize,
+    pub crlf: usize,
+    pub mixed: Vec<String>,
+}
+
+impl LineEndingStats {
+    pub fn record(&mut self, path: &str, line_ending: LineEnding) {
+        match line_ending {
+            LineEnding::Lf => self.lf += 1,
+            LineEnding::Crlf => self.crlf += 1,
+            LineEnding::Mixed => self.mixed.push(path.to_string()),
+            LineEnding::None => {}
+        }
+    }
+}
+
+pub fn detect_line_ending(content: &str) -> LineEnding {
+    let newlines = content.matches('\n').count();
+    let crlf = content.matches("\r\n").count();
+    match (newlines, crlf) {
+        (0, _) => LineEnding::None,
+        (n, c) if n == c => LineEnding::Crlf,
+        (_, 0) => LineEnding::Lf,
+        _ => LineEnding::Mixed,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn detects_each_line_ending() {
+        assert_eq!(detect_line_ending("a\nb\n"), LineEnding::Lf);
+        assert_eq!(detect_line_ending("a\r\nb\r\n"), LineEnding::Crlf);
+        assert_eq!(detect_line_ending("a\r\nb\n"), LineEnding::Mixed);
+        assert_eq!(detect_line_ending("no newline"), LineEnding::None);
+    }
+
+    #[test]
+    fn records_mixed_files_by_path() {
+        let mut stats = LineEndingStats::default();
+        stats.record("lf.txt", LineEnding::Lf);
+        stats.record("crlf.txt", LineEnding::Crlf);
+        stats.record("mixed.txt", LineEnding::Mixed);
+        stats.record("empty.txt", LineEnding::None);
+        assert_eq!((stats.lf, stats.crlf), (1, 1));
+        assert_eq!(stats.mixed, ["mixed.txt"]);
+    }
+
+    #[test]
+    fn combines_the_line_endings_of_two_parts() {
+        assert_eq!(LineEnding::None.combine(LineEnding::Lf), LineEnding::Lf);
+        assert_eq!(LineEnding::Crlf.combine(LineEnding::None), LineEnding::Crlf);
+        assert_eq!(LineEnding::Lf.combine(LineEnding::Lf), LineEnding::Lf);
+        assert_eq!(LineEnding::Lf.combine(LineEnding::Crlf), LineEnding::Mixed);
+    }
+}
@@ -0,0 +1,80 @@
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io;
+use std::path::Path;
+
+pub const EXIT_BASELINE_EXCEEDED: i32 = 6;
+
+// The total token count of an earlier run, kept with --baseline so a
+// project's context can be watched for growth from run to run
+#[derive(Debug, Deserialize, Serialize)]
+pub struct Baseline {
+    pub total_tokens: usize,
+}
+
+impl Baseline {
+    // A missing baseline is not an error: the first run has nothing to
+    // compare against, and --update-baseline creates it
+    pub fn load(path: &Path) -> Result<Option<Self>> {
+        let baseline_str = match fs::read_to_string(path) {
+            Ok(baseline_str) => baseline_str,
+            Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(None),
+            Err(e) => {
+                return Err(e).with_context(|| format!("Failed to read baseline: {:?}", path))
+            }
+        };
+        serde_json::from_str(&baseline_str)
+            .map(Some)
+            .with_context(|| format!("Failed to parse baseline: {:?}", path))
+    }
+
+    pub fn save(&self, path: &Path) -> Result<()> {
+        let baseline_str = serde_json::to_string_pretty(self)?;
+        fs::write(path, baseline_str)
+            .with_context(|| format!("Failed to write baseline: {:?}", path))
+    }
+
+    // Whether `total_tokens` is more than `threshold` percent above the
+    // baseline. Any tokens at all exceed a baseline of zero.
+    pub fn is_exceeded_by(&self, total_tokens: usize, threshold: f64) -> bool {
+        total_tokens as f64 > self.total_tokens as f64 * (1.0 + threshold / 100.0)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn growth_past_the_threshold_exceeds_the_baseline() {
+        let baseline = Baseline { total_tokens: 1000 };
+        assert!(!baseline.is_exceeded_by(900, 10.0));
+        assert!(!baseline.is_exceeded_by(1100, 10.0));
+        assert!(baseline.is_exceeded_by(1101, 10.0));
+        assert!(baseline.is_exceeded_by(1001, 0.0));
+    }
+
+    #[test]
+    fn any_tokens_exceed_a_baseline_of_zero() {
+        let baseline = Baseline { total_tokens: 0 };
+        assert!(!baseline.is_exceeded_by(0, 10.0));
+        assert!(baseline.is_exceeded_by(1, 10.0));
+    }
+
+    #[test]
+    fn a_saved_baseline_loads_back() {
+        let path =
+            std::env::temp_dir().join(format!("combiner-baseline-{}.json", std::process::id()));
+        assert!(Baseline::load(&path).unwrap().is_none());
+
+        Baseline { total_tokens: 42 }.save(&path).unwrap();
+        let loaded = Baseline::load(&path).unwrap();
+        fs::write(&path, "not json").unwrap();
+        let error = Baseline::load(&path).unwrap_err();
+        fs::remove_file(&path).unwrap();
+
+        assert_eq!(loaded.unwrap().total_tokens, 42);
+        assert!(error.to_string().starts_with("Failed to parse baseline"));
+    }
+}
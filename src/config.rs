@@ -1,139 +1,1032 @@
-use anyhow::{Context, Result};
+use anyhow::{bail, Context, Result};
+use regex::Regex;
 use serde::{Deserialize, Serialize};
+use std::fmt;
 use std::fs;
 use std::path::{Path, PathBuf};
 use structopt::StructOpt;
 
+use crate::formatter::{formatter, formatter_name, formatter_names};
+
 const DEFAULT_CONFIG_FILE: &str = "combiner.toml";
 
 #[derive(Debug, StructOpt)]
 #[structopt(name = "combiner", about = "Combines text files in a directory")]
 pub struct Opt {
-    /// Input directory to process
-    #[structopt(short = "d", long, parse(from_os_str), default_value = ".")]
-    pub input_dir: PathBuf,
+    /// Input directory (or single file) to process; can be given more than once, as path:depth to limit its depth
+    #[structopt(
+        short = "d",
+        long = "input-dir",
+        parse(from_os_str),
+        default_value = ".",
+        number_of_values = 1
+    )]
+    pub input_dirs: Vec<PathBuf>,
+
+    /// Only combine files at most this many directories deep in each input (1 is the input's own files)
+    #[structopt(long, parse(try_from_str = parse_max_depth))]
+    pub max_depth: Option<usize>,
+
+    // The depth given with each input as path:depth, split off by split_root_depths
+    #[structopt(skip)]
+    pub root_depths: Vec<Option<usize>>,
 
     /// Output file path
-    #[structopt(short, long, parse(from_os_str))]
+    #[structopt(short, long, env = "COMBINER_OUTPUT", parse(from_os_str))]
     pub output_file: Option<PathBuf>,
 
-    /// Patterns to ignore (in addition to those in config)
+    /// Patterns to ignore (in addition to those in config). A plain name matches whole file and directory names only, so write `*.json` rather than `.json` to ignore JSON files
     #[structopt(short = "g", long)]
     pub ignore_patterns: Vec<String>,
 
+    /// Read additional ignore patterns, one per line, from these files
+    #[structopt(long, parse(from_os_str), number_of_values = 1)]
+    pub ignore_from: Vec<PathBuf>,
+
+    /// Also skip files excluded by the input directory's .dockerignore
+    #[structopt(long)]
+    pub use_dockerignore: bool,
+
+    /// Only combine files matching these patterns (in addition to those in config)
+    #[structopt(long = "include")]
+    pub include_patterns: Vec<String>,
+
     /// Path to config file
     #[structopt(short, long, parse(from_os_str))]
     pub config_file: Option<PathBuf>,
 
-    /// Enable verbose output
+    /// Print more detail: -v for run settings and per-directory summaries, -vv also for every file
+    #[structopt(short, long, parse(from_occurrences))]
+    pub verbose: u8,
+
+    /// Tokenization method (see --list-tokenizers) [default: code]
+    #[structopt(long = "tokenization-method", env = "COMBINER_TOKENIZER")]
+    pub tokenizer_name: Option<String>,
+
+    // --tokenization-method as parsed by load_config, which needs to know
+    // about --tokenizer-fallback before an unknown name can be rejected
+    #[structopt(skip)]
+    pub tokenization_method: Option<TokenizationMethod>,
+
+    /// Skip files that look machine-generated (e.g. "Code generated ... DO NOT EDIT.")
+    #[structopt(long)]
+    pub exclude_generated: bool,
+
+    /// Skip files with a line matching this regex (e.g. "DO NOT COMMIT")
+    #[structopt(long, parse(try_from_str = Regex::new))]
+    pub exclude_content_matching: Option<Regex>,
+
+    /// Skip dependency lockfiles such as package-lock.json, Cargo.lock, and go.sum
+    #[structopt(long)]
+    pub exclude_lockfiles: bool,
+
+    /// Skip test files such as *_test.go, test_*.py, *.spec.js, and *Test.java
+    #[structopt(long)]
+    pub exclude_tests: bool,
+
+    /// Skip symbolic links to files instead of combining the files they point to
+    #[structopt(long)]
+    pub ignore_symlinks: bool,
+
+    /// Pick the files to combine from an interactive list
     #[structopt(short, long)]
-    pub verbose: bool,
+    pub interactive: bool,
+
+    /// Write a manifest of processed files and token counts to this JSON file
+    #[structopt(long, parse(from_os_str))]
+    pub manifest: Option<PathBuf>,
+
+    /// Compare this run against a manifest written by a previous run
+    #[structopt(long, parse(from_os_str))]
+    pub compare: Option<PathBuf>,
+
+    /// Replace likely secrets (API keys, tokens, passwords) with [REDACTED]
+    #[structopt(long)]
+    pub redact: bool,
+
+    /// Fail before writing anything if a file holds a likely secret, listing where each was found
+    #[structopt(long)]
+    pub abort_on_secret: bool,
+
+    /// Write a Markdown summary report of the run to this file
+    #[structopt(long, parse(from_os_str))]
+    pub report: Option<PathBuf>,
+
+    /// Split the output into chunks of at most this many tokens
+    #[structopt(long)]
+    pub split_tokens: Option<usize>,
+
+    /// How files are grouped into chunks when splitting
+    #[structopt(
+        long,
+        parse(try_from_str = parse_split_cohesion),
+        possible_values = &SplitCohesion::variants(),
+        case_insensitive = true,
+        default_value = "greedy"
+    )]
+    pub split_cohesion: SplitCohesion,
+
+    /// Token budget for the contents of the files, applied by --proportional-truncate
+    #[structopt(long, requires = "proportional-truncate")]
+    pub max_tokens: Option<usize>,
+
+    /// Over the --max-tokens budget, cut every file to the same share of its tokens so that all files stay in the output (changes file contents)
+    #[structopt(
+        long,
+        requires = "max-tokens",
+        conflicts_with_all = &["split-tokens", "output-stats-only", "resume", "since-last-run"]
+    )]
+    pub proportional_truncate: bool,
+
+    /// Output format: plain text sections, a single JSON document, one JSON object per file (JSONL), or a registered custom format
+    #[structopt(
+        long,
+        parse(try_from_str = parse_output_format),
+        possible_values = &OutputFormat::variants(),
+        case_insensitive = true,
+        default_value = "text"
+    )]
+    pub format: OutputFormat,
+
+    /// Also write the same files to PATH in FORMAT, e.g. "combined.json:json" (repeatable; reads and tokenizes only once)
+    #[structopt(
+        long,
+        number_of_values = 1,
+        parse(try_from_str = parse_also_output),
+        conflicts_with_all = &["split-tokens", "output-stats-only", "dry-run", "resume", "since-last-run"]
+    )]
+    pub also_output: Vec<AlsoOutput>,
+
+    /// Indent the json output format for reading (jsonl stays one object per line)
+    #[structopt(long)]
+    pub json_pretty: bool,
+
+    /// Start the output with a numbered list of the files and their token counts
+    #[structopt(long, conflicts_with_all = &["split-tokens", "output-stats-only"])]
+    pub toc: bool,
 
-    /// Tokenization method
+    /// List the walked directories that have no files to combine at the top of the output
+    #[structopt(long)]
+    pub note_empty_dirs: bool,
+
+    /// Order of the files in the output: path, size (largest first), or mtime (newest first)
+    #[structopt(
+        long,
+        parse(try_from_str = parse_sort_key),
+        possible_values = &SortKey::variants(),
+        case_insensitive = true
+    )]
+    pub sort: Option<SortKey>,
+
+    /// Order files by glob weight, lowest first, e.g. "*.md=0,*_test.go=20,*.go=10" (first matching glob wins)
+    #[structopt(long, use_delimiter = true, parse(try_from_str = parse_order_weight))]
+    pub order_weight: Vec<OrderWeight>,
+
+    /// Line written before each file in text output instead of the default header, e.g. "=== {path} ({index}) ==="
+    #[structopt(long, parse(try_from_str = parse_separator))]
+    pub separator: Option<String>,
+
+    /// Text written between files in text output: "none" (the default), "blank" for an empty line, or any text, where \n and \t are a line break and a tab
+    #[structopt(long, parse(from_str = parse_file_separator))]
+    pub file_separator: Option<String>,
+
+    /// Write a yaml or json block with each file's path, size, tokens, and language before its contents in text output
     #[structopt(
         long,
+        parse(try_from_str = parse_front_matter),
+        possible_values = &FrontMatter::variants(),
+        case_insensitive = true
+    )]
+    pub front_matter: Option<FrontMatter>,
+
+    /// Remove the import block at the top of Go, Python, JavaScript/TypeScript, and Rust files
+    #[structopt(long)]
+    pub strip_imports: bool,
+
+    /// Remove extra line breaks at the end of each file, keeping at most one
+    #[structopt(long)]
+    pub strip_trailing_newlines_per_file: bool,
+
+    /// Remove every empty or whitespace-only line from file contents, reporting the tokens saved
+    #[structopt(long)]
+    pub compact: bool,
+
+    /// Normalize file contents to this Unicode form before they are transformed, written, and tokenized
+    #[structopt(
+        long,
+        parse(try_from_str = parse_unicode_form),
+        possible_values = &UnicodeForm::variants(),
+        case_insensitive = true
+    )]
+    pub normalize_unicode: Option<UnicodeForm>,
+
+    /// Hard-wrap lines longer than this many characters, at a space where possible
+    #[structopt(long, parse(try_from_str = parse_wrap_width))]
+    pub wrap: Option<usize>,
+
+    /// Also count tokens with these tokenizers and compare the totals (comma-separated)
+    #[structopt(
+        long,
+        use_delimiter = true,
         parse(try_from_str = parse_tokenization_method),
         possible_values = &TokenizationMethod::variants(),
-        case_insensitive = true,
-        default_value = "code"
+        case_insensitive = true
+    )]
+    pub compare_tokenizers: Vec<TokenizationMethod>,
+
+    /// Include each file's permissions and modification time in its header
+    #[structopt(long)]
+    pub include_metadata: bool,
+
+    /// Stop after collecting this many files
+    #[structopt(long)]
+    pub max_files: Option<usize>,
+
+    /// Combine only this many files, picked evenly across the sorted candidates
+    #[structopt(long)]
+    pub sample: Option<usize>,
+
+    /// Fail instead of truncating when more than --max-files files are found
+    #[structopt(long, requires = "max-files")]
+    pub max_files_error: bool,
+
+    /// Print a histogram of per-file token counts
+    #[structopt(long)]
+    pub histogram: bool,
+
+    /// Upper bounds of the histogram buckets (comma-separated)
+    #[structopt(long, use_delimiter = true, default_value = "100,500,2000")]
+    pub histogram_buckets: Vec<usize>,
+
+    /// Break the processing time down into traversal, reading and tokenizing, and writing
+    #[structopt(long)]
+    pub timings: bool,
+
+    /// Print tables without ANSI styling (also off with NO_COLOR or when stdout is not a terminal)
+    #[structopt(long)]
+    pub no_color: bool,
+
+    /// Exit with code 4 if any file is skipped as non-text or unreadable
+    #[structopt(long)]
+    pub fail_on_skip: bool,
+
+    /// At the end of the run, print every skipped file and why it was skipped to stderr
+    #[structopt(long)]
+    pub list_skipped: bool,
+
+    /// Exit with code 5 if the total token count is outside MIN:MAX (either end may be left out)
+    #[structopt(long, parse(try_from_str = parse_token_range))]
+    pub expect_tokens: Option<TokenRange>,
+
+    /// Compare the total token count against the one stored in this JSON file, exiting with code 6 if it grew by more than --baseline-threshold
+    #[structopt(long, parse(from_os_str))]
+    pub baseline: Option<PathBuf>,
+
+    /// How far, in percent, the total may grow past the baseline before the run fails
+    #[structopt(long, default_value = "10", parse(try_from_str = parse_percentage))]
+    pub baseline_threshold: f64,
+
+    /// Store this run's total token count in the --baseline file when the check passes
+    #[structopt(long, requires = "baseline")]
+    pub update_baseline: bool,
+
+    /// Report additional analysis of the collected files (e.g. line endings)
+    #[structopt(long)]
+    pub analyze: bool,
+
+    /// Text to write at the very top of the output, e.g. instructions for an LLM
+    #[structopt(long)]
+    pub prompt: Option<String>,
+
+    /// Read the text to write at the top of the output from this file
+    #[structopt(long, parse(from_os_str), conflicts_with = "prompt")]
+    pub prompt_file: Option<PathBuf>,
+
+    /// Add this many tokens per file to the total for chat message framing (default: 3, as in OpenAI's chat format)
+    #[structopt(long)]
+    pub chat_overhead: Option<Option<usize>>,
+
+    /// Count the tokens of each file's path and delimiters too, adding them to the total and showing them apart from content tokens
+    #[structopt(long)]
+    pub token_breakdown: bool,
+
+    /// Note the git commit and branch of the input directory at the top of the output
+    #[structopt(long)]
+    pub git_ref_header: bool,
+
+    /// Leave out the newline that otherwise ends the output
+    #[structopt(long)]
+    pub no_trailing_newline: bool,
+
+    /// Warn about ignore patterns that did not match any file
+    #[structopt(long)]
+    pub warn_unused_ignores: bool,
+
+    /// Write the run's statistics as JSON to this file instead of writing the combined output
+    #[structopt(
+        long,
+        parse(from_os_str),
+        conflicts_with_all = &["split-tokens", "stamp", "skip-unchanged"]
+    )]
+    pub output_stats_only: Option<PathBuf>,
+
+    /// Count tokens without writing the combined output, and print the directory tree with the tokens of each file and directory
+    #[structopt(
+        long,
+        conflicts_with_all = &["split-tokens", "stamp", "skip-unchanged", "resume", "since-last-run", "proportional-truncate"]
     )]
-    pub tokenization_method: TokenizationMethod,
+    pub dry_run: bool,
+
+    /// Detect the encoding of non-UTF-8 text files and convert them to UTF-8
+    #[structopt(long)]
+    pub detect_encoding: bool,
+
+    /// Also count the words (runs of non-whitespace) in the combined text files, whatever the tokenizer
+    #[structopt(long)]
+    pub count_words: bool,
+
+    /// Include binary files base64-encoded instead of skipping them (requires --max-binary-size)
+    #[structopt(long, requires = "max-binary-size")]
+    pub include_binary_as_base64: bool,
+
+    /// Skip files larger than this (e.g. 1MB), checked before they are read
+    #[structopt(long, parse(try_from_str = parse_size))]
+    pub max_file_size: Option<u64>,
+
+    /// Largest binary file included by --include-binary-as-base64 (e.g. 256K)
+    #[structopt(long, parse(try_from_str = parse_size))]
+    pub max_binary_size: Option<u64>,
+
+    /// Read and tokenize files larger than this a piece at a time instead of all at once (e.g. 64MB)
+    #[structopt(long, parse(try_from_str = parse_size), default_value = "64MB")]
+    pub stream_threshold: u64,
+
+    /// Size of the buffer used when writing the output (e.g. 256K)
+    #[structopt(long, parse(try_from_str = parse_buffer_size), default_value = "256K")]
+    pub write_buffer_size: usize,
+
+    /// Read stdin as a single file instead of walking the input directory (which still supplies the config)
+    #[structopt(long, conflicts_with_all = &["interactive", "confirm-over"])]
+    pub stdin: bool,
+
+    /// Combine only the files committed at HEAD, read from the git repository rather than the working copy
+    #[structopt(long, conflicts_with = "stdin")]
+    pub git_tracked: bool,
+
+    /// File name that stdin is combined under with --stdin
+    #[structopt(long, parse(from_os_str), default_value = "stdin")]
+    pub stdin_name: PathBuf,
+
+    /// Stop at the first file or directory that cannot be read, instead of reporting it and going on
+    #[structopt(long)]
+    pub strict: bool,
+
+    /// Also write each file, after transforms, to this directory under its path relative to the input
+    #[structopt(long, parse(from_os_str))]
+    pub mirror_to: Option<PathBuf>,
+
+    /// Record each file in this progress file as it is written, and on a later run skip the recorded files and append to the output
+    #[structopt(
+        long,
+        parse(from_os_str),
+        conflicts_with_all = &["split-tokens", "toc", "sort", "order-weight", "output-stats-only", "stamp", "skip-unchanged", "no-trailing-newline"]
+    )]
+    pub resume: Option<PathBuf>,
+
+    /// Keep each combined file's modification time in this cache file, and on later runs combine only files modified since, appending them to the output
+    #[structopt(
+        long,
+        parse(from_os_str),
+        conflicts_with_all = &["resume", "split-tokens", "toc", "sort", "order-weight", "output-stats-only", "stamp", "skip-unchanged", "no-trailing-newline"]
+    )]
+    pub since_last_run: Option<PathBuf>,
+
+    /// Retry reads that fail with a possibly transient error (e.g. on NFS or SMB) up to this many times
+    #[structopt(long, default_value = "0")]
+    pub read_retries: usize,
+
+    /// Write a SHA-256 hash of the output to <output_file>.sha256
+    #[structopt(long, conflicts_with = "split-tokens")]
+    pub stamp: bool,
+
+    /// Leave the output untouched and exit with code 3 if its hash matches the existing stamp
+    #[structopt(long, conflicts_with = "split-tokens")]
+    pub skip_unchanged: bool,
+
+    /// Show only file names (not directories) in file headers, numbering duplicates
+    #[structopt(long)]
+    pub flatten: bool,
+
+    /// Start each file path with the name of the input directory it was found in, e.g. myproject/src/main.rs
+    #[structopt(long, conflicts_with = "flatten")]
+    pub include_root_name: bool,
+
+    /// Ask before writing when the estimated output size exceeds this (e.g. 500K, 10MB)
+    #[structopt(long, parse(try_from_str = parse_size))]
+    pub confirm_over: Option<u64>,
+
+    /// Don't ask for confirmation; write the output regardless of its size
+    #[structopt(short, long)]
+    pub yes: bool,
+
+    /// Warn and fall back instead of failing on an unknown tokenizer name: from --tokenization-method (or COMBINER_TOKENIZER) to the config file's tokenizer, and from the config file's to --tokenization-method or the default
+    #[structopt(long)]
+    pub tokenizer_fallback: bool,
+
+    /// Number of files read at once, at least 1 (default: 4 per CPU)
+    #[structopt(long, parse(try_from_str = parse_thread_count))]
+    pub io_concurrency: Option<usize>,
+
+    /// Number of threads used for tokenization, at least 1 (default: one per CPU available to the process)
+    #[structopt(
+        long,
+        visible_alias = "tokenizer-threads",
+        env = "COMBINER_TOKENIZER_THREADS",
+        parse(try_from_str = parse_thread_count)
+    )]
+    pub cpu_concurrency: Option<usize>,
+
+    /// Number of input directories walked at once when several are given (default: one at a time)
+    #[structopt(long)]
+    pub parallel_roots: Option<usize>,
+
+    /// Write a CPU profile in pprof format to this file (requires the `profiling` feature)
+    #[structopt(long, parse(from_os_str))]
+    pub cpu_profile: Option<PathBuf>,
+
+    /// Write a heap profile in dhat format to this file (requires the `profiling` feature)
+    #[structopt(long, parse(from_os_str))]
+    pub mem_profile: Option<PathBuf>,
+
+    /// Print the accepted tokenizer names and exit
+    #[structopt(long)]
+    pub list_tokenizers: bool,
 }
 
-#[derive(Debug, Deserialize, Serialize, Clone, PartialEq)]
-#[serde(rename_all = "lowercase")]
+// Read and written by the names --tokenization-method accepts
+#[derive(Debug, Deserialize, Serialize, Clone, PartialEq, Eq, PartialOrd, Ord)]
+#[serde(try_from = "String", into = "String")]
 pub enum TokenizationMethod {
-    #[serde(alias = "gpt4o")]
     O200kBase,
-    #[serde(alias = "gpt4")]
     Cl100kBase,
-    #[serde(alias = "code")]
     P50kBase,
     P50kEdit,
-    #[serde(alias = "gpt2")]
     R50kBase,
+    Estimate,
 }
 
+pub const DEFAULT_TOKENIZATION_METHOD: TokenizationMethod = TokenizationMethod::P50kBase;
+
+// Every name accepted for a tokenizer, mapped to the method it selects
+pub const TOKENIZER_NAMES: [(&str, TokenizationMethod); 10] = [
+    ("gpt4o", TokenizationMethod::O200kBase),
+    ("o200k_base", TokenizationMethod::O200kBase),
+    ("gpt4", TokenizationMethod::Cl100kBase),
+    ("cl100k_base", TokenizationMethod::Cl100kBase),
+    ("code", TokenizationMethod::P50kBase),
+    ("p50k_base", TokenizationMethod::P50kBase),
+    ("p50k_edit", TokenizationMethod::P50kEdit),
+    ("gpt2", TokenizationMethod::R50kBase),
+    ("r50k_base", TokenizationMethod::R50kBase),
+    ("estimate", TokenizationMethod::Estimate),
+];
+
 impl TokenizationMethod {
-    pub fn variants() -> [&'static str; 9] {
-        [
-            "gpt4o",
-            "o200k_base",
-            "gpt4",
-            "cl100k_base",
-            "code",
-            "p50k_base",
-            "p50k_edit",
-            "gpt2",
-            "r50k_base",
-        ]
+    pub fn variants() -> [&'static str; 10] {
+        let mut names = [""; 10];
+        for (i, (name, _)) in TOKENIZER_NAMES.iter().enumerate() {
+            names[i] = name;
+        }
+        names
     }
 
     pub fn from_str(s: &str) -> Result<Self, String> {
-        match s.to_lowercase().as_str() {
-            "gpt4o" | "o200k_base" => Ok(TokenizationMethod::O200kBase),
-            "gpt4" | "cl100k_base" => Ok(TokenizationMethod::Cl100kBase),
-            "code" | "p50k_base" => Ok(TokenizationMethod::P50kBase),
-            "p50k_edit" => Ok(TokenizationMethod::P50kEdit),
-            "gpt2" | "r50k_base" => Ok(TokenizationMethod::R50kBase),
-            _ => Err(format!("Invalid tokenization method: {}", s)),
-        }
+        let name = s.to_lowercase();
+        TOKENIZER_NAMES
+            .iter()
+            .find(|(candidate, _)| *candidate == name)
+            .map(|(_, method)| method.clone())
+            .ok_or_else(|| {
+                format!(
+                    "Invalid tokenization method: {} (expected one of: {})",
+                    s,
+                    Self::variants().join(", ")
+                )
+            })
     }
 
-    pub fn to_string(&self) -> String {
+    pub fn encoding_name(&self) -> &'static str {
         match self {
-            TokenizationMethod::O200kBase => "gpt4o".to_string(),
-            TokenizationMethod::Cl100kBase => "gpt4".to_string(),
-            TokenizationMethod::P50kBase => "code".to_string(),
-            TokenizationMethod::P50kEdit => "p50k_edit".to_string(),
-            TokenizationMethod::R50kBase => "gpt2".to_string(),
+            TokenizationMethod::O200kBase => "o200k_base",
+            TokenizationMethod::Cl100kBase => "cl100k_base",
+            TokenizationMethod::P50kBase => "p50k_base",
+            TokenizationMethod::P50kEdit => "p50k_edit",
+            TokenizationMethod::R50kBase => "r50k_base",
+            // Not an encoding, but a guess at what cl100k_base would count
+            TokenizationMethod::Estimate => "cl100k_base (estimated)",
         }
     }
 }
 
+impl fmt::Display for TokenizationMethod {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.write_str(match self {
+            TokenizationMethod::O200kBase => "gpt4o",
+            TokenizationMethod::Cl100kBase => "gpt4",
+            TokenizationMethod::P50kBase => "code",
+            TokenizationMethod::P50kEdit => "p50k_edit",
+            TokenizationMethod::R50kBase => "gpt2",
+            TokenizationMethod::Estimate => "estimate",
+        })
+    }
+}
+
+impl From<TokenizationMethod> for String {
+    fn from(method: TokenizationMethod) -> String {
+        method.to_string()
+    }
+}
+
+impl TryFrom<String> for TokenizationMethod {
+    type Error = String;
+
+    fn try_from(s: String) -> Result<Self, String> {
+        TokenizationMethod::from_str(&s)
+    }
+}
+
 fn parse_tokenization_method(s: &str) -> Result<TokenizationMethod, String> {
     TokenizationMethod::from_str(s)
 }
 
-#[derive(Debug, Deserialize)]
+// Parses a byte size with an optional binary unit suffix, e.g. "512", "500K",
+// or "10MB".
+pub fn parse_size(s: &str) -> Result<u64, String> {
+    let upper = s.trim().to_uppercase();
+    let digits_end = upper
+        .find(|c: char| !c.is_ascii_digit())
+        .unwrap_or(upper.len());
+    let (number, unit) = upper.split_at(digits_end);
+    let multiplier: u64 = match unit.trim() {
+        "" | "B" => 1,
+        "K" | "KB" => 1 << 10,
+        "M" | "MB" => 1 << 20,
+        "G" | "GB" => 1 << 30,
+        _ => return Err(format!("Invalid size: {}", s)),
+    };
+    number
+        .parse::<u64>()
+        .ok()
+        .and_then(|number| number.checked_mul(multiplier))
+        .ok_or_else(|| format!("Invalid size: {}", s))
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum SplitCohesion {
+    Greedy,
+    Dir,
+}
+
+impl SplitCohesion {
+    pub fn variants() -> [&'static str; 2] {
+        ["greedy", "dir"]
+    }
+
+    pub fn from_str(s: &str) -> Result<Self, String> {
+        match s.to_lowercase().as_str() {
+            "greedy" => Ok(SplitCohesion::Greedy),
+            "dir" => Ok(SplitCohesion::Dir),
+            _ => Err(format!("Invalid split cohesion: {}", s)),
+        }
+    }
+}
+
+fn parse_split_cohesion(s: &str) -> Result<SplitCohesion, String> {
+    SplitCohesion::from_str(s)
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum OutputFormat {
+    Text,
+    Json,
+    Jsonl,
+    // A formatter added with formatter::register_formatter, by its name
+    Custom(&'static str),
+}
+
+impl OutputFormat {
+    pub fn variants() -> Vec<&'static str> {
+        let mut variants = vec!["text", "json", "jsonl"];
+        variants.extend(formatter_names());
+        variants
+    }
+
+    pub fn from_str(s: &str) -> Result<Self, String> {
+        match s.to_lowercase().as_str() {
+            "text" => Ok(OutputFormat::Text),
+            "json" => Ok(OutputFormat::Json),
+            "jsonl" => Ok(OutputFormat::Jsonl),
+            _ => formatter_name(s)
+                .map(OutputFormat::Custom)
+                .ok_or_else(|| format!("Invalid output format: {}", s)),
+        }
+    }
+
+    pub fn extension(&self) -> &'static str {
+        match self {
+            OutputFormat::Text => "txt",
+            OutputFormat::Json => "json",
+            OutputFormat::Jsonl => "jsonl",
+            OutputFormat::Custom(name) => formatter(name).map_or("txt", |f| f.extension()),
+        }
+    }
+}
+
+fn parse_output_format(s: &str) -> Result<OutputFormat, String> {
+    OutputFormat::from_str(s)
+}
+
+// A further output file written from the same files with --also-output
+#[derive(Debug, Clone, PartialEq)]
+pub struct AlsoOutput {
+    pub path: PathBuf,
+    pub format: OutputFormat,
+}
+
+fn parse_also_output(s: &str) -> Result<AlsoOutput, String> {
+    let invalid = || format!("Invalid output (expected PATH:FORMAT): {}", s);
+    // The format comes last, so paths may contain colons
+    let (path, format) = s.rsplit_once(':').ok_or_else(invalid)?;
+    if path.is_empty() {
+        return Err(invalid());
+    }
+    Ok(AlsoOutput {
+        path: PathBuf::from(path),
+        format: OutputFormat::from_str(format)?,
+    })
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum SortKey {
+    Path,
+    Size,
+    Mtime,
+}
+
+impl SortKey {
+    pub fn variants() -> [&'static str; 3] {
+        ["path", "size", "mtime"]
+    }
+
+    pub fn from_str(s: &str) -> Result<Self, String> {
+        match s.to_lowercase().as_str() {
+            "path" => Ok(SortKey::Path),
+            "size" => Ok(SortKey::Size),
+            "mtime" => Ok(SortKey::Mtime),
+            _ => Err(format!("Invalid sort key: {}", s)),
+        }
+    }
+}
+
+// Forms for --normalize-unicode
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum UnicodeForm {
+    Nfc,
+}
+
+impl UnicodeForm {
+    pub fn variants() -> [&'static str; 1] {
+        ["nfc"]
+    }
+
+    pub fn from_str(s: &str) -> Result<Self, String> {
+        match s.to_lowercase().as_str() {
+            "nfc" => Ok(UnicodeForm::Nfc),
+            _ => Err(format!("Invalid Unicode normalization form: {}", s)),
+        }
+    }
+}
+
+fn parse_unicode_form(s: &str) -> Result<UnicodeForm, String> {
+    UnicodeForm::from_str(s)
+}
+
+fn parse_sort_key(s: &str) -> Result<SortKey, String> {
+    SortKey::from_str(s)
+}
+
+// Formats for --front-matter
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum FrontMatter {
+    Yaml,
+    Json,
+}
+
+impl FrontMatter {
+    pub fn variants() -> [&'static str; 2] {
+        ["yaml", "json"]
+    }
+
+    pub fn from_str(s: &str) -> Result<Self, String> {
+        match s.to_lowercase().as_str() {
+            "yaml" => Ok(FrontMatter::Yaml),
+            "json" => Ok(FrontMatter::Json),
+            _ => Err(format!("Invalid front matter format: {}", s)),
+        }
+    }
+}
+
+fn parse_front_matter(s: &str) -> Result<FrontMatter, String> {
+    FrontMatter::from_str(s)
+}
+
+// A glob and the weight it gives matching files under --order-weight
+#[derive(Debug, Clone, PartialEq)]
+pub struct OrderWeight {
+    pub pattern: String,
+    pub weight: i64,
+}
+
+fn parse_order_weight(s: &str) -> Result<OrderWeight, String> {
+    let invalid = || format!("Invalid order weight (expected GLOB=WEIGHT): {}", s);
+    let (pattern, weight) = s.rsplit_once('=').ok_or_else(invalid)?;
+    let pattern = pattern.trim();
+    if pattern.is_empty() {
+        return Err(invalid());
+    }
+    let weight = weight.trim().parse::<i64>().map_err(|_| invalid())?;
+    Ok(OrderWeight {
+        pattern: pattern.to_string(),
+        weight,
+    })
+}
+
+fn parse_wrap_width(s: &str) -> Result<usize, String> {
+    match s.parse::<usize>() {
+        Ok(0) => Err(format!("Wrap width must be greater than zero: {}", s)),
+        Ok(width) => Ok(width),
+        Err(_) => Err(format!("Invalid wrap width: {}", s)),
+    }
+}
+
+fn parse_buffer_size(s: &str) -> Result<usize, String> {
+    let size = parse_size(s)?;
+    if size == 0 {
+        return Err(format!("Buffer size must be greater than zero: {}", s));
+    }
+    usize::try_from(size).map_err(|_| format!("Buffer size is too large: {}", s))
+}
+
+// Thread pools are sized by these, and rayon takes zero threads to mean its
+// default rather than none
+fn parse_thread_count(s: &str) -> Result<usize, String> {
+    match s.parse::<usize>() {
+        Ok(0) => Err(format!("Must be at least 1: {}", s)),
+        Ok(count) => Ok(count),
+        Err(_) => Err(format!("Invalid number: {}", s)),
+    }
+}
+
+fn parse_percentage(s: &str) -> Result<f64, String> {
+    match s.trim_end_matches('%').parse::<f64>() {
+        Ok(percentage) if percentage.is_finite() && percentage >= 0.0 => Ok(percentage),
+        _ => Err(format!("Invalid percentage: {}", s)),
+    }
+}
+
+// A separator must name the file so the output can be split back apart
+fn parse_separator(s: &str) -> Result<String, String> {
+    if !s.contains("{path}") {
+        return Err(format!("Separator must contain {{path}}: {}", s));
+    }
+    Ok(s.to_string())
+}
+
+// `\n` and `\t` are unescaped so a separator can span lines without shell
+// quoting tricks; `\\` is a literal backslash
+fn parse_file_separator(s: &str) -> String {
+    match s {
+        "none" => String::new(),
+        "blank" => "\n".to_string(),
+        _ => {
+            let mut separator = String::new();
+            let mut chars = s.chars();
+            while let Some(c) = chars.next() {
+                if c != '\\' {
+                    separator.push(c);
+                    continue;
+                }
+                match chars.next() {
+                    Some('n') => separator.push('\n'),
+                    Some('t') => separator.push('\t'),
+                    Some('\\') => separator.push('\\'),
+                    other => {
+                        separator.push('\\');
+                        separator.extend(other);
+                    }
+                }
+            }
+            separator
+        }
+    }
+}
+
+pub const EXIT_TOKENS_OUT_OF_RANGE: i32 = 5;
+
+// An inclusive range of token counts for --expect-tokens
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct TokenRange {
+    pub min: Option<usize>,
+    pub max: Option<usize>,
+}
+
+impl TokenRange {
+    pub fn contains(&self, tokens: usize) -> bool {
+        self.min.map_or(true, |min| tokens >= min) && self.max.map_or(true, |max| tokens <= max)
+    }
+}
+
+impl std::fmt::Display for TokenRange {
+    fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
+        let bound = |bound: Option<usize>| bound.map(|n| n.to_string()).unwrap_or_default();
+        write!(f, "{}:{}", bound(self.min), bound(self.max))
+    }
+}
+
+fn parse_token_range(s: &str) -> Result<TokenRange, String> {
+    let invalid = || format!("Invalid token range (expected MIN:MAX): {}", s);
+    let (min, max) = s.split_once(':').ok_or_else(invalid)?;
+    let bound = |bound: &str| match bound.trim() {
+        "" => Ok(None),
+        bound => bound.parse::<usize>().map(Some).map_err(|_| invalid()),
+    };
+    let range = TokenRange {
+        min: bound(min)?,
+        max: bound(max)?,
+    };
+    if let (Some(min), Some(max)) = (range.min, range.max) {
+        if min > max {
+            return Err(invalid());
+        }
+    }
+    Ok(range)
+}
+
+#[derive(Debug, Default, Deserialize)]
 pub struct Config {
     pub ignore_patterns: Option<Vec<String>>,
     pub include_patterns: Option<Vec<String>>,
     pub output_file: Option<String>,
     pub tokenization_method: Option<TokenizationMethod>,
+    pub generated_markers: Option<Vec<String>>,
+    pub redact_patterns: Option<Vec<String>>,
+}
+
+fn parse_max_depth(s: &str) -> Result<usize, String> {
+    match s.parse::<usize>() {
+        Ok(0) => Err(format!("Depth must be at least 1: {}", s)),
+        Ok(depth) => Ok(depth),
+        Err(_) => Err(format!("Invalid depth: {}", s)),
+    }
+}
+
+// Splits the depth off inputs given as path:depth. An input whose text after
+// the last colon is not a number (e.g. C:\src) is a plain path.
+pub fn split_root_depths(opt: &mut Opt) -> Result<()> {
+    let mut depths = Vec::with_capacity(opt.input_dirs.len());
+    for input in &mut opt.input_dirs {
+        let text = input.to_string_lossy().into_owned();
+        let depth = match text.rsplit_once(':') {
+            Some((path, depth))
+                if !depth.is_empty() && depth.bytes().all(|b| b.is_ascii_digit()) =>
+            {
+                let depth = parse_max_depth(depth).map_err(anyhow::Error::msg)?;
+                *input = PathBuf::from(path);
+                Some(depth)
+            }
+            _ => None,
+        };
+        depths.push(depth);
+    }
+    opt.root_depths = depths;
+    Ok(())
+}
+
+pub fn validate_input_path(input_path: &Path) -> Result<()> {
+    let metadata = fs::metadata(input_path)
+        .with_context(|| format!("Input path does not exist: {:?}", input_path))?;
+    if !metadata.is_dir() && !metadata.is_file() {
+        bail!(
+            "Input path is neither a directory nor a regular file: {:?}",
+            input_path
+        );
+    }
+    Ok(())
 }
 
 pub fn load_config(opt: &mut Opt) -> Result<Config> {
     if opt.config_file.is_none() {
-        let default_config = opt.input_dir.join(DEFAULT_CONFIG_FILE);
+        // The config is found in the first input. A single input file is
+        // configured from the directory containing it.
+        let input = &opt.input_dirs[0];
+        let config_dir = if input.is_file() {
+            input.parent().unwrap_or(Path::new("."))
+        } else {
+            input
+        };
+        let default_config = config_dir.join(DEFAULT_CONFIG_FILE);
         if default_config.exists() {
             opt.config_file = Some(default_config);
         }
     }
 
+    let cli_fallback = parse_cli_tokenizer(opt)?;
+
     match &opt.config_file {
         Some(path) => {
             let config_str = fs::read_to_string(path)
                 .with_context(|| format!("Failed to read config file: {:?}", path))?;
-            let mut config: Config = toml::from_str(&config_str)?;
+            let mut table: toml::Table = toml::from_str(&config_str)?;
 
-            // If tokenization_method is not specified in the config file, use the CLI option
-            if config.tokenization_method.is_none() {
-                config.tokenization_method = Some(opt.tokenization_method.clone());
+            // Reject unknown tokenizer names unless asked to fall back to the CLI option
+            if let Some(value) = table.get("tokenization_method") {
+                let name = value.as_str().unwrap_or_default();
+                if let Err(e) = TokenizationMethod::from_str(name) {
+                    if !opt.tokenizer_fallback {
+                        bail!("{} in config file {:?}", e, path);
+                    }
+                    eprintln!(
+                        "Warning: {}; falling back to {}",
+                        e,
+                        opt.tokenization_method
+                            .as_ref()
+                            .unwrap_or(&DEFAULT_TOKENIZATION_METHOD)
+                            .to_string()
+                    );
+                    table.remove("tokenization_method");
+                }
             }
-
+            let mut config: Config = toml::Value::Table(table).try_into()?;
+            config.tokenization_method = resolve_tokenization_method(opt, &config);
+            warn_tokenizer_fallback(cli_fallback, &config);
+            Ok(config)
+        }
+        None => {
+            let config = Config {
+                tokenization_method: resolve_tokenization_method(opt, &Config::default()),
+                ..Default::default()
+            };
+            warn_tokenizer_fallback(cli_fallback, &config);
             Ok(config)
         }
-        None => Ok(Config {
-            ignore_patterns: None,
-            include_patterns: None,
-            output_file: None,
-            tokenization_method: Some(opt.tokenization_method.clone()),
-        }),
     }
 }
 
-pub fn merge_ignore_patterns(
+// Parses --tokenization-method (or COMBINER_TOKENIZER) into
+// opt.tokenization_method. An unknown name is an error unless
+// --tokenizer-fallback is given, when it is returned for a warning once the
+// tokenizer it falls back to is known.
+fn parse_cli_tokenizer(opt: &mut Opt) -> Result<Option<String>> {
+    let name = match &opt.tokenizer_name {
+        Some(name) => name,
+        None => return Ok(None),
+    };
+    match TokenizationMethod::from_str(name) {
+        Ok(method) => {
+            opt.tokenization_method = Some(method);
+            Ok(None)
+        }
+        Err(e) if opt.tokenizer_fallback => Ok(Some(e)),
+        Err(e) => bail!("{} in --tokenization-method (or COMBINER_TOKENIZER)", e),
+    }
+}
+
+fn warn_tokenizer_fallback(error: Option<String>, config: &Config) {
+    if let Some(error) = error {
+        eprintln!(
+            "Warning: {}; falling back to {}",
+            error,
+            config
+                .tokenization_method
+                .as_ref()
+                .unwrap_or(&DEFAULT_TOKENIZATION_METHOD)
+        );
+    }
+}
+
+// The flag (or COMBINER_TOKENIZER, which structopt reads in its place) wins
+// over the config file, which wins over the built-in default. The output
+// file follows the same order in determine_output_file.
+fn resolve_tokenization_method(opt: &Opt, config: &Config) -> Option<TokenizationMethod> {
+    Some(
+        opt.tokenization_method
+            .clone()
+            .or_else(|| config.tokenization_method.clone())
+            .unwrap_or(DEFAULT_TOKENIZATION_METHOD),
+    )
+}
+
+pub fn merge_patterns(
     cli_patterns: &[String],
     config_patterns: &Option<Vec<String>>,
 ) -> Vec<String> {
@@ -144,28 +1037,46 @@ pub fn merge_ignore_patterns(
     patterns
 }
 
+// Reads newline-separated patterns from a file, skipping blank lines and
+// `#` comments.
+pub fn load_pattern_file(path: &Path) -> Result<Vec<String>> {
+    let contents = fs::read_to_string(path)
+        .with_context(|| format!("Failed to read ignore file: {:?}", path))?;
+    Ok(contents
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .map(String::from)
+        .collect())
+}
+
 pub fn determine_output_file(opt: &mut Opt, config: &Config) -> Result<PathBuf> {
     if opt.output_file.is_none() {
         opt.output_file = config.output_file.as_ref().map(PathBuf::from).or_else(|| {
             let datetime = chrono::Local::now().format("%Y%m%d_%H%M%S");
             Some(PathBuf::from(format!(
-                "{}{}.txt",
+                "{}{}.{}",
                 crate::DEFAULT_OUTPUT_PREFIX,
-                datetime
+                datetime,
+                opt.format.extension()
             )))
         });
     }
     Ok(opt.output_file.as_ref().unwrap().to_path_buf())
 }
 
+// --verbose levels: run settings and per-directory summaries, then per-file detail
+pub const VERBOSE_SUMMARY: u8 = 1;
+pub const VERBOSE_FILES: u8 = 2;
+
 pub fn print_verbose_info(
     opt: &Opt,
     output_file: &Path,
     ignore_patterns: &[String],
     config: &Config,
 ) {
-    if opt.verbose {
-        println!("Input directory: {:?}", opt.input_dir);
+    if opt.verbose >= VERBOSE_SUMMARY {
+        println!("Input directories: {:?}", opt.input_dirs);
         println!("Output file: {:?}", output_file);
         println!("Config file: {:?}", opt.config_file);
         println!("Ignore patterns: {:?}", ignore_patterns);
@@ -174,11 +1085,308 @@ pub fn print_verbose_info(
             config
                 .tokenization_method
                 .as_ref()
-                .unwrap_or(&opt.tokenization_method)
+                .unwrap_or(&DEFAULT_TOKENIZATION_METHOD)
                 .to_string()
         );
         if let Some(include_patterns) = &config.include_patterns {
             println!("Include patterns: {:?}", include_patterns);
         }
+        if opt.exclude_generated {
+            if let Some(markers) = &config.generated_markers {
+                println!("Generated markers: {:?}", markers);
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn a_missing_input_path_is_an_error() {
+        let missing = std::env::temp_dir().join("combiner-no-such-directory");
+        let error = validate_input_path(&missing).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            format!("Input path does not exist: {:?}", missing)
+        );
+    }
+
+    #[test]
+    fn a_single_file_is_accepted() {
+        let file = std::env::temp_dir().join(format!("combiner-{}-input.txt", std::process::id()));
+        fs::write(&file, "text").unwrap();
+        let result = validate_input_path(&file);
+        fs::remove_file(&file).unwrap();
+        assert!(result.is_ok());
+    }
+
+    #[test]
+    fn an_existing_directory_is_accepted() {
+        assert!(validate_input_path(&std::env::temp_dir()).is_ok());
+    }
+
+    #[test]
+    fn pattern_files_skip_blank_lines_and_comments() {
+        let file = std::env::temp_dir().join(format!("combiner-{}-ignore", std::process::id()));
+        fs::write(&file, "# build output\ndist\n\n  *.log  \n#*.txt\n").unwrap();
+        let patterns = load_pattern_file(&file).unwrap();
+        fs::remove_file(&file).unwrap();
+        assert_eq!(patterns, ["dist", "*.log"]);
+    }
+
+    #[test]
+    fn a_missing_pattern_file_names_the_file() {
+        let missing = std::env::temp_dir().join("combiner-no-such-ignore-file");
+        let error = load_pattern_file(&missing).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            format!("Failed to read ignore file: {:?}", missing)
+        );
+    }
+
+    #[test]
+    fn sizes_take_an_optional_binary_unit() {
+        assert_eq!(parse_size("512"), Ok(512));
+        assert_eq!(parse_size("500K"), Ok(500 * 1024));
+        assert_eq!(parse_size("10mb"), Ok(10 * 1024 * 1024));
+        assert_eq!(parse_size("1 GB"), Ok(1 << 30));
+        assert!(parse_size("10XB").is_err());
+        assert!(parse_size("MB").is_err());
+    }
+
+    #[test]
+    fn the_listed_names_are_the_accepted_names() {
+        let listed: Vec<&str> = TOKENIZER_NAMES.iter().map(|(name, _)| *name).collect();
+        assert_eq!(TokenizationMethod::variants().to_vec(), listed);
+        assert!(TokenizationMethod::from_str("GPT4").is_ok());
+        assert!(TokenizationMethod::from_str("gpt5")
+            .unwrap_err()
+            .starts_with("Invalid tokenization method: gpt5"));
+    }
+
+    // Loads a config file containing `toml` with the given command line
+    fn load(name: &str, toml: &str, args: &[&str]) -> Result<Config> {
+        let file =
+            std::env::temp_dir().join(format!("combiner-{}-{}.toml", std::process::id(), name));
+        fs::write(&file, toml).unwrap();
+        let mut argv = vec!["combiner", "-c", file.to_str().unwrap()];
+        argv.extend(args);
+        let result = load_config(&mut Opt::from_iter(argv));
+        fs::remove_file(&file).unwrap();
+        result
+    }
+
+    #[test]
+    fn the_config_file_accepts_the_documented_tokenizer_names() {
+        for (name, method) in &TOKENIZER_NAMES {
+            let config = load(name, &format!("tokenization_method = {:?}", name), &[]).unwrap();
+            assert_eq!(config.tokenization_method.as_ref(), Some(method));
+        }
+    }
+
+    #[test]
+    fn an_unknown_tokenizer_name_errors_by_default() {
+        let error = load("unknown", "tokenization_method = \"gpt5\"", &[]).unwrap_err();
+        let message = error.to_string();
+        assert!(message.starts_with("Invalid tokenization method: gpt5 (expected one of: gpt4o,"));
+        assert!(message.contains("in config file"));
+
+        for args in [
+            &["--tokenization-method", "gpt5"][..],
+            &["--compare-tokenizers", "gpt5"],
+        ] {
+            let mut argv = vec!["combiner"];
+            argv.extend(args);
+            let rejected = match Opt::from_iter_safe(argv) {
+                Ok(mut opt) => load_config(&mut opt).is_err(),
+                Err(_) => true,
+            };
+            assert!(rejected, "{:?}", args);
+        }
+    }
+
+    #[test]
+    fn tokenizer_fallback_applies_to_the_command_line_tokenizer() {
+        let config = load(
+            "cli-fallback",
+            "tokenization_method = \"gpt2\"",
+            &["--tokenizer-fallback", "--tokenization-method", "gpt5"],
+        )
+        .unwrap();
+        assert_eq!(
+            config.tokenization_method,
+            Some(TokenizationMethod::R50kBase)
+        );
+
+        // Without a config file it falls back to the default
+        let dir = std::env::temp_dir().join(format!("combiner-{}-no-config", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let mut opt = Opt::from_iter([
+            "combiner",
+            "-d",
+            dir.to_str().unwrap(),
+            "--tokenizer-fallback",
+            "--tokenization-method",
+            "gpt5",
+        ]);
+        let config = load_config(&mut opt);
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(
+            config.unwrap().tokenization_method,
+            Some(DEFAULT_TOKENIZATION_METHOD)
+        );
+    }
+
+    #[test]
+    fn tokenizer_fallback_uses_the_command_line_tokenizer() {
+        let config = load(
+            "fallback",
+            "tokenization_method = \"gpt5\"",
+            &["--tokenizer-fallback", "--tokenization-method", "gpt2"],
+        )
+        .unwrap();
+        assert_eq!(
+            config.tokenization_method,
+            Some(TokenizationMethod::R50kBase)
+        );
+    }
+
+    #[test]
+    fn a_separator_must_contain_the_path() {
+        assert_eq!(
+            parse_separator("=== {path} ({index}) ==="),
+            Ok("=== {path} ({index}) ===".to_string())
+        );
+        assert_eq!(
+            parse_separator("=== {index} ==="),
+            Err("Separator must contain {path}: === {index} ===".to_string())
+        );
+        assert!(Opt::from_iter_safe(["combiner", "--separator", "---"]).is_err());
+    }
+
+    #[test]
+    fn token_ranges_may_leave_out_either_end() {
+        let range = parse_token_range("100:200").unwrap();
+        assert!(!range.contains(99));
+        assert!(range.contains(100));
+        assert!(range.contains(200));
+        assert!(!range.contains(201));
+
+        assert!(parse_token_range(":200").unwrap().contains(0));
+        assert!(parse_token_range("100:").unwrap().contains(usize::MAX));
+        assert_eq!(parse_token_range(" 5 : ").unwrap().to_string(), "5:");
+    }
+
+    #[test]
+    fn invalid_token_ranges_are_rejected() {
+        assert!(parse_token_range("100").is_err());
+        assert!(parse_token_range("a:b").is_err());
+        assert!(parse_token_range("200:100").is_err());
+    }
+
+    #[test]
+    fn buffer_sizes_take_units_and_must_be_positive() {
+        assert_eq!(parse_buffer_size("256K"), Ok(256 * 1024));
+        assert_eq!(parse_buffer_size("4096"), Ok(4096));
+        assert!(parse_buffer_size("0").is_err());
+        assert!(parse_buffer_size("lots").is_err());
+    }
+
+    #[test]
+    fn order_weights_parse_as_glob_and_weight() {
+        assert_eq!(
+            parse_order_weight("*_test.go = -20"),
+            Ok(OrderWeight {
+                pattern: "*_test.go".to_string(),
+                weight: -20,
+            })
+        );
+        assert!(parse_order_weight("*.go").is_err());
+        assert!(parse_order_weight("=1").is_err());
+        assert!(parse_order_weight("*.go=first").is_err());
+    }
+
+    #[test]
+    fn wrap_widths_must_be_positive() {
+        assert_eq!(parse_wrap_width("80"), Ok(80));
+        assert!(parse_wrap_width("0").is_err());
+        assert!(parse_wrap_width("wide").is_err());
+    }
+
+    #[test]
+    fn depths_are_split_off_inputs_given_as_path_and_depth() {
+        let mut opt = Opt::from_iter(["combiner", "-d", "src:2", "-d", "docs", "-d", r"C:\src"]);
+        split_root_depths(&mut opt).unwrap();
+        assert_eq!(
+            opt.input_dirs,
+            [
+                PathBuf::from("src"),
+                PathBuf::from("docs"),
+                PathBuf::from(r"C:\src")
+            ]
+        );
+        assert_eq!(opt.root_depths, [Some(2), None, None]);
+
+        let mut opt = Opt::from_iter(["combiner", "-d", "src:0"]);
+        assert!(split_root_depths(&mut opt).is_err());
+    }
+
+    #[test]
+    fn file_separators_are_named_or_unescaped() {
+        assert_eq!(parse_file_separator("none"), "");
+        assert_eq!(parse_file_separator("blank"), "\n");
+        assert_eq!(parse_file_separator(r"\n---\n"), "\n---\n");
+        assert_eq!(parse_file_separator(r"a\tb\\n\x"), "a\tb\\n\\x");
+    }
+
+    #[test]
+    fn percentages_may_carry_a_percent_sign() {
+        assert_eq!(parse_percentage("10"), Ok(10.0));
+        assert_eq!(parse_percentage("2.5%"), Ok(2.5));
+        assert!(parse_percentage("-1").is_err());
+        assert!(parse_percentage("inf").is_err());
+        assert!(parse_percentage("ten").is_err());
+    }
+
+    #[test]
+    fn tokenizer_threads_is_another_name_for_cpu_concurrency() {
+        let opt = Opt::from_iter(["combiner", "--tokenizer-threads", "2"]);
+        assert_eq!(opt.cpu_concurrency, Some(2));
+    }
+
+    #[test]
+    fn also_output_takes_the_format_after_the_last_colon() {
+        assert_eq!(
+            parse_also_output("C:/out/combined.json:json"),
+            Ok(AlsoOutput {
+                path: PathBuf::from("C:/out/combined.json"),
+                format: OutputFormat::Json,
+            })
+        );
+        assert!(parse_also_output("combined.json").is_err());
+        assert!(parse_also_output(":json").is_err());
+        assert!(parse_also_output("combined.txt:markdown").is_err());
+    }
+
+    #[test]
+    fn thread_counts_are_at_least_one() {
+        assert_eq!(parse_thread_count("1"), Ok(1));
+        assert_eq!(parse_thread_count("16"), Ok(16));
+        assert!(parse_thread_count("0").is_err());
+        assert!(parse_thread_count("-1").is_err());
+        assert!(parse_thread_count("many").is_err());
+    }
+
+    #[test]
+    fn tokenization_methods_round_trip_through_serde() {
+        for (name, method) in &TOKENIZER_NAMES {
+            let json = serde_json::to_string(method).unwrap();
+            let parsed: TokenizationMethod = serde_json::from_str(&json).unwrap();
+            assert_eq!(&parsed, method, "{} was written as {}", name, json);
+            let named: TokenizationMethod = serde_json::from_str(&format!("{:?}", name)).unwrap();
+            assert_eq!(&named, method);
+        }
     }
 }
@@ -0,0 +1,35 @@
+use chardetng::EncodingDetector;
+use encoding_rs::Encoding;
+
+// Decodes text that is not valid UTF-8 by detecting its encoding (a BOM if
+// present, otherwise a guess from the byte content). Returns the decoded
+// text and the encoding name, or None if the bytes don't decode cleanly.
+pub fn decode_non_utf8(bytes: &[u8]) -> Option<(String, &'static str)> {
+    let encoding = match Encoding::for_bom(bytes) {
+        Some((encoding, _)) => encoding,
+        None => {
+            let mut detector = EncodingDetector::new();
+            detector.feed(bytes, true);
+            detector.guess(None, false)
+        }
+    };
+
+    let (decoded, encoding, had_errors) = encoding.decode(bytes);
+    if had_errors {
+        None
+    } else {
+        Some((decoded.into_owned(), encoding.name()))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn decodes_latin1_text() {
+        let (content, encoding) = decode_non_utf8(b"na\xefve caf\xe9").unwrap();
+        assert_eq!(content, "naïve café");
+        assert_eq!(encoding, "windows-1252");
+    }
+}
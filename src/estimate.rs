@@ -0,0 +1,204 @@
+// A quick estimate of the tokens cl100k_base (the gpt4 tokenizer) would
+// count, without loading any encoding data. Text is split the way cl100k_base
+// splits it before encoding: runs of letters, of digits, of punctuation, and
+// of whitespace, with a single space joining the word after it. Each piece is
+// then priced by rule rather than looked up, which is where the estimate
+// drifts:
+//
+// - Common English words and short identifiers are one token, as in the
+//   vocabulary; rare or long words are guessed at about five letters a token
+//   and may be off either way.
+// - camelCase and snake_case identifiers count one piece per part.
+// - Digits count three to a token, exactly as cl100k_base groups them.
+// - Text outside ASCII is priced by its UTF-8 length, which suits CJK scripts
+//   but overcounts accented Latin words.
+//
+// It is meant for fast budget checks on prose and source code, where the
+// rules above hold; use a real tokenizer when the count must be exact.
+pub fn estimate_tokens(text: &str) -> usize {
+    let mut tokens = 0;
+    let mut chars = text.char_indices().peekable();
+    while let Some((start, c)) = chars.next() {
+        let class = CharClass::of(c);
+        let mut end = start + c.len_utf8();
+        while let Some(&(i, next)) = chars.peek() {
+            if CharClass::of(next) != class {
+                break;
+            }
+            end = i + next.len_utf8();
+            chars.next();
+        }
+        let piece = &text[start..end];
+        tokens += match class {
+            CharClass::Letter => word_tokens(piece),
+            CharClass::Digit => piece.len().div_ceil(3),
+            // A single space belongs to the word or punctuation after it
+            CharClass::Space if piece == " " && chars.peek().is_some() => 0,
+            CharClass::Space => 1,
+            CharClass::Other => piece.chars().count().div_ceil(2),
+        };
+    }
+    tokens
+}
+
+#[derive(Clone, Copy, PartialEq)]
+enum CharClass {
+    Letter,
+    Digit,
+    Space,
+    Other,
+}
+
+impl CharClass {
+    fn of(c: char) -> Self {
+        if c.is_alphabetic() || c == '_' {
+            CharClass::Letter
+        } else if c.is_numeric() {
+            CharClass::Digit
+        } else if c.is_whitespace() {
+            CharClass::Space
+        } else {
+            CharClass::Other
+        }
+    }
+}
+
+// Longest ASCII word taken as a single token
+const WORD_TOKEN_LEN: usize = 8;
+// Letters per token of longer words
+const LETTERS_PER_TOKEN: usize = 5;
+// UTF-8 bytes per token of text outside ASCII
+const BYTES_PER_TOKEN: usize = 3;
+
+fn word_tokens(word: &str) -> usize {
+    // Leading and trailing underscores, as in __init__, are pieces of their own
+    let edges = usize::from(word.starts_with('_')) + usize::from(word.ends_with('_'));
+    let parts: usize = word
+        .split('_')
+        .flat_map(camel_case_parts)
+        .map(|part| {
+            if !part.is_ascii() {
+                part.len().div_ceil(BYTES_PER_TOKEN)
+            } else if part.len() <= WORD_TOKEN_LEN {
+                1
+            } else {
+                part.len().div_ceil(LETTERS_PER_TOKEN)
+            }
+        })
+        .sum();
+    edges.min(word.len()) + parts
+}
+
+// Splits before each uppercase letter that follows a lowercase one, so
+// getUserName gives get, User, and Name
+fn camel_case_parts(word: &str) -> Vec<&str> {
+    let mut parts = Vec::new();
+    let mut start = 0;
+    let mut previous_lowercase = false;
+    for (i, c) in word.char_indices() {
+        if c.is_uppercase() && previous_lowercase {
+            parts.push(&word[start..i]);
+            start = i;
+        }
+        previous_lowercase = c.is_lowercase();
+    }
+    if start < word.len() {
+        parts.push(&word[start..]);
+    }
+    parts
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tiktoken_rs::cl100k_base;
+
+    const PROSE: &str = "The quick brown fox jumps over the lazy dog. It was the best of \
+        times, it was the worst of times, it was the age of wisdom, it was the age of \
+        foolishness. Combiner walks a directory, reads every text file it finds, and \
+        writes them into a single file along with a count of the tokens they take.\n";
+
+    const RUST: &str = r#"use std::collections::HashMap;
+
+/// Counts how often each word appears in the text.
+pub fn word_counts(text: &str) -> HashMap<String, usize> {
+    let mut counts = HashMap::new();
+    for word in text.split_whitespace() {
+        *counts.entry(word.to_lowercase()).or_insert(0) += 1;
+    }
+    counts
+}
+
+fn main() {
+    let counts = word_counts("the cat and the hat");
+    println!("{:?}", counts.get("the"));
+}
+"#;
+
+    const PYTHON: &str = r#"import os
+
+
+def total_size(directory):
+    """Returns the size in bytes of every file below directory."""
+    size = 0
+    for root, _dirs, files in os.walk(directory):
+        for name in files:
+            size += os.path.getsize(os.path.join(root, name))
+    return size
+
+
+if __name__ == "__main__":
+    print(total_size("."))
+"#;
+
+    const JSON: &str = r#"{
+  "name": "combiner",
+  "version": "0.1.7",
+  "files": [
+    {"path": "src/main.rs", "tokens": 1024},
+    {"path": "src/lib.rs", "tokens": 2048}
+  ]
+}
+"#;
+
+    #[test]
+    fn stays_within_fifteen_percent_of_cl100k_base() {
+        let bpe = cl100k_base().unwrap();
+        for sample in [PROSE, RUST, PYTHON, JSON] {
+            let exact = bpe.encode_ordinary(sample).len() as f64;
+            let estimate = estimate_tokens(sample) as f64;
+            let error = (estimate - exact).abs() / exact;
+            assert!(
+                error <= 0.15,
+                "estimated {} tokens for {} exact ({:.0}% off):\n{}",
+                estimate,
+                exact,
+                error * 100.0,
+                sample
+            );
+        }
+    }
+
+    #[test]
+    fn a_single_space_joins_the_word_after_it() {
+        assert_eq!(estimate_tokens(""), 0);
+        assert_eq!(estimate_tokens("hello world"), 2);
+        assert_eq!(estimate_tokens("hello  world"), 3);
+        assert_eq!(estimate_tokens("x = 1;"), 4);
+        assert_eq!(estimate_tokens("end\n"), 2);
+    }
+
+    #[test]
+    fn identifiers_count_one_piece_per_part() {
+        assert_eq!(estimate_tokens("getUserName"), 3);
+        assert_eq!(estimate_tokens("user_name"), 2);
+        assert_eq!(estimate_tokens("__init__"), 3);
+    }
+
+    #[test]
+    fn long_words_digits_and_other_scripts_are_priced_by_length() {
+        assert_eq!(estimate_tokens("internationalization"), 4);
+        assert_eq!(estimate_tokens("1234567"), 3);
+        assert_eq!(estimate_tokens("日本語"), 3);
+    }
+}
@@ -1,121 +1,1193 @@
-use anyhow::{Context, Result};
+use anyhow::{bail, Context, Result};
+use base64::engine::general_purpose::STANDARD as BASE64;
+use base64::Engine as _;
 use rayon::prelude::*;
-use std::fs::{self, File};
-use std::io::{BufWriter, Write};
-use std::path::Path;
-use std::sync::{Arc, Mutex};
+use rayon::{ThreadPool, ThreadPoolBuilder};
+use regex::Regex;
+use serde::Serialize;
+use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
+use std::fs::{self, File, OpenOptions};
+use std::io::{self, BufRead, BufReader, BufWriter, IntoInnerError, Read, Seek, Write};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex, PoisonError};
+use std::time::{Duration, Instant, SystemTime};
 use tiktoken_rs::{cl100k_base, o200k_base, p50k_base, p50k_edit, r50k_base, CoreBPE};
-use walkdir::WalkDir;
 
-use crate::config::{Config, TokenizationMethod};
+use crate::analysis::{detect_line_ending, LineEnding, LineEndingStats};
+use crate::config::{
+    load_pattern_file, merge_patterns, Config, FrontMatter, OutputFormat, SplitCohesion,
+    TokenizationMethod, DEFAULT_TOKENIZATION_METHOD, VERBOSE_FILES, VERBOSE_SUMMARY,
+};
+use crate::encoding::decode_non_utf8;
+use crate::estimate::estimate_tokens;
+use crate::formatter::{formatter, FileMetadata, FormattedFile, Formatter, Header};
+use crate::git::{current_ref, GitRef};
+use crate::interactive::{confirm_output_size, prompt_selection};
+use crate::interrupt::interrupted;
+use crate::mtime_cache::MtimeCache;
+use crate::output::language_name;
+use crate::paths::{flatten_names, mirror_path, relative_display_path, root_name};
+use crate::patterns::PatternSet;
+use crate::redact::Redactor;
+use crate::resume::{reopen_output, Progress, Resumed};
+use crate::sort::{sort_files, OrderWeights};
+use crate::source::{FileSource, OsFiles, Walk};
+use crate::split::{chunk_manifest_path, chunk_path, plan_chunks, write_chunk_manifest, Chunk};
+use crate::transform::{
+    apply_transformers, LineTransformer, NormalizeUnicode, RemoveBlankLines, StripImports,
+    StripTrailingNewlines, WrapLines,
+};
+use crate::SCHEMA_VERSION;
+
+pub const GENERATED_SCAN_LINES: usize = 5;
+const UTF8_BOM: char = '\u{feff}';
+pub const DEFAULT_GENERATED_MARKERS: &[&str] = &[
+    "Code generated",
+    "DO NOT EDIT",
+    "@generated",
+    "<auto-generated",
+];
+
+// Dependency lockfiles skipped by --exclude-lockfiles, matched by file name
+pub const LOCKFILE_NAMES: &[&str] = &[
+    "package-lock.json",
+    "npm-shrinkwrap.json",
+    "yarn.lock",
+    "pnpm-lock.yaml",
+    "bun.lockb",
+    "Cargo.lock",
+    "go.sum",
+    "poetry.lock",
+    "Pipfile.lock",
+    "uv.lock",
+    "composer.lock",
+    "Gemfile.lock",
+    "Podfile.lock",
+    "pubspec.lock",
+    "mix.lock",
+    "flake.lock",
+    "packages.lock.json",
+];
+
+// Test files skipped by --exclude-tests, matched with the same engine as
+// ignore patterns
+pub const TEST_FILE_PATTERNS: &[&str] = &[
+    "*_test.go",
+    "test_*.py",
+    "*_test.py",
+    "*.test.js",
+    "*.spec.js",
+    "*.test.jsx",
+    "*.spec.jsx",
+    "*.test.ts",
+    "*.spec.ts",
+    "*.test.tsx",
+    "*.spec.tsx",
+    "*Test.java",
+    "*Tests.java",
+    "*Test.kt",
+    "*_spec.rb",
+    "*_test.rb",
+    "*Tests.cs",
+];
+
+// Reading is bound by the disk rather than the CPU, so by default more files
+// are read at once than there are cores.
+pub const IO_THREADS_PER_CPU: usize = 4;
+
+pub const DOCKERIGNORE_FILE: &str = ".dockerignore";
+
+pub const EXIT_SKIPPED: i32 = 4;
+
+// How much of a streamed file is read, tokenized, and written at a time
+const STREAM_CHUNK_SIZE: usize = 1 << 20;
+
+// Tokens OpenAI's chat format adds around each message (role and framing)
+pub const DEFAULT_CHAT_OVERHEAD: usize = 3;
+
+// How much of a file without a text extension is checked for binary content
+// by --include-binary-as-base64
+const BINARY_SCAN_BYTES: usize = 8000;
+
+// The encoding noted on files included by --include-binary-as-base64
+const BASE64_ENCODING: &str = "base64";
+
+// Delay before the first --read-retries retry; it doubles with each retry
+const READ_RETRY_DELAY: Duration = Duration::from_millis(100);
+
+// Files filtered at once while looking for the first --max-files files
+const FILTER_BATCH_SIZE: usize = 256;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub enum SkipReason {
+    NonText,
+    Ignored,
+    NotIncluded,
+    Generated,
+    Lockfile,
+    Test,
+    Symlink,
+    ContentExcluded,
+    TooLarge,
+    Deselected,
+}
+
+impl SkipReason {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            SkipReason::NonText => "non-text",
+            SkipReason::Ignored => "ignored",
+            SkipReason::NotIncluded => "non-included",
+            SkipReason::Generated => "generated",
+            SkipReason::Lockfile => "lockfile",
+            SkipReason::Test => "test",
+            SkipReason::Symlink => "symlink",
+            SkipReason::ContentExcluded => "content-excluded",
+            SkipReason::TooLarge => "too-large",
+            SkipReason::Deselected => "deselected",
+        }
+    }
+
+    // Whether the file was left out by the user's own choices (patterns,
+    // flags, or selection) rather than because it could not be combined
+    pub fn is_deliberate(&self) -> bool {
+        !matches!(self, SkipReason::NonText)
+    }
+}
+
+// Wall-clock time of each phase of a run, with --timings. Traversal covers
+// the setup before the first file is read (loading the tokenizer, walking
+// and filtering); processing reads and tokenizes the files, writing them as
+// it goes when the output is in completion order; writing covers whatever
+// is written once all files are done (ordered output, chunks, the final flush).
+#[derive(Debug, Clone, Copy)]
+pub struct PhaseTimings {
+    pub traversal: Duration,
+    pub processing: Duration,
+    pub writing: Duration,
+}
+
+pub struct ProcessingResult {
+    pub files_processed: usize,
+    pub total_tokens: usize,
+    pub file_stats: Vec<(String, usize, u64)>,
+    pub skipped_files: Vec<(String, String)>,
+    pub skip_counts: BTreeMap<SkipReason, usize>,
+    // Every file left out by a filter, in path order, with --list-skipped
+    pub skip_list: Option<Vec<(String, SkipReason)>>,
+    pub redactions: Option<usize>,
+    pub chunks: Vec<Chunk>,
+    // The files written with --also-output
+    pub also_outputs: Vec<PathBuf>,
+    pub tokenizer_totals: Vec<(TokenizationMethod, usize)>,
+    pub files_truncated: usize,
+    pub line_endings: Option<LineEndingStats>,
+    pub prompt_tokens: Option<usize>,
+    pub toc_tokens: Option<usize>,
+    // Tokens of the --file-separator text between files
+    pub separator_tokens: Option<usize>,
+    pub chat_overhead_tokens: Option<usize>,
+    // Tokens of the headers and delimiters around each file, with
+    // --token-breakdown
+    pub delimiter_tokens: Option<usize>,
+    pub files_transcoded: Option<usize>,
+    // Files skipped because the run being resumed already wrote them
+    pub files_resumed: Option<usize>,
+    // Files left out by --since-last-run as not modified since the last run
+    pub files_unchanged: Option<usize>,
+    // Files cut down to fit --max-tokens by --proportional-truncate
+    pub files_cut_to_budget: Option<usize>,
+    // Words in the combined text files, with --count-words
+    pub total_words: Option<usize>,
+    // Tokens the blank lines removed by --compact would have taken
+    pub compact_tokens_saved: Option<usize>,
+    // Files read only after a retry, with --read-retries
+    pub files_retried: Option<usize>,
+    // Walked directories with nothing to combine, with --note-empty-dirs
+    pub empty_dirs: Option<Vec<String>>,
+    pub flatten_renames: Option<usize>,
+    pub estimated_size: u64,
+    pub sample: Option<(usize, usize)>,
+    pub interrupted: bool,
+    pub timings: Option<PhaseTimings>,
+    pub output_discarded: bool,
+    // Set with --warn-unused-ignores
+    pub unused_ignores: Option<Vec<String>>,
+}
+
+impl ProcessingResult {
+    // Files skipped for reasons other than the user's own filters: non-text
+    // files and files that failed to read
+    pub fn unexpected_skips(&self) -> usize {
+        let undeliberate: usize = self
+            .skip_counts
+            .iter()
+            .filter(|(reason, _)| !reason.is_deliberate())
+            .map(|(_, count)| count)
+            .sum();
+        undeliberate + self.skipped_files.len()
+    }
+}
+
+struct ContentPipeline {
+    transformers: Vec<Box<dyn LineTransformer>>,
+    redactor: Option<Redactor>,
+    redactions: AtomicUsize,
+    wrap: Option<WrapLines>,
+}
+
+impl ContentPipeline {
+    fn prepare(&self, path: &Path, content: String) -> String {
+        let mut content = apply_transformers(&self.transformers, path, content);
+        if let Some(redactor) = &self.redactor {
+            let (redacted, count) = redactor.redact(content);
+            content = redacted;
+            self.redactions.fetch_add(count, Ordering::Relaxed);
+        }
+        // Wrapping last keeps a secret split across lines from escaping the redactor
+        if let Some(wrap) = &self.wrap {
+            content = wrap.transform(path, &content);
+        }
+        content
+    }
+}
+
+enum OutputSink {
+    File(Mutex<BufWriter<File>>),
+    // Files are written once all are processed, in order (--sort) or in
+    // chunks (--split-tokens)
+    Collect(Mutex<Vec<FileEntry>>),
+    // --output-stats-only: files are counted but not written
+    Discard,
+}
+
+#[derive(Serialize)]
+struct FileEntry {
+    path: String,
+    #[serde(flatten)]
+    metadata: Option<FileMetadata>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    encoding: Option<&'static str>,
+    #[serde(rename = "contents")]
+    content: String,
+    tokens: usize,
+    // Bytes read, for --front-matter
+    #[serde(skip)]
+    size: u64,
+    // Position in the list of files to combine
+    #[serde(skip)]
+    position: usize,
+}
+
+impl FileEntry {
+    // `index` is the file's 1-based position in the output
+    fn formatted(&self, index: usize) -> FormattedFile<'_> {
+        FormattedFile {
+            path: &self.path,
+            metadata: self.metadata.as_ref(),
+            encoding: self.encoding,
+            contents: &self.content,
+            tokens: self.tokens,
+            index,
+        }
+    }
+}
+
+struct FileProcessor<'a> {
+    source: &'a dyn FileSource,
+    output: OutputSink,
+    layout: Layout,
+    files_written: AtomicUsize,
+    // --file-separator texts written to the output file in this run
+    separators_written: AtomicUsize,
+    progress: Option<Progress>,
+    bpe: Arc<Tokenizer>,
+    pipeline: ContentPipeline,
+    comparisons: Vec<(TokenizationMethod, Arc<Tokenizer>, AtomicUsize)>,
+    // Taken once the files to combine are known, before any is read
+    file_metadata: Option<HashMap<PathBuf, FileMetadata>>,
+    line_endings: Option<Mutex<LineEndingStats>>,
+    transcoded: Option<AtomicUsize>,
+    words: Option<AtomicUsize>,
+    // Tokens removed by --compact
+    compacted: Option<AtomicUsize>,
+    delimiter_tokens: Option<AtomicUsize>,
+    read_retries: usize,
+    retried: Option<AtomicUsize>,
+    binary_limit: Option<u64>,
+    verbose: u8,
+    display_names: HashMap<PathBuf, String>,
+    cpu_pool: ThreadPool,
+    stream_threshold: u64,
+    mirror_dir: Option<PathBuf>,
+}
 
 pub fn process_files(
     opt: &crate::config::Opt,
     output_file: &Path,
     ignore_patterns: &[String],
     config: &Config,
-) -> Result<(
-    usize,
-    usize,
-    Vec<(String, usize, u64)>,
-    Vec<(String, String)>,
-)> {
-    let output = Arc::new(Mutex::new(BufWriter::new(File::create(output_file)?)));
+) -> Result<ProcessingResult> {
+    process_files_from(&OsFiles, opt, output_file, ignore_patterns, config)
+}
+
+// Like `process_files`, but finds and reads the input files through `source`
+pub fn process_files_from(
+    source: &dyn FileSource,
+    opt: &crate::config::Opt,
+    output_file: &Path,
+    ignore_patterns: &[String],
+    config: &Config,
+) -> Result<ProcessingResult> {
+    let traversal_start = Instant::now();
+    // With --also-output, these apply to the outputs in their format
+    let formats: Vec<OutputFormat> = std::iter::once(opt.format)
+        .chain(opt.also_output.iter().map(|also_output| also_output.format))
+        .collect();
+    let text_output = formats.contains(&OutputFormat::Text);
+    if opt.separator.is_some() && !text_output {
+        bail!("--separator only applies to the text output format");
+    }
+    if opt.file_separator.is_some() && !text_output {
+        bail!("--file-separator only applies to the text output format");
+    }
+    if opt.front_matter.is_some() && !text_output {
+        bail!("--front-matter only applies to the text output format");
+    }
+    if opt.json_pretty && !formats.contains(&OutputFormat::Json) {
+        bail!("--json-pretty only applies to the json output format");
+    }
+    // Each chunk would need to be a complete document of its own
+    if opt.split_tokens.is_some() && opt.format == OutputFormat::Json {
+        bail!("--split-tokens does not support the json output format; use jsonl");
+    }
+    // Resuming appends entries, so the output cannot have anything after them
+    if opt.resume.is_some() && !matches!(opt.format, OutputFormat::Text | OutputFormat::Jsonl) {
+        bail!("--resume only supports the text and jsonl output formats");
+    }
+    if opt.since_last_run.is_some()
+        && !matches!(opt.format, OutputFormat::Text | OutputFormat::Jsonl)
+    {
+        bail!("--since-last-run only supports the text and jsonl output formats");
+    }
+    // Unknown formats fail before anything is walked
+    for format in &formats {
+        custom_formatter(*format, opt.toc)?;
+    }
     let tokenization_method = config
         .tokenization_method
         .as_ref()
-        .unwrap_or(&opt.tokenization_method);
-    let bpe = Arc::new(get_tokenizer(tokenization_method)?);
+        .unwrap_or(&DEFAULT_TOKENIZATION_METHOD);
+    let bpe = get_tokenizer(tokenization_method)?;
+
+    let prompt = read_prompt(opt)?;
+    let prompt_tokens = prompt.as_ref().map(|prompt| bpe.count(prompt));
+    let comparisons = opt
+        .compare_tokenizers
+        .iter()
+        .map(|method| Ok((method.clone(), get_tokenizer(method)?, AtomicUsize::new(0))))
+        .collect::<Result<Vec<_>>>()?;
 
     let file_stats = Arc::new(Mutex::new(Vec::new()));
     let skipped_files = Arc::new(Mutex::new(Vec::new()));
+    let skip_counts = Mutex::new(BTreeMap::new());
+    let skip_list = opt.list_skipped.then(|| Mutex::new(Vec::new()));
+    let record_skip = |path: &Path, reason: SkipReason| {
+        *skip_counts.lock().unwrap().entry(reason).or_insert(0) += 1;
+        if let Some(skip_list) = &skip_list {
+            let path = path.to_string_lossy().into_owned();
+            skip_list.lock().unwrap().push((path, reason));
+        }
+    };
+    let mut ignore_patterns = PatternSet::new(ignore_patterns)?;
+    if opt.use_dockerignore {
+        for root in opt.input_dirs.iter().filter(|root| !root.is_file()) {
+            let dockerignore = root.join(DOCKERIGNORE_FILE);
+            if dockerignore.is_file() {
+                ignore_patterns.add_anchored(root, &load_pattern_file(&dockerignore)?)?;
+            } else if opt.verbose >= VERBOSE_SUMMARY {
+                println!("No {} found in {:?}", DOCKERIGNORE_FILE, root);
+            }
+        }
+    }
+    let include_patterns = PatternSet::new(&merge_patterns(
+        &opt.include_patterns,
+        &config.include_patterns,
+    ))?;
+    let include_patterns = if include_patterns.is_empty() {
+        None
+    } else {
+        Some(include_patterns)
+    };
 
-    let files: Vec<_> = WalkDir::new(&opt.input_dir)
-        .into_iter()
-        .filter_map(Result::ok)
+    let redactor = if opt.redact {
+        Some(Redactor::new(
+            config.redact_patterns.as_deref().unwrap_or_default(),
+        )?)
+    } else {
+        None
+    };
+    let mut transformers: Vec<Box<dyn LineTransformer>> = Vec::new();
+    // Normalized first, so later steps see the same text for the same words
+    if let Some(form) = opt.normalize_unicode {
+        transformers.push(Box::new(NormalizeUnicode { form }));
+    }
+    if opt.strip_imports {
+        transformers.push(Box::new(StripImports));
+    }
+    // After import stripping, which can leave an import-only file blank
+    if opt.strip_trailing_newlines_per_file {
+        transformers.push(Box::new(StripTrailingNewlines));
+    }
+    let pipeline = ContentPipeline {
+        transformers,
+        redactor,
+        redactions: AtomicUsize::new(0),
+        wrap: opt.wrap.map(|width| WrapLines { width }),
+    };
+
+    let generated_markers: Option<Vec<String>> = if opt.exclude_generated {
+        Some(config.generated_markers.clone().unwrap_or_else(|| {
+            DEFAULT_GENERATED_MARKERS
+                .iter()
+                .map(|m| m.to_string())
+                .collect()
+        }))
+    } else {
+        None
+    };
+
+    // Ignored directories are not walked at all (e.g. node_modules)
+    let visited_dirs = Mutex::new(BTreeSet::new());
+    let skip_dir = |dir: &Path| {
+        let ignored = ignore_patterns.matches_dir(dir);
+        if ignored && opt.verbose >= VERBOSE_SUMMARY {
+            println!("Skipping ignored directory: {:?}", dir);
+        }
+        if !ignored && opt.note_empty_dirs {
+            visited_dirs.lock().unwrap().insert(dir.to_path_buf());
+        }
+        ignored
+    };
+    // A depth given with an input (path:depth) wins over --max-depth
+    let depths: Vec<Option<usize>> = (0..opt.input_dirs.len())
+        .map(|i| opt.root_depths.get(i).copied().flatten().or(opt.max_depth))
+        .collect();
+    let mut walk_errors = Vec::new();
+    let entries = collect_input_files(
+        source,
+        &opt.input_dirs,
+        &depths,
+        opt.parallel_roots,
+        &skip_dir,
+        &mut walk_errors,
+    )?;
+    // Paths that could not be walked are reported with the unreadable files,
+    // or with --strict end the run
+    if let (true, Some((path, error))) = (opt.strict, walk_errors.first()) {
+        bail!("Failed to walk {:?}: {}", path, error);
+    }
+    skipped_files.lock().unwrap().extend(
+        walk_errors
+            .into_iter()
+            .map(|(path, error)| (path.to_string_lossy().into_owned(), error)),
+    );
+    let binary_limit = if opt.include_binary_as_base64 {
+        opt.max_binary_size
+    } else {
+        None
+    };
+    let test_patterns = if opt.exclude_tests {
+        Some(test_file_patterns()?)
+    } else {
+        None
+    };
+    let filters = Filters {
+        ignore_patterns: &ignore_patterns,
+        test_patterns: test_patterns.as_ref(),
+        include_patterns: include_patterns.as_ref(),
+        generated_markers: generated_markers.as_deref(),
+        exclude_lockfiles: opt.exclude_lockfiles,
+        ignore_symlinks: opt.ignore_symlinks,
+        binary_limit,
+        excluded_content: opt.exclude_content_matching.as_ref(),
+        max_file_size: opt.max_file_size,
+    };
+    let roots: HashMap<&Path, &Path> = entries
+        .iter()
+        .map(|(root, path)| (path.as_path(), *root))
         .collect();
 
-    let files_processed = files
-        .par_iter()
-        .filter(|entry| {
-            let path = entry.path();
-            if entry.file_type().is_file() {
-                if is_text_file(path)
-                    && !should_ignore(path, ignore_patterns)
-                    && should_include(path, &config.include_patterns)
-                {
-                    true
-                } else {
-                    if opt.verbose {
-                        print_skip_reason(path, ignore_patterns, &config.include_patterns);
-                    }
-                    false
+    // A file named explicitly on the command line is always combined
+    let explicit_files: HashSet<&Path> = opt
+        .input_dirs
+        .iter()
+        .filter(|input| source.is_file(input))
+        .map(PathBuf::as_path)
+        .collect();
+    let (explicit, walked): (Vec<&Path>, Vec<&Path>) = entries
+        .iter()
+        .map(|(_, path)| path.as_path())
+        .partition(|path| explicit_files.contains(roots[path]));
+    let mut files = explicit;
+
+    // Sorting first lets --max-files keep e.g. the newest files
+    let ordered = opt.sort.is_some() || !opt.order_weight.is_empty();
+    // Without an order or a sample to choose from all of them, --max-files
+    // keeps the first files that pass the filters, so the files after those
+    // are never examined at all
+    let filter_limit = opt.max_files.filter(|_| {
+        !ordered && opt.sample.is_none() && !opt.max_files_error && !opt.note_empty_dirs
+    });
+    let mut unexamined = 0;
+    let kept = if opt.interactive {
+        let candidates: Vec<(&Path, Option<SkipReason>)> = walked
+            .iter()
+            .map(|path| (*path, skip_reason(source, path, &filters)))
+            .collect();
+        let mut deselected = Vec::new();
+        let selected = select_files(candidates, &mut deselected, prompt_selection)?;
+        for (path, reason) in deselected {
+            record_skip(path, reason);
+        }
+        selected
+    } else {
+        let keep = |path: &&Path| match skip_reason(source, path, &filters) {
+            Some(reason) => {
+                if opt.verbose >= VERBOSE_FILES {
+                    print_skip_reason(path, reason);
                 }
-            } else {
+                record_skip(path, reason);
                 false
             }
-        })
-        .count();
+            None => true,
+        };
+        match filter_limit {
+            Some(limit) => {
+                // Filtered a batch at a time, in walk order
+                let mut kept = Vec::new();
+                let mut batches = walked.chunks(FILTER_BATCH_SIZE);
+                while files.len() + kept.len() < limit {
+                    let batch = match batches.next() {
+                        Some(batch) => batch,
+                        None => break,
+                    };
+                    let passed: Vec<&Path> = batch.par_iter().copied().filter(&keep).collect();
+                    kept.extend(passed);
+                }
+                unexamined = batches.map(<[&Path]>::len).sum();
+                kept
+            }
+            None => walked.into_par_iter().filter(&keep).collect(),
+        }
+    };
+    files.extend(kept);
 
-    let total_tokens: usize = files
-        .par_iter()
-        .filter(|entry| {
-            let path = entry.path();
-            path.is_file()
-                && is_text_file(path)
-                && !should_ignore(path, ignore_patterns)
-                && should_include(path, &config.include_patterns)
-        })
-        .map(|entry| {
-            let path = entry.path();
-            if opt.verbose {
-                println!("Processing file: {:?}", path);
-            }
-            (
-                path.to_string_lossy().into_owned(),
-                process_file(path, &output, &bpe),
+    // Found before sampling or --max-files, which would make directories
+    // look empty that only lost files to the cut
+    let empty_dirs = if opt.note_empty_dirs {
+        let mut visited_dirs = visited_dirs.into_inner().unwrap();
+        visited_dirs.extend(
+            opt.input_dirs
+                .iter()
+                .filter(|input| !source.is_file(input))
+                .cloned(),
+        );
+        Some(find_empty_dirs(visited_dirs, &files))
+    } else {
+        None
+    };
+
+    let mut sample = None;
+    if let Some(sample_size) = opt.sample {
+        if files.len() > sample_size {
+            files.sort();
+            sample = Some((sample_size, files.len()));
+            files = sample_evenly(&files, sample_size);
+        }
+    }
+
+    if ordered {
+        let weights = OrderWeights::new(&opt.order_weight)?;
+        sort_files(source, &mut files, opt.sort, &weights);
+    }
+
+    let mut files_truncated = unexamined;
+    if let Some(max_files) = opt.max_files {
+        if files.len() > max_files {
+            if opt.max_files_error {
+                bail!(
+                    "Found {} files to combine, more than --max-files {}",
+                    files.len(),
+                    max_files
+                );
+            }
+            files_truncated += files.len() - max_files;
+            files.truncate(max_files);
+        }
+    }
+
+    // Nothing is written, not even an empty output file, when a secret is found
+    if opt.abort_on_secret {
+        let scanner = Redactor::new(config.redact_patterns.as_deref().unwrap_or_default())?;
+        let secrets = find_secrets(source, &files, &scanner);
+        if !secrets.is_empty() {
+            bail!(
+                "Aborted: likely secrets found (--abort-on-secret):\n{}",
+                secrets.join("\n")
+            );
+        }
+    }
+
+    let (display_names, flatten_renames) = if opt.flatten {
+        let (names, renamed) = flatten_names(&files);
+        (names, Some(renamed))
+    } else {
+        let mut root_names = HashMap::new();
+        let names = files
+            .iter()
+            .map(|path| {
+                let root = roots[path];
+                let name = relative_display_path(root, path);
+                // Input files, rather than directories, are shown as given
+                let root_name = if opt.include_root_name && root != *path {
+                    root_names
+                        .entry(root)
+                        .or_insert_with(|| root_name(root))
+                        .as_deref()
+                } else {
+                    None
+                };
+                let name = match root_name {
+                    Some(root_name) => format!("{}/{}", root_name, name),
+                    None => name,
+                };
+                (path.to_path_buf(), name)
+            })
+            .collect();
+        (names, None)
+    };
+
+    // Files already written by the run being resumed
+    let resumed = match &opt.resume {
+        Some(progress_file) => Some(Resumed::load(progress_file)?),
+        None => None,
+    };
+    let files_resumed = resumed.as_ref().map(|resumed| {
+        let before = files.len();
+        files.retain(|path| !resumed.files.contains(*path));
+        before - files.len()
+    });
+
+    // With --since-last-run only files modified since the last run are
+    // combined, and appended to its output. The times are taken before the
+    // files are read, so a file changed while being read is combined again
+    // next time.
+    let last_run = match &opt.since_last_run {
+        Some(cache_file) => Some(MtimeCache::load(cache_file)?),
+        None => None,
+    };
+    let modified_times: HashMap<PathBuf, Option<SystemTime>> = if last_run.is_some() {
+        files
+            .par_iter()
+            .map(|path| (path.to_path_buf(), modified_time(source, path)))
+            .collect()
+    } else {
+        HashMap::new()
+    };
+    // Without the earlier output to append to, everything is combined again
+    let previous_run = last_run
+        .as_ref()
+        .and_then(Option::as_ref)
+        .filter(|_| output_file.exists());
+    let files_unchanged = previous_run.map(|cache| {
+        let before = files.len();
+        files.retain(|path| cache.is_changed(path, modified_times[*path]));
+        before - files.len()
+    });
+    let appended_len = match previous_run {
+        Some(_) => Some(fs::metadata(output_file)?.len()),
+        None => None,
+    };
+
+    // Check the expected size before the output file is created
+    let git_ref = if opt.git_ref_header {
+        // A single input file is looked up from the directory containing it
+        let input = &opt.input_dirs[0];
+        let dir = if input.is_file() {
+            input.parent().unwrap_or(Path::new("."))
+        } else {
+            input
+        };
+        let git_ref = current_ref(dir);
+        if git_ref.is_none() && opt.verbose >= VERBOSE_SUMMARY {
+            println!(
+                "Not a git repository, leaving out the git header: {:?}",
+                dir
+            );
+        }
+        git_ref
+    } else {
+        None
+    };
+    // Every layout option as given. Each output's layout is derived from it,
+    // dropping the options that do not apply to that output's format, so an
+    // --also-output still gets e.g. --json-pretty when the main output is
+    // not json
+    let base_layout = Layout {
+        format: opt.format,
+        custom: None,
+        separator: opt.separator.clone(),
+        file_separator: opt.file_separator.clone().unwrap_or_default(),
+        front_matter: opt.front_matter,
+        json_pretty: opt.json_pretty,
+        git_ref,
+        empty_dirs,
+        trailing_newline: !opt.no_trailing_newline,
+        write_buffer_size: opt.write_buffer_size,
+    };
+    let layout = base_layout.with_format(opt.format)?;
+    let estimated_size =
+        estimate_output_size(source, &files, &display_names, prompt.as_deref(), &layout);
+    let output_discarded = opt.output_stats_only.is_some() || opt.dry_run;
+    if let (Some(threshold), false) = (opt.confirm_over, output_discarded) {
+        if estimated_size > threshold && !opt.yes && !confirm_output_size(estimated_size)? {
+            bail!("Aborted: estimated output size exceeds --confirm-over");
+        }
+    }
+
+    // The length to keep of an earlier output being appended to
+    let reopened_len = resumed
+        .as_ref()
+        .and_then(|resumed| resumed.output_len)
+        .or(appended_len);
+    let output = match opt.split_tokens {
+        Some(_) => OutputSink::Collect(Mutex::new(Vec::new())),
+        None if output_discarded => OutputSink::Discard,
+        // Files are collected and written once all are read when they are
+        // written in sorted order, when the table of contents or
+        // --proportional-truncate needs every file's token count up front,
+        // or when --also-output writes every file once per output
+        None if ordered || opt.toc || opt.proportional_truncate || !opt.also_output.is_empty() => {
+            OutputSink::Collect(Mutex::new(Vec::new()))
+        }
+        None => {
+            let file = match reopened_len {
+                Some(len) => reopen_output(output_file, len)?,
+                None => create_output(output_file)?,
+            };
+            OutputSink::File(Mutex::new(BufWriter::with_capacity(
+                layout.write_buffer_size,
+                file,
+            )))
+        }
+    };
+    // An output appended to already has its preamble and earlier files
+    let files_written = match (&resumed, previous_run) {
+        (Some(resumed), _) => resumed.files.len(),
+        (None, Some(cache)) => cache.len(),
+        (None, None) => 0,
+    };
+    if let (OutputSink::File(output), None) = (&output, reopened_len) {
+        layout.write_preamble(&mut *output.lock().unwrap(), prompt.as_deref(), None)?;
+    }
+    let progress = match (&opt.resume, &resumed) {
+        (Some(progress_file), Some(resumed)) if files_written > 0 => {
+            Some(Progress::open(progress_file, resumed.progress_len)?)
+        }
+        (Some(progress_file), _) => Some(Progress::open(progress_file, 0)?),
+        _ => None,
+    };
+    let processor = FileProcessor {
+        source,
+        output,
+        layout,
+        files_written: AtomicUsize::new(files_written),
+        separators_written: AtomicUsize::new(0),
+        progress,
+        bpe,
+        pipeline,
+        comparisons,
+        file_metadata: if opt.include_metadata {
+            Some(
+                files
+                    .par_iter()
+                    .filter_map(|path| {
+                        let metadata = source.metadata(path)?;
+                        Some((path.to_path_buf(), file_metadata(&metadata)))
+                    })
+                    .collect(),
             )
-        })
-        .filter_map(|(path, result)| match result {
-            Ok((file_tokens, file_size)) => {
-                file_stats
-                    .lock()
-                    .unwrap()
-                    .push((path.clone(), file_tokens, file_size));
-                Some(file_tokens)
+        } else {
+            None
+        },
+        line_endings: if opt.analyze {
+            Some(Mutex::new(LineEndingStats::default()))
+        } else {
+            None
+        },
+        transcoded: if opt.detect_encoding {
+            Some(AtomicUsize::new(0))
+        } else {
+            None
+        },
+        words: if opt.count_words {
+            Some(AtomicUsize::new(0))
+        } else {
+            None
+        },
+        compacted: if opt.compact {
+            Some(AtomicUsize::new(0))
+        } else {
+            None
+        },
+        delimiter_tokens: if opt.token_breakdown {
+            Some(AtomicUsize::new(0))
+        } else {
+            None
+        },
+        read_retries: opt.read_retries,
+        binary_limit,
+        retried: if opt.read_retries > 0 {
+            Some(AtomicUsize::new(0))
+        } else {
+            None
+        },
+        verbose: opt.verbose,
+        display_names,
+        stream_threshold: opt.stream_threshold,
+        mirror_dir: opt.mirror_to.clone(),
+        cpu_pool: thread_pool(opt.cpu_concurrency, 1)?,
+    };
+    let io_pool = thread_pool(opt.io_concurrency, IO_THREADS_PER_CPU)?;
+
+    // Each file is read on the I/O pool
+    let processing_start = Instant::now();
+    let traversal = processing_start - traversal_start;
+    let failed = AtomicBool::new(false);
+    let file_tokens: usize = io_pool.install(|| {
+        files
+            .par_iter()
+            .enumerate()
+            .filter(|_| !interrupted() && !(opt.strict && failed.load(Ordering::Relaxed)))
+            .map(|(position, path)| {
+                if opt.verbose >= VERBOSE_FILES {
+                    println!("Processing file: {:?}", path);
+                }
+                (
+                    path.to_string_lossy().into_owned(),
+                    processor.process_file(path, position),
+                )
+            })
+            .filter_map(|(path, result)| match result {
+                Ok((file_tokens, file_size)) => {
+                    file_stats
+                        .lock()
+                        .unwrap()
+                        .push((path.clone(), file_tokens, file_size));
+                    Some(file_tokens)
+                }
+                Err(e) => {
+                    failed.store(true, Ordering::Relaxed);
+                    skipped_files
+                        .lock()
+                        .unwrap()
+                        .push((path.clone(), e.to_string()));
+                    if opt.verbose >= VERBOSE_FILES {
+                        println!("Skipped file due to error: {:?} - {}", path, e);
+                    }
+                    None
+                }
+            })
+            .sum()
+    });
+    // With --strict the first unreadable file ends the run. Files not yet
+    // started are left alone, and a partly written output is removed, unless
+    // it can be resumed.
+    if opt.strict {
+        if let Some((_, error)) = skipped_files.lock().unwrap().first() {
+            if let (OutputSink::File(_), None) = (&processor.output, &opt.resume) {
+                let _ = fs::remove_file(output_file);
             }
-            Err(e) => {
-                skipped_files
-                    .lock()
-                    .unwrap()
-                    .push((path.clone(), e.to_string()));
-                if opt.verbose {
-                    println!("Skipped file due to error: {:?} - {}", path, e);
+            bail!("{}", error);
+        }
+    }
+    // Each combined file is counted as one chat message
+    let chat_overhead_tokens = opt.chat_overhead.map(|overhead| {
+        overhead.unwrap_or(DEFAULT_CHAT_OVERHEAD) * file_stats.lock().unwrap().len()
+    });
+    let delimiter_tokens = processor
+        .delimiter_tokens
+        .as_ref()
+        .map(|tokens| tokens.load(Ordering::Relaxed));
+    let mut total_tokens = file_tokens
+        + prompt_tokens.unwrap_or(0)
+        + chat_overhead_tokens.unwrap_or(0)
+        + delimiter_tokens.unwrap_or(0);
+
+    // Only files that were actually combined count as processed; unreadable
+    // ones are reported separately, and after Ctrl-C some were never started
+    let was_interrupted = interrupted();
+    let files_processed = file_stats.lock().unwrap().len();
+    if opt.verbose >= VERBOSE_SUMMARY {
+        print_directory_summary(&file_stats.lock().unwrap());
+    }
+
+    let FileProcessor {
+        output,
+        pipeline,
+        comparisons,
+        line_endings,
+        transcoded,
+        words,
+        compacted,
+        retried,
+        layout,
+        bpe,
+        separators_written,
+        ..
+    } = processor;
+
+    let writing_start = Instant::now();
+    let processing = writing_start - processing_start;
+    let mut toc_tokens = None;
+    let mut files_cut_to_budget = None;
+    // Without an output file, as many as writing one would have taken
+    let mut separators = files_processed.saturating_sub(1);
+    let chunks = match (output, opt.split_tokens) {
+        (OutputSink::Collect(collected), Some(max_tokens)) => {
+            let mut collected = collected.into_inner().unwrap();
+            if ordered {
+                collected.sort_by_key(|entry| entry.position);
+            } else {
+                collected.sort_by(|a, b| a.path.cmp(&b.path));
+            }
+            let chunks = write_chunks(
+                output_file,
+                collected,
+                max_tokens,
+                opt.split_cohesion,
+                prompt.as_deref(),
+                &layout,
+            )?;
+            write_chunk_manifest(&chunk_manifest_path(output_file), &chunks)?;
+            separators = chunks
+                .iter()
+                .map(|chunk| chunk.files.len().saturating_sub(1))
+                .sum();
+            chunks
+        }
+        (OutputSink::Collect(collected), None) => {
+            let mut collected = collected.into_inner().unwrap();
+            if ordered {
+                collected.sort_by_key(|entry| entry.position);
+            } else {
+                collected.sort_by(|a, b| a.path.cmp(&b.path));
+            }
+            if let (Some(max_tokens), true) = (opt.max_tokens, opt.proportional_truncate) {
+                let (cut, tokens_removed) =
+                    truncate_proportionally(&mut collected, max_tokens, &bpe);
+                total_tokens -= tokens_removed;
+                // The per-file statistics follow the truncated contents
+                let tokens: HashMap<String, usize> = collected
+                    .iter()
+                    .map(|entry| {
+                        (
+                            files[entry.position].to_string_lossy().into_owned(),
+                            entry.tokens,
+                        )
+                    })
+                    .collect();
+                for (path, file_tokens, _) in file_stats.lock().unwrap().iter_mut() {
+                    if let Some(&truncated) = tokens.get(path.as_str()) {
+                        *file_tokens = truncated;
+                    }
                 }
+                files_cut_to_budget = Some(cut);
+            }
+            let toc = if opt.toc {
+                Some(layout.toc(&collected)?)
+            } else {
                 None
+            };
+            toc_tokens = toc.as_deref().map(|toc| bpe.count(toc));
+            separators = write_in_order(
+                output_file,
+                &collected,
+                prompt.as_deref(),
+                toc.as_deref(),
+                &layout,
+            )?;
+            for also_output in &opt.also_output {
+                let layout = base_layout.with_format(also_output.format)?;
+                let toc = if opt.toc {
+                    Some(layout.toc(&collected)?)
+                } else {
+                    None
+                };
+                write_in_order(
+                    &also_output.path,
+                    &collected,
+                    prompt.as_deref(),
+                    toc.as_deref(),
+                    &layout,
+                )?;
             }
-        })
-        .sum();
+            Vec::new()
+        }
+        (OutputSink::File(output), _) => {
+            layout.finish(output.into_inner().unwrap())?;
+            separators = separators_written.into_inner();
+            Vec::new()
+        }
+        _ => Vec::new(),
+    };
+    // File separators go between the files of each output file (or chunk),
+    // and are tokenized on their own like the prompt. Only those written in
+    // this run count, not those of an output resumed or appended to.
+    let separator_tokens = opt
+        .file_separator
+        .as_ref()
+        .map(|separator| bpe.count(separator) * separators);
+    if let (Some(cache_file), Some(last_run)) = (&opt.since_last_run, last_run) {
+        let mut cache = last_run.unwrap_or_default();
+        for (path, _, _) in file_stats.lock().unwrap().iter() {
+            let path = Path::new(path);
+            cache.record(path, modified_times.get(path).copied().flatten());
+        }
+        cache.save(cache_file)?;
+    }
+    let timings = PhaseTimings {
+        traversal,
+        processing,
+        writing: writing_start.elapsed(),
+    };
 
-    Ok((
+    Ok(ProcessingResult {
         files_processed,
-        total_tokens,
-        Arc::try_unwrap(file_stats).unwrap().into_inner().unwrap(),
-        Arc::try_unwrap(skipped_files)
+        total_tokens: total_tokens + toc_tokens.unwrap_or(0) + separator_tokens.unwrap_or(0),
+        file_stats: Arc::try_unwrap(file_stats).unwrap().into_inner().unwrap(),
+        skipped_files: Arc::try_unwrap(skipped_files)
             .unwrap()
             .into_inner()
             .unwrap(),
-    ))
+        skip_counts: skip_counts.into_inner().unwrap(),
+        skip_list: skip_list.map(|skip_list| {
+            let mut skip_list = skip_list.into_inner().unwrap();
+            skip_list.sort();
+            skip_list
+        }),
+        redactions: pipeline.redactor.map(|_| pipeline.redactions.into_inner()),
+        chunks,
+        also_outputs: opt
+            .also_output
+            .iter()
+            .map(|also_output| also_output.path.clone())
+            .collect(),
+        tokenizer_totals: comparisons
+            .into_iter()
+            .map(|(method, _, total)| (method, total.into_inner()))
+            .collect(),
+        files_truncated,
+        line_endings: line_endings.map(|stats| stats.into_inner().unwrap()),
+        prompt_tokens,
+        toc_tokens,
+        separator_tokens,
+        chat_overhead_tokens,
+        delimiter_tokens,
+        files_transcoded: transcoded.map(AtomicUsize::into_inner),
+        files_resumed,
+        files_unchanged,
+        files_cut_to_budget,
+        total_words: words.map(AtomicUsize::into_inner),
+        compact_tokens_saved: compacted.map(AtomicUsize::into_inner),
+        files_retried: retried.map(AtomicUsize::into_inner),
+        empty_dirs: layout.empty_dirs,
+        flatten_renames,
+        estimated_size,
+        sample,
+        interrupted: was_interrupted,
+        timings: opt.timings.then_some(timings),
+        output_discarded,
+        unused_ignores: if opt.warn_unused_ignores {
+            Some(ignore_patterns.unused())
+        } else {
+            None
+        },
+    })
+}
+
+// The prompt is written exactly as returned here, separated from the first
+// file by a blank line, so its token count matches the output.
+fn read_prompt(opt: &crate::config::Opt) -> Result<Option<String>> {
+    let prompt = match (&opt.prompt, &opt.prompt_file) {
+        (Some(prompt), _) => prompt.clone(),
+        (None, Some(prompt_file)) => fs::read_to_string(prompt_file)
+            .with_context(|| format!("Failed to read prompt file: {:?}", prompt_file))?,
+        (None, None) => return Ok(None),
+    };
+    Ok(Some(format!("{}\n\n", prompt.trim_end())))
+}
+
+// Encodings already loaded, so that a process combining several directories
+// (or comparing tokenizers) builds each one only once. Each encoding has a
+// slot of its own, locked while it loads, so concurrent callers asking for
+// the same encoding wait for it rather than loading it again, while other
+// encodings load alongside it. A load that fails leaves its slot empty for
+// the next caller to try again.
+static TOKENIZERS: Mutex<BTreeMap<TokenizationMethod, TokenizerSlot>> = Mutex::new(BTreeMap::new());
+
+type TokenizerSlot = Arc<Mutex<Option<Arc<Tokenizer>>>>;
+
+fn get_tokenizer(method: &TokenizationMethod) -> Result<Arc<Tokenizer>> {
+    load_tokenizer(&TOKENIZERS, method, load_encoding)
 }
 
-fn get_tokenizer(method: &TokenizationMethod) -> Result<CoreBPE> {
-    match method {
+// get_tokenizer with the cache and the loader passed in, so tests can make
+// loading fail
+fn load_tokenizer(
+    tokenizers: &Mutex<BTreeMap<TokenizationMethod, TokenizerSlot>>,
+    method: &TokenizationMethod,
+    load: impl FnOnce(&TokenizationMethod) -> Result<Tokenizer>,
+) -> Result<Arc<Tokenizer>> {
+    // Neither lock guards anything a panic could leave half-updated, so a
+    // poisoned one is used as is
+    let slot = Arc::clone(
+        tokenizers
+            .lock()
+            .unwrap_or_else(PoisonError::into_inner)
+            .entry(method.clone())
+            .or_default(),
+    );
+    let mut slot = slot.lock().unwrap_or_else(PoisonError::into_inner);
+    if let Some(bpe) = &*slot {
+        return Ok(Arc::clone(bpe));
+    }
+    // A tokenizer that fails to load is an error for the caller to report,
+    // never a panic, so library users can recover from it
+    let bpe = Arc::new(load(method).with_context(|| {
+        format!(
+            "Failed to load the {} tokenizer; check that --tokenization-method names \
+             a known tokenizer (see --list-tokenizers), or use \
+             --tokenization-method estimate, which needs no encoding data",
+            method.encoding_name()
+        )
+    })?);
+    *slot = Some(Arc::clone(&bpe));
+    Ok(bpe)
+}
+
+fn load_encoding(method: &TokenizationMethod) -> Result<Tokenizer> {
+    let bpe = match method {
         TokenizationMethod::O200kBase => o200k_base(),
         TokenizationMethod::Cl100kBase => cl100k_base(),
         TokenizationMethod::P50kBase => p50k_base(),
         TokenizationMethod::P50kEdit => p50k_edit(),
         TokenizationMethod::R50kBase => r50k_base(),
-    }
+        TokenizationMethod::Estimate => return Ok(Tokenizer::Estimate),
+    };
+    Ok(Tokenizer::Bpe(bpe?))
 }
 
 fn is_text_file(path: &Path) -> bool {
@@ -133,7 +1205,14 @@ fn is_text_file(path: &Path) -> bool {
                     | "yml"
                     | "py"
                     | "js"
+                    | "jsx"
                     | "ts"
+                    | "tsx"
+                    | "go"
+                    | "java"
+                    | "kt"
+                    | "rb"
+                    | "cs"
                     | "html"
                     | "css"
                     | "sh"
@@ -149,60 +1228,3794 @@ fn is_text_file(path: &Path) -> bool {
         .unwrap_or(false)
 }
 
-fn should_ignore(path: &Path, ignore_patterns: &[String]) -> bool {
+fn should_ignore(path: &Path, ignore_patterns: &PatternSet) -> bool {
     let file_name = path.file_name().and_then(|n| n.to_str()).unwrap_or("");
 
-    ignore_patterns
-        .iter()
-        .any(|pattern| path.to_str().map(|s| s.contains(pattern)).unwrap_or(false))
-        || file_name.starts_with(crate::DEFAULT_OUTPUT_PREFIX)
+    ignore_patterns.matches(path) || file_name.starts_with(crate::DEFAULT_OUTPUT_PREFIX)
 }
 
-fn should_include(path: &Path, include_patterns: &Option<Vec<String>>) -> bool {
+fn should_include(path: &Path, include_patterns: Option<&PatternSet>) -> bool {
     include_patterns
-        .as_ref()
-        .map(|patterns| {
-            patterns.is_empty()
-                || patterns
-                    .iter()
-                    .any(|pattern| path.to_str().map(|s| s.contains(pattern)).unwrap_or(false))
-        })
+        .map(|patterns| patterns.matches(path))
         .unwrap_or(true)
 }
 
-fn process_file(
-    path: &Path,
-    output: &Arc<Mutex<BufWriter<File>>>,
-    bpe: &Arc<CoreBPE>,
-) -> Result<(usize, u64)> {
-    let mut output = output.lock().unwrap();
-    write!(output, "File: {:?}\n", path)?;
-    writeln!(output, "{}", "-".repeat(80))?;
+pub fn is_lockfile(path: &Path) -> bool {
+    path.file_name()
+        .and_then(|name| name.to_str())
+        .map(|name| LOCKFILE_NAMES.contains(&name))
+        .unwrap_or(false)
+}
 
-    let content =
-        fs::read_to_string(path).with_context(|| format!("Failed to read file: {:?}", path))?;
+pub fn test_file_patterns() -> Result<PatternSet> {
+    let patterns: Vec<String> = TEST_FILE_PATTERNS
+        .iter()
+        .map(|pattern| pattern.to_string())
+        .collect();
+    PatternSet::new(&patterns)
+}
 
-    write!(output, "{}", content)?;
-    writeln!(output, "{}", "-".repeat(80))?;
+// With --include-binary-as-base64, a file without a text extension is
+// combined when it is small enough and actually binary; text files with
+// unknown extensions are still skipped.
+fn is_included_binary(source: &dyn FileSource, path: &Path, binary_limit: Option<u64>) -> bool {
+    let fits = match (binary_limit, source.len(path)) {
+        (Some(limit), Ok(len)) => len <= limit,
+        _ => false,
+    };
+    let mut start = Vec::new();
+    fits && source
+        .open(path)
+        .and_then(|file| file.take(BINARY_SCAN_BYTES as u64).read_to_end(&mut start))
+        .is_ok()
+        && looks_binary(&start)
+}
 
-    let tokens = bpe.encode_ordinary(&content);
-    let file_size = fs::metadata(path)?.len();
-    Ok((tokens.len(), file_size))
+// NUL bytes or bytes that are not UTF-8. A character cut off at the end of
+// `bytes` does not count, so this also works on the start of a file.
+fn looks_binary(bytes: &[u8]) -> bool {
+    bytes.contains(&0)
+        || matches!(std::str::from_utf8(bytes), Err(error) if error.error_len().is_some())
 }
 
-pub fn print_skip_reason(
-    path: &Path,
-    ignore_patterns: &[String],
-    include_patterns: &Option<Vec<String>>,
-) {
-    if !path.is_file() {
-        println!("Skipping non-file: {:?}", path);
-    } else if !is_text_file(path) {
-        println!("Skipping non-text file: {:?}", path);
-    } else if should_ignore(path, ignore_patterns) {
-        println!("Skipping ignored file: {:?}", path);
-    } else if !should_include(path, include_patterns) {
-        println!("Skipping non-included file: {:?}", path);
+// What a streamed file adds to the run's totals
+struct Streamed {
+    tokens: usize,
+    // Per --compare-tokenizers tokenizer, in order
+    compared: Vec<usize>,
+    words: usize,
+    compacted: usize,
+    file_size: u64,
+    line_ending: LineEnding,
+}
+
+// Removes everything written to `output` after `start`, so a file that
+// fails part way through leaves nothing of its entry behind
+fn roll_back(output: &mut BufWriter<File>, start: u64) -> Result<()> {
+    output.flush()?;
+    output.get_mut().set_len(start)?;
+    output.seek(io::SeekFrom::Start(start))?;
+    Ok(())
+}
+
+// Matched a line at a time, as grep does, so only the longest line is ever
+// held in memory; this is the last filter applied, and files it keeps are
+// read a second time when they are combined
+fn has_matching_content(source: &dyn FileSource, path: &Path, regex: &Regex) -> bool {
+    let mut reader = match source.open(path) {
+        Ok(file) => BufReader::new(file),
+        Err(_) => return false,
+    };
+    let mut line = Vec::new();
+    loop {
+        line.clear();
+        match reader.read_until(b'\n', &mut line) {
+            Ok(0) | Err(_) => return false,
+            Ok(_) => {
+                if regex.is_match(&String::from_utf8_lossy(&line)) {
+                    return true;
+                }
+            }
+        }
+    }
+}
+
+fn is_generated_file(source: &dyn FileSource, path: &Path, markers: &[String]) -> bool {
+    let file = match source.open(path) {
+        Ok(file) => file,
+        Err(_) => return false,
+    };
+
+    BufReader::new(file)
+        .lines()
+        .take(GENERATED_SCAN_LINES)
+        .map_while(Result::ok)
+        .any(|line| markers.iter().any(|marker| line.contains(marker.as_str())))
+}
+
+// Each file is read, tokenized, and written in a single pass; only its path,
+// token count, and size are kept afterwards (except when splitting, which
+// needs every file's content before chunks can be planned).
+impl FileProcessor<'_> {
+    // Returns the text and, for binary files included as base64, the
+    // encoding used. NUL bytes mark a file as binary before any attempt to
+    // transcode it, since most single-byte encodings accept any bytes.
+    fn decode(&self, path: &Path, bytes: Vec<u8>) -> Result<(String, Option<&'static str>)> {
+        if self.binary_limit.is_some() && bytes.contains(&0) {
+            return self.encode_binary(path, bytes);
+        }
+
+        let error = match String::from_utf8(bytes) {
+            Ok(content) => return Ok((strip_bom(content), None)),
+            Err(error) => error,
+        };
+
+        if let Some(transcoded) = &self.transcoded {
+            if let Some((content, encoding)) = decode_non_utf8(error.as_bytes()) {
+                if self.verbose >= VERBOSE_FILES {
+                    println!("Transcoded file from {}: {:?}", encoding, path);
+                }
+                transcoded.fetch_add(1, Ordering::Relaxed);
+                return Ok((content, None));
+            }
+        }
+
+        if self.binary_limit.is_some() {
+            return self.encode_binary(path, error.into_bytes());
+        }
+        Err(error).with_context(|| format!("Failed to read file: {:?}", path))
+    }
+
+    fn encode_binary(&self, path: &Path, bytes: Vec<u8>) -> Result<(String, Option<&'static str>)> {
+        let limit = self.binary_limit.unwrap_or(0);
+        if bytes.len() as u64 > limit {
+            bail!(
+                "Binary file is larger than --max-binary-size ({} > {} bytes): {:?}",
+                bytes.len(),
+                limit,
+                path
+            );
+        }
+        Ok((BASE64.encode(bytes), Some(BASE64_ENCODING)))
+    }
+
+    fn process_file(&self, path: &Path, position: usize) -> Result<(usize, u64)> {
+        // Import stripping needs the whole file, and split output keeps every
+        // file in memory anyway
+        let stream_output = match &self.output {
+            OutputSink::File(output) => Some(Some(output)),
+            OutputSink::Discard => Some(None),
+            OutputSink::Collect(_) => None,
+        };
+        // Transcoding and base64 encoding need the whole file, since whether
+        // it is UTF-8 is only known once every byte has been seen
+        let decodes = self.binary_limit.is_some() || self.transcoded.is_some();
+        if let Some(output) = stream_output {
+            if self.pipeline.transformers.is_empty()
+                && self.layout.custom.is_none()
+                && self.layout.front_matter.is_none()
+                && self.mirror_dir.is_none()
+                && !decodes
+                && self.source.len(path).unwrap_or(0) > self.stream_threshold
+            {
+                return self.stream_file(path, output);
+            }
+        }
+
+        let bytes = self
+            .with_retries(path, || self.source.read(path))
+            .with_context(|| format!("Failed to read file: {:?}", path))?;
+        // Report the size of what was actually read; the file may have
+        // changed since it was discovered.
+        let file_size = bytes.len() as u64;
+        let (content, encoding) = self.decode(path, bytes)?;
+        // Encoded binary content is left as is: it has no lines, and its
+        // random-looking text would trip the redactor
+        let content = if encoding.is_none() {
+            if let Some(line_endings) = &self.line_endings {
+                line_endings
+                    .lock()
+                    .unwrap()
+                    .record(&path.to_string_lossy(), detect_line_ending(&content));
+            }
+            let content = self.compact(path, self.pipeline.prepare(path, content));
+            self.count_words(&content);
+            content
+        } else {
+            content
+        };
+
+        let tokens = self.tokenize(&content);
+        let entry = FileEntry {
+            path: self.display_name(path),
+            metadata: self.metadata(path).cloned(),
+            encoding,
+            content,
+            tokens,
+            size: file_size,
+            position,
+        };
+        // The output position is not known yet for collected files; it only
+        // shows in a --separator template, where it makes little difference
+        self.count_delimiters(
+            &entry.path,
+            entry.metadata.as_ref(),
+            entry.encoding,
+            position + 1,
+        )?;
+        if let Some(mirror_dir) = &self.mirror_dir {
+            mirror_file(mirror_dir, &entry)?;
+        }
+
+        match &self.output {
+            OutputSink::File(output) => {
+                let mut output = output.lock().unwrap();
+                let index = self.files_written.fetch_add(1, Ordering::Relaxed) + 1;
+                if index > 1 {
+                    self.layout.write_file_separator(&mut *output)?;
+                    self.separators_written.fetch_add(1, Ordering::Relaxed);
+                }
+                self.layout.write_entry(&mut *output, &entry, index)?;
+                if let Some(progress) = &self.progress {
+                    progress.record(path, &mut output)?;
+                }
+            }
+            OutputSink::Collect(collected) => collected.lock().unwrap().push(entry),
+            OutputSink::Discard => {}
+        }
+
+        Ok((tokens, file_size))
+    }
+
+    // Reads, tokenizes, and writes a large file a piece at a time so it is
+    // never held in memory whole. Pieces end at a line break, so the token
+    // and word counts only differ from counting the whole file when a token
+    // or word would span a piece boundary. The output stays locked while the
+    // file is streamed, and if the file turns out not to be UTF-8 or fails to
+    // read part way, everything written for it is removed again and it
+    // counts towards no total. Without an output (--output-stats-only) the
+    // file is only tokenized.
+    fn stream_file(
+        &self,
+        path: &Path,
+        output: Option<&Mutex<BufWriter<File>>>,
+    ) -> Result<(usize, u64)> {
+        let reader = self
+            .with_retries(path, || self.source.open(path))
+            .with_context(|| format!("Failed to read file: {:?}", path))?;
+
+        let mut locked = output.map(|output| output.lock().unwrap());
+        let start = match &mut locked {
+            Some(locked) => Some(locked.stream_position()?),
+            None => None,
+        };
+        let index = self.files_written.fetch_add(1, Ordering::Relaxed) + 1;
+        let streamed = match &mut locked {
+            Some(locked) => self.write_streamed(path, reader, &mut **locked, index),
+            None => self.write_streamed(path, reader, &mut io::sink(), index),
+        };
+        let streamed = match streamed {
+            Ok(streamed) => streamed,
+            Err(error) => {
+                if let (Some(locked), Some(start)) = (&mut locked, start) {
+                    roll_back(locked, start)?;
+                }
+                self.files_written.fetch_sub(1, Ordering::Relaxed);
+                return Err(error);
+            }
+        };
+
+        if index > 1 && locked.is_some() {
+            self.separators_written.fetch_add(1, Ordering::Relaxed);
+        }
+        let display_name = self.display_name(path);
+        let metadata = self.metadata(path);
+        self.count_delimiters(&display_name, metadata, None, index)?;
+        self.add_compared(&streamed.compared);
+        if let Some(words) = &self.words {
+            words.fetch_add(streamed.words, Ordering::Relaxed);
+        }
+        if let Some(compacted) = &self.compacted {
+            compacted.fetch_add(streamed.compacted, Ordering::Relaxed);
+        }
+        if let (Some(progress), Some(locked)) = (&self.progress, &mut locked) {
+            progress.record(path, locked)?;
+        }
+        if let Some(line_endings) = &self.line_endings {
+            line_endings
+                .lock()
+                .unwrap()
+                .record(&path.to_string_lossy(), streamed.line_ending);
+        }
+        Ok((streamed.tokens, streamed.file_size))
+    }
+
+    // Writes a streamed file's entry, tallying what it adds to the run's
+    // totals for stream_file to apply once the whole file has been written
+    fn write_streamed(
+        &self,
+        path: &Path,
+        mut reader: Box<dyn Read + '_>,
+        mut output: &mut dyn Write,
+        index: usize,
+    ) -> Result<Streamed> {
+        let read_error = || format!("Failed to read file: {:?}", path);
+        if index > 1 {
+            self.layout.write_file_separator(&mut output)?;
+        }
+        let display_name = self.display_name(path);
+        let metadata = self.metadata(path);
+        self.layout
+            .write_entry_start(&mut output, &display_name, metadata, None, index)?;
+
+        let mut streamed = Streamed {
+            tokens: 0,
+            compared: vec![0; self.comparisons.len()],
+            words: 0,
+            compacted: 0,
+            file_size: 0,
+            line_ending: LineEnding::None,
+        };
+        let mut buffer = vec![0; STREAM_CHUNK_SIZE];
+        let mut pending: Vec<u8> = Vec::new();
+        // The start of `pending` known to hold no line break
+        let mut searched = 0;
+        let mut ends_with_newline = true;
+        let mut first_piece = true;
+        loop {
+            let read = reader.read(&mut buffer).with_context(read_error)?;
+            pending.extend_from_slice(&buffer[..read]);
+            let at_end = read == 0;
+            if !at_end && pending.len() < STREAM_CHUNK_SIZE {
+                continue;
+            }
+
+            // Cut after the last line break, so the transforms, redaction,
+            // and wrapping only ever see whole lines. The partial line after
+            // it is carried over to the next piece, and a line longer than a
+            // piece is read on until it ends.
+            let cut = if at_end {
+                pending.len()
+            } else {
+                match pending[searched..].iter().rposition(|byte| *byte == b'\n') {
+                    Some(newline) => searched + newline + 1,
+                    None => {
+                        searched = pending.len();
+                        continue;
+                    }
+                }
+            };
+            let rest = pending.split_off(cut);
+            searched = rest.len();
+            let mut piece = String::from_utf8(std::mem::replace(&mut pending, rest))
+                .with_context(read_error)?;
+            streamed.file_size += piece.len() as u64;
+            if first_piece {
+                piece = strip_bom(piece);
+                first_piece = false;
+            }
+            streamed.line_ending = streamed.line_ending.combine(detect_line_ending(&piece));
+
+            let piece = self.pipeline.prepare(path, piece);
+            let (piece, saved) = self.compact_counted(path, piece);
+            streamed.compacted += saved;
+            let (tokens, compared) = self.count_tokens(&piece);
+            streamed.tokens += tokens;
+            for (total, tokens) in streamed.compared.iter_mut().zip(compared) {
+                *total += tokens;
+            }
+            if self.words.is_some() {
+                streamed.words += piece.split_whitespace().count();
+            }
+            self.layout.write_content(&mut output, &piece)?;
+            if !piece.is_empty() {
+                ends_with_newline = piece.ends_with('\n');
+            }
+
+            if at_end {
+                break;
+            }
+        }
+        self.layout
+            .write_entry_end(&mut output, streamed.tokens, ends_with_newline)?;
+        Ok(streamed)
+    }
+
+    // Runs `read` again after a growing delay when it fails with an error
+    // that may go away by itself, up to --read-retries times. Errors such as
+    // a missing file or denied permission are returned straight away.
+    fn with_retries<T>(&self, path: &Path, read: impl Fn() -> io::Result<T>) -> io::Result<T> {
+        let mut delay = READ_RETRY_DELAY;
+        let mut attempt = 0;
+        loop {
+            match read() {
+                Ok(value) => {
+                    if let (Some(retried), true) = (&self.retried, attempt > 0) {
+                        retried.fetch_add(1, Ordering::Relaxed);
+                    }
+                    return Ok(value);
+                }
+                Err(error)
+                    if attempt < self.read_retries && is_transient(&error) && !interrupted() =>
+                {
+                    attempt += 1;
+                    if self.verbose >= VERBOSE_FILES {
+                        println!(
+                            "Retrying read ({}/{}) after error: {:?} - {}",
+                            attempt, self.read_retries, path, error
+                        );
+                    }
+                    std::thread::sleep(delay);
+                    delay *= 2;
+                }
+                Err(error) => return Err(error),
+            }
+        }
+    }
+
+    // Tokenizing is CPU-bound, so it is bounded by the CPU pool rather than
+    // by the number of files being read at once.
+    fn tokenize(&self, content: &str) -> usize {
+        let (tokens, compared) = self.count_tokens(content);
+        self.add_compared(&compared);
+        tokens
+    }
+
+    // Tokens with the main tokenizer, and with each --compare-tokenizers
+    // tokenizer in order, without adding them to the totals
+    fn count_tokens(&self, content: &str) -> (usize, Vec<usize>) {
+        self.cpu_pool.install(|| {
+            let compared = self
+                .comparisons
+                .par_iter()
+                .map(|(_, bpe, _)| bpe.count(content))
+                .collect();
+            (self.bpe.count(content), compared)
+        })
+    }
+
+    fn add_compared(&self, compared: &[usize]) {
+        for ((_, _, total), tokens) in self.comparisons.iter().zip(compared) {
+            total.fetch_add(*tokens, Ordering::Relaxed);
+        }
+    }
+
+    // For --token-breakdown. The framing is tokenized apart from the
+    // content, like the prompt, and only with the main tokenizer.
+    fn count_delimiters(
+        &self,
+        path: &str,
+        metadata: Option<&FileMetadata>,
+        encoding: Option<&str>,
+        index: usize,
+    ) -> Result<()> {
+        if let Some(delimiter_tokens) = &self.delimiter_tokens {
+            let framing = self.layout.framing(path, metadata, encoding, index)?;
+            let tokens = self.bpe.count(&framing);
+            delimiter_tokens.fetch_add(tokens, Ordering::Relaxed);
+        }
+        Ok(())
+    }
+
+    // Removes blank lines after every other transform, counting the tokens
+    // they took with the main tokenizer
+    fn compact(&self, path: &Path, content: String) -> String {
+        let (compact, saved) = self.compact_counted(path, content);
+        if let Some(compacted) = &self.compacted {
+            compacted.fetch_add(saved, Ordering::Relaxed);
+        }
+        compact
+    }
+
+    // Like compact, returning the tokens saved instead of adding them up
+    fn compact_counted(&self, path: &Path, content: String) -> (String, usize) {
+        if self.compacted.is_none() {
+            return (content, 0);
+        }
+        let compact = RemoveBlankLines.transform(path, &content);
+        let saved = self
+            .bpe
+            .count(&content)
+            .saturating_sub(self.bpe.count(&compact));
+        (compact, saved)
+    }
+
+    // Words are split on Unicode whitespace, so the count does not depend on
+    // the tokenizer
+    fn count_words(&self, content: &str) {
+        if let Some(words) = &self.words {
+            words.fetch_add(content.split_whitespace().count(), Ordering::Relaxed);
+        }
+    }
+
+    fn display_name(&self, path: &Path) -> String {
+        self.display_names
+            .get(path)
+            .cloned()
+            .unwrap_or_else(|| path.to_string_lossy().into_owned())
+    }
+
+    fn metadata(&self, path: &Path) -> Option<&FileMetadata> {
+        self.file_metadata.as_ref()?.get(path)
+    }
+}
+
+// Writes a file's contents, as they appear in the output, under the
+// --mirror-to directory. Encoded binary files are written encoded.
+fn mirror_file(mirror_dir: &Path, entry: &FileEntry) -> Result<()> {
+    let path = mirror_path(mirror_dir, &entry.path);
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)
+            .with_context(|| format!("Failed to create directory: {:?}", parent))?;
+    }
+    fs::write(&path, &entry.content)
+        .with_context(|| format!("Failed to write mirrored file: {:?}", path))
+}
+
+fn modified_time(source: &dyn FileSource, path: &Path) -> Option<SystemTime> {
+    source
+        .metadata(path)
+        .and_then(|metadata| metadata.modified().ok())
+}
+
+// Whether retrying a failed read might succeed. Errors that describe the
+// file itself (it is missing, unreadable, or a directory) will not change.
+fn is_transient(error: &io::Error) -> bool {
+    !matches!(
+        error.kind(),
+        io::ErrorKind::NotFound
+            | io::ErrorKind::PermissionDenied
+            | io::ErrorKind::InvalidInput
+            | io::ErrorKind::InvalidData
+            | io::ErrorKind::Unsupported
+            | io::ErrorKind::OutOfMemory
+    )
+}
+
+fn file_metadata(metadata: &fs::Metadata) -> FileMetadata {
+    FileMetadata {
+        mode: format_mode(metadata),
+        mod_time: metadata
+            .modified()
+            .ok()
+            .map(|time| chrono::DateTime::<chrono::Local>::from(time).to_rfc3339()),
+    }
+}
+
+#[cfg(unix)]
+fn format_mode(metadata: &fs::Metadata) -> String {
+    use std::os::unix::fs::PermissionsExt;
+    format!("{:o}", metadata.permissions().mode() & 0o7777)
+}
+
+#[cfg(not(unix))]
+fn format_mode(metadata: &fs::Metadata) -> String {
+    if metadata.permissions().readonly() {
+        "read-only".to_string()
+    } else {
+        "read-write".to_string()
     }
 }
 
+// The punctuation of the json and jsonl formats, which write JSON a piece at
+// a time so large files can be streamed
+struct JsonStyle {
+    // Opens the document, then its files array
+    begin: &'static str,
+    files: &'static str,
+    // Opens a file's object, separates a field's name from its value, starts
+    // each field after the first, and closes the object
+    open: &'static str,
+    colon: &'static str,
+    next: &'static str,
+    close: &'static str,
+    // Closes the files array and the document
+    end: &'static str,
+}
+
+const COMPACT_JSON: JsonStyle = JsonStyle {
+    begin: "{",
+    files: "\"files\":[",
+    open: "{",
+    colon: ":",
+    next: ",",
+    close: "}",
+    end: "]}\n",
+};
+
+// Indented like serde_json's pretty printer, with --json-pretty
+const PRETTY_JSON: JsonStyle = JsonStyle {
+    begin: "{\n",
+    files: "  \"files\": [",
+    open: "\n    {\n      ",
+    colon: ": ",
+    next: ",\n      ",
+    close: "\n    }",
+    end: "\n  ]\n}\n",
+};
+
+// How the prompt and each file are laid out in the output
+struct Layout {
+    format: OutputFormat,
+    // The registered formatter, for a custom format
+    custom: Option<Arc<dyn Formatter>>,
+    separator: Option<String>,
+    // Written between consecutive files of an output file, with --file-separator
+    file_separator: String,
+    front_matter: Option<FrontMatter>,
+    json_pretty: bool,
+    git_ref: Option<GitRef>,
+    empty_dirs: Option<Vec<String>>,
+    trailing_newline: bool,
+    // Capacity of the buffer in front of each output file
+    write_buffer_size: usize,
+}
+
+impl Layout {
+    // The same layout in another format, for --also-output. Options that
+    // only apply to the text or json format are left out of the others.
+    fn with_format(&self, format: OutputFormat) -> Result<Layout> {
+        let text = format == OutputFormat::Text;
+        Ok(Layout {
+            format,
+            custom: custom_formatter(format, false)?,
+            separator: self.separator.clone().filter(|_| text),
+            file_separator: if text {
+                self.file_separator.clone()
+            } else {
+                String::new()
+            },
+            front_matter: self.front_matter.filter(|_| text),
+            json_pretty: self.json_pretty && format == OutputFormat::Json,
+            git_ref: self.git_ref.clone(),
+            empty_dirs: self.empty_dirs.clone(),
+            trailing_newline: self.trailing_newline,
+            write_buffer_size: self.write_buffer_size,
+        })
+    }
+
+    fn json_style(&self) -> &'static JsonStyle {
+        if self.json_pretty {
+            &PRETTY_JSON
+        } else {
+            &COMPACT_JSON
+        }
+    }
+
+    // A field of the json document that comes before its files, with the
+    // comma that separates it from the next
+    fn json_field(&self, name: &str, value: &serde_json::Value) -> Result<String> {
+        let name = serde_json::to_string(name)?;
+        if self.json_pretty {
+            let value = serde_json::to_string_pretty(value)?.replace('\n', "\n  ");
+            Ok(format!("  {}: {},\n", name, value))
+        } else {
+            Ok(format!("{}:{},", name, serde_json::to_string(value)?))
+        }
+    }
+
+    // Writes what comes before the first file: the prompt, then the git
+    // revision for --git-ref-header, the empty directories for
+    // --note-empty-dirs, and the table of contents for --toc
+    fn write_preamble(
+        &self,
+        output: &mut impl Write,
+        prompt: Option<&str>,
+        toc: Option<&str>,
+    ) -> Result<()> {
+        if let Some(formatter) = &self.custom {
+            let header = Header {
+                prompt,
+                git_revision: self.git_ref.as_ref().map(GitRef::describe),
+                empty_dirs: self.empty_dirs.as_deref(),
+            };
+            return formatter.write_header(output, &header);
+        }
+        match self.format {
+            OutputFormat::Text => {
+                if let Some(prompt) = prompt {
+                    output.write_all(prompt.as_bytes())?;
+                }
+                if let Some(git_ref) = &self.git_ref {
+                    write!(output, "Git revision: {}\n\n", git_ref.describe())?;
+                }
+                if let Some(empty_dirs) = self.empty_dirs.as_ref().filter(|dirs| !dirs.is_empty()) {
+                    writeln!(output, "Directories with no files combined:")?;
+                    for dir in empty_dirs {
+                        writeln!(output, "- {}", dir)?;
+                    }
+                    writeln!(output)?;
+                }
+                if let Some(toc) = toc {
+                    output.write_all(toc.as_bytes())?;
+                }
+            }
+            // The header fields come first, then the files array, which
+            // finish closes
+            OutputFormat::Json => {
+                output.write_all(self.json_style().begin.as_bytes())?;
+                let schema_version = serde_json::json!(SCHEMA_VERSION);
+                output.write_all(
+                    self.json_field("schema_version", &schema_version)?
+                        .as_bytes(),
+                )?;
+                if let Some(prompt) = prompt {
+                    output.write_all(
+                        self.json_field("prompt", &serde_json::json!(prompt))?
+                            .as_bytes(),
+                    )?;
+                }
+                if let Some(git_ref) = &self.git_ref {
+                    let git =
+                        serde_json::json!({ "commit": git_ref.commit, "branch": git_ref.branch });
+                    output.write_all(self.json_field("git", &git)?.as_bytes())?;
+                }
+                if let Some(empty_dirs) = self.empty_dirs.as_ref().filter(|dirs| !dirs.is_empty()) {
+                    output.write_all(
+                        self.json_field("empty_dirs", &serde_json::json!(empty_dirs))?
+                            .as_bytes(),
+                    )?;
+                }
+                if let Some(toc) = toc {
+                    output.write_all(toc.as_bytes())?;
+                }
+                output.write_all(self.json_style().files.as_bytes())?;
+            }
+            OutputFormat::Jsonl => {
+                if let Some(prompt) = prompt {
+                    serde_json::to_writer(&mut *output, &serde_json::json!({ "prompt": prompt }))?;
+                    writeln!(output)?;
+                }
+                if let Some(git_ref) = &self.git_ref {
+                    serde_json::to_writer(
+                        &mut *output,
+                        &serde_json::json!({
+                            "git": { "commit": git_ref.commit, "branch": git_ref.branch }
+                        }),
+                    )?;
+                    writeln!(output)?;
+                }
+                if let Some(empty_dirs) = self.empty_dirs.as_ref().filter(|dirs| !dirs.is_empty()) {
+                    serde_json::to_writer(
+                        &mut *output,
+                        &serde_json::json!({ "empty_dirs": empty_dirs }),
+                    )?;
+                    writeln!(output)?;
+                }
+                if let Some(toc) = toc {
+                    output.write_all(toc.as_bytes())?;
+                }
+            }
+            OutputFormat::Custom(_) => unreachable!("custom formats write their own header"),
+        }
+        Ok(())
+    }
+
+    // `index` is the file's 1-based position in the output
+    fn write_entry(&self, output: &mut impl Write, entry: &FileEntry, index: usize) -> Result<()> {
+        if let Some(formatter) = &self.custom {
+            return formatter.write_file(output, &entry.formatted(index));
+        }
+        self.write_entry_start(
+            output,
+            &entry.path,
+            entry.metadata.as_ref(),
+            entry.encoding,
+            index,
+        )?;
+        if let Some(front_matter) = self.front_matter {
+            write_front_matter(output, front_matter, entry)?;
+        }
+        self.write_content(output, &entry.content)?;
+        let ends_with_newline = entry.content.is_empty() || entry.content.ends_with('\n');
+        self.write_entry_end(output, entry.tokens, ends_with_newline)
+    }
+
+    // What goes between consecutive files of an output file: the
+    // --file-separator text, or the comma between elements of the json array
+    fn write_file_separator(&self, output: &mut impl Write) -> Result<()> {
+        match self.format {
+            OutputFormat::Json => output.write_all(b",")?,
+            _ => output.write_all(self.file_separator.as_bytes())?,
+        }
+        Ok(())
+    }
+
+    // A file's entry is written in three parts so that large files can be
+    // streamed: the header, the content (possibly in several pieces), and
+    // whatever follows the content. The token count is only needed at the end.
+    // Custom formats take each file whole, so they are never streamed.
+    fn write_entry_start(
+        &self,
+        output: &mut impl Write,
+        path: &str,
+        metadata: Option<&FileMetadata>,
+        encoding: Option<&str>,
+        index: usize,
+    ) -> Result<()> {
+        match (self.format, &self.separator) {
+            (OutputFormat::Json | OutputFormat::Jsonl, _) => {
+                // Fields are written in the same order as FileEntry serializes them
+                let style = self.json_style();
+                let field = |name: &str| format!("{}\"{}\"{}", style.next, name, style.colon);
+                write!(
+                    output,
+                    "{}\"path\"{}{}",
+                    style.open,
+                    style.colon,
+                    serde_json::to_string(path)?
+                )?;
+                if let Some(metadata) = metadata {
+                    write!(
+                        output,
+                        "{}{}",
+                        field("mode"),
+                        serde_json::to_string(&metadata.mode)?
+                    )?;
+                    if let Some(mod_time) = &metadata.mod_time {
+                        write!(
+                            output,
+                            "{}{}",
+                            field("mod_time"),
+                            serde_json::to_string(mod_time)?
+                        )?;
+                    }
+                }
+                if let Some(encoding) = encoding {
+                    write!(
+                        output,
+                        "{}{}",
+                        field("encoding"),
+                        serde_json::to_string(encoding)?
+                    )?;
+                }
+                write!(output, "{}\"", field("contents"))?;
+            }
+            (OutputFormat::Text, Some(separator)) => {
+                writeln!(output, "{}", render_separator(separator, path, index))?;
+                if let Some(metadata) = metadata {
+                    writeln!(output, "{}", metadata)?;
+                }
+                if let Some(encoding) = encoding {
+                    writeln!(output, "Encoding: {}", encoding)?;
+                }
+            }
+            (OutputFormat::Text, None) => {
+                write!(output, "File: {:?}\n", path)?;
+                if let Some(metadata) = metadata {
+                    writeln!(output, "{}", metadata)?;
+                }
+                if let Some(encoding) = encoding {
+                    writeln!(output, "Encoding: {}", encoding)?;
+                }
+                writeln!(output, "{}", "-".repeat(80))?;
+            }
+            (OutputFormat::Custom(_), _) => unreachable!("custom formats are not streamed"),
+        }
+        Ok(())
+    }
+
+    // What write_entry writes around a file's content: its header, and
+    // whatever follows the content
+    fn framing(
+        &self,
+        path: &str,
+        metadata: Option<&FileMetadata>,
+        encoding: Option<&str>,
+        index: usize,
+    ) -> Result<String> {
+        let mut framing = Vec::new();
+        if let Some(formatter) = &self.custom {
+            let file = FormattedFile {
+                path,
+                metadata,
+                encoding,
+                contents: "",
+                tokens: 0,
+                index,
+            };
+            formatter.write_file(&mut framing, &file)?;
+        } else {
+            self.write_entry_start(&mut framing, path, metadata, encoding, index)?;
+            self.write_entry_end(&mut framing, 0, true)?;
+        }
+        Ok(String::from_utf8_lossy(&framing).into_owned())
+    }
+
+    fn write_content(&self, output: &mut impl Write, content: &str) -> Result<()> {
+        match self.format {
+            OutputFormat::Json | OutputFormat::Jsonl => {
+                // serde_json escapes newlines, so each file stays on a single line
+                let escaped = serde_json::to_string(content)?;
+                output.write_all(&escaped.as_bytes()[1..escaped.len() - 1])?;
+            }
+            OutputFormat::Text => output.write_all(content.as_bytes())?,
+            OutputFormat::Custom(_) => unreachable!("custom formats are not streamed"),
+        }
+        Ok(())
+    }
+
+    // In text output the content is followed by exactly one line break
+    // whether or not the file ended with one, so every entry ends the same way
+    fn write_entry_end(
+        &self,
+        output: &mut impl Write,
+        tokens: usize,
+        ends_with_newline: bool,
+    ) -> Result<()> {
+        if self.format == OutputFormat::Text && !ends_with_newline {
+            writeln!(output)?;
+        }
+        match (self.format, &self.separator) {
+            (OutputFormat::Json, _) => {
+                let style = self.json_style();
+                write!(
+                    output,
+                    "\"{}\"tokens\"{}{}{}",
+                    style.next, style.colon, tokens, style.close
+                )?;
+            }
+            (OutputFormat::Jsonl, _) => writeln!(output, "\",\"tokens\":{}}}", tokens)?,
+            (OutputFormat::Text, Some(_)) => {}
+            (OutputFormat::Text, None) => writeln!(output, "{}", "-".repeat(80))?,
+            (OutputFormat::Custom(_), _) => unreachable!("custom formats are not streamed"),
+        }
+        Ok(())
+    }
+
+    // Every layout ends the output with a single newline, which
+    // --no-trailing-newline removes once everything has been written
+    fn finish(&self, mut output: BufWriter<File>) -> Result<()> {
+        if let Some(formatter) = &self.custom {
+            formatter.write_footer(&mut output)?;
+        }
+        if self.format == OutputFormat::Json {
+            output.write_all(self.json_style().end.as_bytes())?;
+        }
+        let mut file = output.into_inner().map_err(IntoInnerError::into_error)?;
+        if !self.trailing_newline {
+            // A custom footer need not end with a newline
+            let len = file.stream_position()?;
+            if len > 0 {
+                let mut last = [0];
+                file.seek(io::SeekFrom::Start(len - 1))?;
+                file.read_exact(&mut last)?;
+                if last[0] == b'\n' {
+                    file.set_len(len - 1)?;
+                }
+            }
+        }
+        Ok(())
+    }
+
+    // The --toc listing of each file in output order with its token count.
+    // The total counts the files only, since the listing's own tokens are
+    // only known once it is written.
+    fn toc(&self, entries: &[FileEntry]) -> Result<String> {
+        let total: usize = entries.iter().map(|entry| entry.tokens).sum();
+        match self.format {
+            OutputFormat::Text => {
+                let mut toc = String::from("Table of Contents:\n");
+                for (index, entry) in entries.iter().enumerate() {
+                    toc.push_str(&format!(
+                        "{}. {} ({} tokens)\n",
+                        index + 1,
+                        entry.path,
+                        entry.tokens
+                    ));
+                }
+                toc.push_str(&format!(
+                    "Total: {} tokens in {} files\n\n",
+                    total,
+                    entries.len()
+                ));
+                Ok(toc)
+            }
+            OutputFormat::Json | OutputFormat::Jsonl => {
+                let files: Vec<serde_json::Value> = entries
+                    .iter()
+                    .map(|entry| serde_json::json!({ "path": entry.path, "tokens": entry.tokens }))
+                    .collect();
+                let toc = serde_json::json!({ "files": files, "total_tokens": total });
+                if self.format == OutputFormat::Json {
+                    return self.json_field("toc", &toc);
+                }
+                let toc = serde_json::json!({ "toc": toc });
+                Ok(format!("{}\n", serde_json::to_string(&toc)?))
+            }
+            OutputFormat::Custom(_) => unreachable!("--toc is rejected for custom formats"),
+        }
+    }
+
+    // Bytes written around each file's content by write_entry, plus a file
+    // separator (counted for every file, so one more than is written)
+    fn overhead(&self, path: &str) -> u64 {
+        let file_separator = self.file_separator.len() as u64;
+        match (self.format, &self.separator) {
+            (OutputFormat::Text, Some(separator)) => {
+                render_separator(separator, path, 1).len() as u64 + 1 + file_separator
+            }
+            (OutputFormat::Text, None) => {
+                (format!("File: {:?}\n", path).len() + 2 * 81) as u64 + file_separator
+            }
+            (OutputFormat::Json | OutputFormat::Jsonl, _) => {
+                let entry = FileEntry {
+                    path: path.to_string(),
+                    metadata: None,
+                    encoding: None,
+                    content: String::new(),
+                    tokens: 0,
+                    size: 0,
+                    position: 0,
+                };
+                // One more byte for the line break, or the comma in the json
+                // array. Pretty json starts each file on a new line and
+                // indents each line by 4 more than serde_json does.
+                if self.json_pretty {
+                    serde_json::to_string_pretty(&entry)
+                        .map_or(0, |json| (json.len() + 4 * json.lines().count() + 2) as u64)
+                } else {
+                    serde_json::to_string(&entry).map_or(0, |json| json.len() as u64 + 1)
+                }
+            }
+            (OutputFormat::Custom(_), _) => {
+                let entry = FormattedFile {
+                    path,
+                    metadata: None,
+                    encoding: None,
+                    contents: "",
+                    tokens: 0,
+                    index: 1,
+                };
+                let mut written = Vec::new();
+                self.custom
+                    .as_ref()
+                    .and_then(|formatter| formatter.write_file(&mut written, &entry).ok())
+                    .map_or(0, |_| written.len() as u64)
+            }
+        }
+    }
+}
+
+// Output files are also opened for reading, so that Layout::finish can check
+// how they end
+fn create_output(path: &Path) -> io::Result<File> {
+    OpenOptions::new()
+        .read(true)
+        .write(true)
+        .create(true)
+        .truncate(true)
+        .open(path)
+}
+
+// The registered formatter of a custom format, or None for a built-in one
+fn custom_formatter(format: OutputFormat, toc: bool) -> Result<Option<Arc<dyn Formatter>>> {
+    match format {
+        OutputFormat::Custom(name) => {
+            if toc {
+                bail!("--toc is not supported by the {} output format", name);
+            }
+            let formatter =
+                formatter(name).with_context(|| format!("Unknown output format: {}", name))?;
+            Ok(Some(formatter))
+        }
+        _ => Ok(None),
+    }
+}
+
+fn render_separator(template: &str, path: &str, index: usize) -> String {
+    template
+        .replace("{path}", path)
+        .replace("{index}", &index.to_string())
+}
+
+// A loaded --tokenization-method: a tiktoken encoding, or the estimate of
+// combiner::estimate, which has no encoding to load
+enum Tokenizer {
+    Bpe(CoreBPE),
+    Estimate,
+}
+
+impl Tokenizer {
+    fn count(&self, text: &str) -> usize {
+        match self {
+            Tokenizer::Bpe(bpe) => bpe.encode_ordinary(text).len(),
+            Tokenizer::Estimate => estimate_tokens(text),
+        }
+    }
+
+    // The longest beginning of `text` that counts at most `keep` tokens
+    fn truncate(&self, text: &str, keep: usize) -> String {
+        let bpe = match self {
+            Tokenizer::Bpe(bpe) => bpe,
+            Tokenizer::Estimate => {
+                // The estimate grows with the prefix, so the longest one
+                // within the limit can be searched for, ending at any
+                // character boundary
+                let ends: Vec<usize> = text
+                    .char_indices()
+                    .map(|(i, _)| i)
+                    .skip(1)
+                    .chain(std::iter::once(text.len()))
+                    .collect();
+                let fits = ends.partition_point(|&end| estimate_tokens(&text[..end]) <= keep);
+                let end = if fits == 0 { 0 } else { ends[fits - 1] };
+                return text[..end].to_string();
+            }
+        };
+        let mut tokens = bpe.encode_ordinary(text);
+        tokens.truncate(keep);
+        // A prefix can end inside a multi-byte character, which does not
+        // decode, and the decoded text can encode to more tokens than it
+        // was cut to; either way, one token less is kept
+        loop {
+            match bpe.decode(tokens.clone()) {
+                Ok(content) if bpe.encode_ordinary(&content).len() <= keep => break content,
+                _ => {
+                    tokens.pop();
+                }
+            }
+        }
+    }
+}
+
+// Cuts each file to the share of its tokens that brings the total of all
+// files within `max_tokens`, so that every file keeps its beginning. Returns
+// how many files were cut and how many tokens they lost.
+fn truncate_proportionally(
+    entries: &mut [FileEntry],
+    max_tokens: usize,
+    bpe: &Tokenizer,
+) -> (usize, usize) {
+    let total: usize = entries.iter().map(|entry| entry.tokens).sum();
+    if total <= max_tokens {
+        return (0, 0);
+    }
+    let mut cut = 0;
+    let mut tokens_removed = 0;
+    for entry in entries.iter_mut() {
+        let keep = entry.tokens * max_tokens / total;
+        if keep == entry.tokens {
+            continue;
+        }
+        let content = bpe.truncate(&entry.content, keep);
+        let tokens = bpe.count(&content);
+        tokens_removed += entry.tokens - tokens;
+        entry.tokens = tokens;
+        entry.content = content;
+        cut += 1;
+    }
+    (cut, tokens_removed)
+}
+
+// The fields of --front-matter, in the order they are written
+#[derive(Serialize)]
+struct FrontMatterFields<'a> {
+    path: &'a str,
+    size: u64,
+    tokens: usize,
+    language: String,
+}
+
+// Writes a file's --front-matter block between its header and its contents.
+// Yaml strings are written json-quoted, which yaml parses the same way.
+fn write_front_matter(
+    output: &mut impl Write,
+    front_matter: FrontMatter,
+    entry: &FileEntry,
+) -> Result<()> {
+    let fields = FrontMatterFields {
+        path: &entry.path,
+        size: entry.size,
+        tokens: entry.tokens,
+        language: language_name(Path::new(&entry.path)),
+    };
+    match front_matter {
+        FrontMatter::Yaml => {
+            writeln!(output, "---")?;
+            writeln!(output, "path: {}", serde_json::to_string(fields.path)?)?;
+            writeln!(output, "size: {}", fields.size)?;
+            writeln!(output, "tokens: {}", fields.tokens)?;
+            writeln!(
+                output,
+                "language: {}",
+                serde_json::to_string(&fields.language)?
+            )?;
+            writeln!(output, "---")?;
+        }
+        FrontMatter::Json => writeln!(output, "{}", serde_json::to_string(&fields)?)?,
+    }
+    Ok(())
+}
+
+// Estimates the output size from the files' sizes on disk; transformations,
+// redaction, and metadata lines make the actual size differ slightly.
+fn estimate_output_size(
+    source: &dyn FileSource,
+    files: &[&Path],
+    display_names: &HashMap<PathBuf, String>,
+    prompt: Option<&str>,
+    layout: &Layout,
+) -> u64 {
+    let prompt_size = prompt.map_or(0, |prompt| prompt.len() as u64);
+    let files_size: u64 = files
+        .par_iter()
+        .map(|path| {
+            let size = source.len(path).unwrap_or(0);
+            let name = display_names
+                .get(*path)
+                .cloned()
+                .unwrap_or_else(|| path.to_string_lossy().into_owned());
+            size + layout.overhead(&name)
+        })
+        .sum();
+    prompt_size + files_size
+}
+
+// Writes `files` whole to `output_file`, returning how many file separators
+// went between them
+fn write_in_order(
+    output_file: &Path,
+    files: &[FileEntry],
+    prompt: Option<&str>,
+    toc: Option<&str>,
+    layout: &Layout,
+) -> Result<usize> {
+    let mut output = BufWriter::with_capacity(
+        layout.write_buffer_size,
+        create_output(output_file)
+            .with_context(|| format!("Failed to create output file: {:?}", output_file))?,
+    );
+    layout.write_preamble(&mut output, prompt, toc)?;
+    let mut separators = 0;
+    for (index, entry) in files.iter().enumerate() {
+        if index > 0 {
+            layout.write_file_separator(&mut output)?;
+            separators += 1;
+        }
+        layout.write_entry(&mut output, entry, index + 1)?;
+    }
+    layout.finish(output)?;
+    Ok(separators)
+}
+
+fn write_chunks(
+    output_file: &Path,
+    files: Vec<FileEntry>,
+    max_tokens: usize,
+    cohesion: SplitCohesion,
+    prompt: Option<&str>,
+    layout: &Layout,
+) -> Result<Vec<Chunk>> {
+    let sizes: Vec<(String, usize)> = files
+        .iter()
+        .map(|entry| (entry.path.clone(), entry.tokens))
+        .collect();
+
+    let mut files_written = 0;
+    plan_chunks(&sizes, max_tokens, cohesion)
+        .into_iter()
+        .enumerate()
+        .map(|(index, members)| {
+            let chunk_file = chunk_path(output_file, index + 1);
+            let mut output = BufWriter::with_capacity(
+                layout.write_buffer_size,
+                create_output(&chunk_file)
+                    .with_context(|| format!("Failed to create chunk: {:?}", chunk_file))?,
+            );
+            let mut chunk = Chunk {
+                path: chunk_file,
+                files: Vec::new(),
+                tokens: 0,
+            };
+            if index == 0 {
+                layout.write_preamble(&mut output, prompt, None)?;
+            }
+            for (position, member) in members.into_iter().enumerate() {
+                let entry = &files[member];
+                if position > 0 {
+                    layout.write_file_separator(&mut output)?;
+                }
+                files_written += 1;
+                layout.write_entry(&mut output, entry, files_written)?;
+                chunk.files.push((entry.path.clone(), entry.tokens));
+                chunk.tokens += entry.tokens;
+            }
+            layout.finish(output)?;
+            Ok(chunk)
+        })
+        .collect()
+}
+
+// Builds a pool of `threads` threads, or by default `per_cpu` for each CPU the
+// process may use, which under a container CPU limit can be fewer than the
+// machine has
+fn thread_pool(threads: Option<usize>, per_cpu: usize) -> Result<ThreadPool> {
+    let cpus = std::thread::available_parallelism().map_or(1, |n| n.get());
+    Ok(ThreadPoolBuilder::new()
+        .num_threads(threads.unwrap_or(cpus * per_cpu))
+        .build()?)
+}
+
+// Lists the files under every input root, paired with the root each was
+// found under. Files reachable from several overlapping roots (e.g. `-d .`
+// and `-d src`) are listed once, under the first of them. With
+// --parallel-roots up to that many roots are walked at once; their files
+// are still listed in root order, so the result does not depend on which
+// walk finishes first.
+fn collect_input_files<'a>(
+    source: &dyn FileSource,
+    roots: &'a [PathBuf],
+    depths: &[Option<usize>],
+    parallel_roots: Option<usize>,
+    skip_dir: &(dyn Fn(&Path) -> bool + Sync),
+    walk_errors: &mut Vec<(PathBuf, String)>,
+) -> Result<Vec<(&'a Path, PathBuf)>> {
+    if let ([root], [depth]) = (roots, depths) {
+        let walk = walk_root(source, root, *depth, skip_dir);
+        walk_errors.extend(walk.errors);
+        return Ok(walk
+            .files
+            .into_iter()
+            .map(|path| (root.as_path(), path))
+            .collect());
+    }
+
+    let canonical_roots: Vec<PathBuf> =
+        roots.iter().map(|root| source.canonicalize(root)).collect();
+    for (i, root) in canonical_roots.iter().enumerate() {
+        for (j, other) in canonical_roots.iter().enumerate().skip(i + 1) {
+            if root.starts_with(other) || other.starts_with(root) {
+                eprintln!(
+                    "Warning: inputs {:?} and {:?} overlap; files in both are combined once",
+                    roots[i], roots[j]
+                );
+            }
+        }
+    }
+
+    let walk =
+        |(root, depth): (&PathBuf, &Option<usize>)| walk_root(source, root, *depth, skip_dir);
+    let walks: Vec<Walk> = match parallel_roots {
+        Some(threads) => ThreadPoolBuilder::new()
+            .num_threads(threads)
+            .build()?
+            .install(|| roots.par_iter().zip(depths).map(walk).collect()),
+        None => roots.iter().zip(depths).map(walk).collect(),
+    };
+
+    let mut seen = HashSet::new();
+    let mut files = Vec::new();
+    for (root, walk) in roots.iter().zip(walks) {
+        walk_errors.extend(walk.errors);
+        files.extend(
+            walk.files
+                .into_iter()
+                .filter(|path| seen.insert(source.canonicalize(path)))
+                .map(|path| (root.as_path(), path)),
+        );
+    }
+    Ok(files)
+}
+
+// The files under `root`, leaving out directories `depth` or more levels
+// down, whose files would be deeper than `depth`. Those directories are
+// not walked at all.
+fn walk_root(
+    source: &dyn FileSource,
+    root: &Path,
+    depth: Option<usize>,
+    skip_dir: &dyn Fn(&Path) -> bool,
+) -> Walk {
+    let too_deep = |dir: &Path| {
+        depth.map_or(false, |depth| {
+            dir.strip_prefix(root)
+                .map_or(false, |relative| relative.components().count() >= depth)
+        })
+    };
+    source.walk(root, &|dir| too_deep(dir) || skip_dir(dir))
+}
+
+// What decides whether a walked file is combined
+struct Filters<'a> {
+    ignore_patterns: &'a PatternSet,
+    // With --exclude-tests
+    test_patterns: Option<&'a PatternSet>,
+    include_patterns: Option<&'a PatternSet>,
+    generated_markers: Option<&'a [String]>,
+    exclude_lockfiles: bool,
+    ignore_symlinks: bool,
+    binary_limit: Option<u64>,
+    excluded_content: Option<&'a Regex>,
+    max_file_size: Option<u64>,
+}
+
+fn skip_reason(source: &dyn FileSource, path: &Path, filters: &Filters) -> Option<SkipReason> {
+    // Checked for every file so that ignore patterns for non-text files
+    // (e.g. `*.png`) are seen to match
+    let ignored = should_ignore(path, filters.ignore_patterns);
+    // Files the user left out are told apart before the extension check, so
+    // that only files nobody asked to skip count as non-text, which
+    // --fail-on-skip treats as unexpected. Most lockfiles, for one, have no
+    // text extension.
+    if filters.ignore_symlinks && source.is_symlink(path) {
+        Some(SkipReason::Symlink)
+    } else if filters.exclude_lockfiles && is_lockfile(path) {
+        Some(SkipReason::Lockfile)
+    } else if ignored {
+        Some(SkipReason::Ignored)
+    } else if !should_include(path, filters.include_patterns) {
+        Some(SkipReason::NotIncluded)
+    } else if filters
+        .test_patterns
+        .map(|patterns| patterns.matches(path))
+        .unwrap_or(false)
+    {
+        Some(SkipReason::Test)
+    } else if !is_text_file(path) && !is_included_binary(source, path, filters.binary_limit) {
+        Some(SkipReason::NonText)
+    } else if is_too_large(source, path, filters.max_file_size) {
+        // Before the checks below, which read the file
+        Some(SkipReason::TooLarge)
+    } else if filters
+        .generated_markers
+        .map(|markers| is_generated_file(source, path, markers))
+        .unwrap_or(false)
+    {
+        Some(SkipReason::Generated)
+    } else if filters
+        .excluded_content
+        .map(|regex| has_matching_content(source, path, regex))
+        .unwrap_or(false)
+    {
+        Some(SkipReason::ContentExcluded)
+    } else {
+        None
+    }
+}
+
+// Whether the file's size on disk exceeds --max-file-size, found without
+// reading it. A file whose size cannot be found is left for the read to fail.
+fn is_too_large(source: &dyn FileSource, path: &Path, max_file_size: Option<u64>) -> bool {
+    match (max_file_size, source.len(path)) {
+        (Some(max_file_size), Ok(len)) => len > max_file_size,
+        _ => false,
+    }
+}
+
+fn select_files<'a, F>(
+    candidates: Vec<(&'a Path, Option<SkipReason>)>,
+    deselected: &mut Vec<(&'a Path, SkipReason)>,
+    pick: F,
+) -> Result<Vec<&'a Path>>
+where
+    F: FnOnce(&[&Path], &[bool]) -> Result<Vec<bool>>,
+{
+    let paths: Vec<&Path> = candidates.iter().map(|(path, _)| *path).collect();
+    let defaults: Vec<bool> = candidates
+        .iter()
+        .map(|(_, reason)| reason.is_none())
+        .collect();
+    let selection = pick(&paths, &defaults)?;
+
+    Ok(candidates
+        .into_iter()
+        .zip(selection)
+        .filter_map(|((path, reason), selected)| {
+            if selected {
+                Some(path)
+            } else {
+                deselected.push((path, reason.unwrap_or(SkipReason::Deselected)));
+                None
+            }
+        })
+        .collect())
+}
+
+// Picks `count` items spread evenly across `items`, always starting with the
+// first, so the same input gives the same sample.
+fn sample_evenly<T: Copy>(items: &[T], count: usize) -> Vec<T> {
+    (0..count).map(|i| items[i * items.len() / count]).collect()
+}
+
+fn print_skip_reason(path: &Path, reason: SkipReason) {
+    println!("Skipping {} file: {:?}", reason.as_str(), path);
+}
+
+// Every `path:line` holding a likely secret, in path order. Files are scanned
+// as read, before any transformation.
+fn find_secrets(source: &dyn FileSource, files: &[&Path], scanner: &Redactor) -> Vec<String> {
+    let mut secrets: Vec<(&Path, usize)> = files
+        .par_iter()
+        .flat_map(|path| {
+            let lines = match source.read(path) {
+                Ok(bytes) => scanner.secret_lines(&String::from_utf8_lossy(&bytes)),
+                Err(_) => Vec::new(),
+            };
+            lines
+                .into_iter()
+                .map(|line| (*path, line))
+                .collect::<Vec<_>>()
+        })
+        .collect();
+    secrets.sort();
+    secrets
+        .into_iter()
+        .map(|(path, line)| format!("  {}:{}", path.display(), line))
+        .collect()
+}
+
+// Drops a leading UTF-8 byte order mark, which editors on Windows often add.
+// It would otherwise end up in the middle of the output and cost tokens.
+// Other encodings lose theirs when they are decoded.
+fn strip_bom(mut content: String) -> String {
+    if content.starts_with(UTF8_BOM) {
+        content.drain(..UTF8_BOM.len_utf8());
+    }
+    content
+}
+
+// Walked directories with no file to combine anywhere below them
+fn find_empty_dirs(visited_dirs: BTreeSet<PathBuf>, files: &[&Path]) -> Vec<String> {
+    let occupied: HashSet<&Path> = files
+        .iter()
+        .flat_map(|path| path.ancestors().skip(1))
+        .collect();
+    visited_dirs
+        .iter()
+        .filter(|dir| !occupied.contains(dir.as_path()))
+        .map(|dir| dir.to_string_lossy().into_owned())
+        .collect()
+}
+
+// Files and tokens combined from each directory, for -v
+fn print_directory_summary(file_stats: &[(String, usize, u64)]) {
+    let mut directories: BTreeMap<&Path, (usize, usize)> = BTreeMap::new();
+    for (path, tokens, _) in file_stats {
+        let directory = Path::new(path).parent().unwrap_or(Path::new(""));
+        let (files, total) = directories.entry(directory).or_insert((0, 0));
+        *files += 1;
+        *total += tokens;
+    }
+    for (directory, (files, tokens)) in directories {
+        println!(
+            "Combined {} files ({} tokens) from {:?}",
+            files, tokens, directory
+        );
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::config::{load_config, Opt, TOKENIZER_NAMES};
+    use crate::source::MemoryFiles;
+    use std::path::PathBuf;
+    use structopt::StructOpt;
+
+    // Writes a file into a directory of its own under the system temp directory
+    fn temp_file(name: &str, contents: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("combiner-{}-{}", std::process::id(), name));
+        fs::create_dir_all(&dir).unwrap();
+        let path = dir.join(name);
+        fs::write(&path, contents).unwrap();
+        path
+    }
+
+    // Writes each (path, contents) pair into a fresh directory under the
+    // system temp directory
+    fn temp_dir(name: &str, files: &[(&str, &str)]) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("combiner-{}-{}", std::process::id(), name));
+        let _ = fs::remove_dir_all(&dir);
+        for (path, contents) in files {
+            let path = dir.join(path);
+            fs::create_dir_all(path.parent().unwrap()).unwrap();
+            fs::write(path, contents).unwrap();
+        }
+        dir
+    }
+
+    // Combines `dir` with the given arguments into a file beside it, returning
+    // the result and the combined output
+    fn run(dir: &Path, args: &[&str]) -> (ProcessingResult, String) {
+        try_run(dir, args).unwrap()
+    }
+
+    fn try_run(dir: &Path, args: &[&str]) -> Result<(ProcessingResult, String)> {
+        let output_file = dir.with_extension("out.txt");
+        let mut argv = vec!["combiner", "-d", dir.to_str().unwrap()];
+        argv.extend(args);
+        let mut opt = Opt::from_iter(argv);
+        // Resolves the tokenizer as combine() does
+        let config = load_config(&mut opt)?;
+        let result = process_files(&opt, &output_file, &[], &config);
+        let output = fs::read_to_string(&output_file).unwrap_or_default();
+        let _ = fs::remove_file(&output_file);
+        Ok((result?, output))
+    }
+
+    fn default_markers() -> Vec<String> {
+        DEFAULT_GENERATED_MARKERS
+            .iter()
+            .map(|marker| marker.to_string())
+            .collect()
+    }
+
+    #[test]
+    fn detects_a_go_generated_header() {
+        let path = temp_file(
+            "api.pb.go",
+            "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage api\n",
+        );
+        assert!(is_generated_file(&OsFiles, &path, &default_markers()));
+    }
+
+    #[test]
+    fn keeps_a_hand_written_file() {
+        let path = temp_file("server.go", "package api\n\nfunc Serve() {}\n");
+        assert!(!is_generated_file(&OsFiles, &path, &default_markers()));
+    }
+
+    #[test]
+    fn only_scans_the_first_lines() {
+        let contents = format!(
+            "{}// DO NOT EDIT\n",
+            "fn f() {}\n".repeat(GENERATED_SCAN_LINES)
+        );
+        let path = temp_file("late_marker.rs", &contents);
+        assert!(!is_generated_file(&OsFiles, &path, &default_markers()));
+    }
+
+    #[test]
+    fn counts_generated_files_under_their_own_skip_reason() {
+        let path = temp_file("bindings.rs", "// @generated by build.rs\npub fn f() {}\n");
+        let markers = default_markers();
+        let ignore_patterns = PatternSet::new(&[]).unwrap();
+        let mut filters = Filters {
+            ignore_patterns: &ignore_patterns,
+            test_patterns: None,
+            include_patterns: None,
+            generated_markers: Some(&markers),
+            exclude_lockfiles: false,
+            ignore_symlinks: false,
+            binary_limit: None,
+            excluded_content: None,
+            max_file_size: None,
+        };
+        assert_eq!(
+            skip_reason(&OsFiles, &path, &filters),
+            Some(SkipReason::Generated)
+        );
+        filters.generated_markers = None;
+        assert_eq!(skip_reason(&OsFiles, &path, &filters), None);
+    }
+
+    #[test]
+    fn uses_the_configured_markers() {
+        let path = temp_file("schema.rs", "// Produced by schemagen\npub struct S;\n");
+        assert!(!is_generated_file(&OsFiles, &path, &default_markers()));
+        assert!(is_generated_file(
+            &OsFiles,
+            &path,
+            &["Produced by".to_string()]
+        ));
+    }
+
+    #[test]
+    fn selection_replaces_the_default_choices() {
+        let candidates = vec![
+            (Path::new("src/main.rs"), None),
+            (Path::new("src/lib.rs"), None),
+            (Path::new("target/build.rs"), Some(SkipReason::Ignored)),
+        ];
+        let mut deselected = Vec::new();
+        let selected = select_files(candidates, &mut deselected, |paths, defaults| {
+            assert_eq!(paths.len(), 3);
+            assert_eq!(defaults, [true, true, false]);
+            Ok(vec![true, false, true])
+        })
+        .unwrap();
+        assert_eq!(
+            selected,
+            [Path::new("src/main.rs"), Path::new("target/build.rs")]
+        );
+        assert_eq!(
+            deselected,
+            [(Path::new("src/lib.rs"), SkipReason::Deselected)]
+        );
+    }
+
+    #[test]
+    fn unselected_files_keep_their_skip_reason() {
+        let candidates = vec![
+            (Path::new("a.rs"), None),
+            (Path::new("image.png"), Some(SkipReason::NonText)),
+        ];
+        let mut deselected = Vec::new();
+        let selected = select_files(candidates, &mut deselected, |_, defaults| {
+            Ok(defaults.to_vec())
+        })
+        .unwrap();
+        assert_eq!(selected, [Path::new("a.rs")]);
+        assert_eq!(deselected, [(Path::new("image.png"), SkipReason::NonText)]);
+    }
+
+    #[test]
+    fn a_failed_prompt_fails_the_selection() {
+        let candidates = vec![(Path::new("a.rs"), None)];
+        let result = select_files(candidates, &mut Vec::new(), |_, _| {
+            anyhow::bail!("no terminal")
+        });
+        assert!(result.is_err());
+    }
+
+    #[test]
+    fn compares_totals_across_encodings_on_multilingual_text() {
+        let dir = temp_dir(
+            "compare-tokenizers",
+            &[(
+                "greetings.txt",
+                "Hello, world!\nこんにちは世界\nПривет, мир!\nनमस्ते दुनिया\n",
+            )],
+        );
+        let (result, _) = run(
+            &dir,
+            &[
+                "--tokenization-method",
+                "cl100k_base",
+                "--compare-tokenizers",
+                "r50k_base,o200k_base",
+            ],
+        );
+
+        let total = |method: TokenizationMethod| {
+            result
+                .tokenizer_totals
+                .iter()
+                .find(|(compared, _)| *compared == method)
+                .map(|(_, total)| *total)
+                .unwrap()
+        };
+        assert_eq!(result.tokenizer_totals.len(), 2);
+        // Newer encodings have more non-English vocabulary
+        assert!(total(TokenizationMethod::R50kBase) > result.total_tokens);
+        assert!(total(TokenizationMethod::O200kBase) < result.total_tokens);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn metadata_gives_the_mode_and_modification_time() {
+        use std::os::unix::fs::PermissionsExt;
+        use std::time::{Duration, SystemTime};
+
+        let path = temp_file("metadata.rs", "fn main() {}\n");
+        fs::set_permissions(&path, fs::Permissions::from_mode(0o640)).unwrap();
+        let modified = SystemTime::UNIX_EPOCH + Duration::from_secs(1_700_000_000);
+        File::options()
+            .write(true)
+            .open(&path)
+            .unwrap()
+            .set_modified(modified)
+            .unwrap();
+
+        assert_eq!(
+            file_metadata(&fs::metadata(&path).unwrap()).to_string(),
+            format!(
+                "Mode: 640, Modified: {}",
+                chrono::DateTime::<chrono::Local>::from(modified).to_rfc3339()
+            )
+        );
+    }
+
+    #[test]
+    fn metadata_is_written_under_the_file_header() {
+        let dir = temp_dir("include-metadata", &[("main.rs", "fn main() {}\n")]);
+        let (_, output) = run(&dir, &["--include-metadata"]);
+        let header = output.lines().nth(1).unwrap();
+        assert!(header.starts_with("Mode: "), "{}", output);
+        assert!(header.contains(", Modified: "), "{}", output);
+
+        let (_, output) = run(&dir, &["--include-metadata", "--format", "jsonl"]);
+        let entry: serde_json::Value =
+            serde_json::from_str(output.lines().next().unwrap()).unwrap();
+        assert!(entry["mode"].is_string(), "{}", output);
+        assert!(entry["mod_time"].is_string(), "{}", output);
+        assert!(entry.get("metadata").is_none(), "{}", output);
+
+        let (_, output) = run(&dir, &[]);
+        assert!(!output.contains("Mode: "));
+    }
+
+    fn five_files(name: &str) -> PathBuf {
+        temp_dir(
+            name,
+            &[
+                ("a.txt", "a"),
+                ("b.txt", "b"),
+                ("c.txt", "c"),
+                ("d.txt", "d"),
+                ("e.txt", "e"),
+            ],
+        )
+    }
+
+    #[test]
+    fn max_files_processes_exactly_that_many_files() {
+        let dir = five_files("max-files");
+        let (result, output) = run(&dir, &["--max-files", "2"]);
+        assert_eq!(result.files_processed, 2);
+        assert_eq!(result.files_truncated, 3);
+        assert_eq!(output.matches("File: ").count(), 2);
+
+        let (result, _) = run(&dir, &["--max-files", "5"]);
+        assert_eq!(result.files_processed, 5);
+        assert_eq!(result.files_truncated, 0);
+    }
+
+    #[test]
+    fn max_files_error_fails_instead_of_truncating() {
+        let dir = five_files("max-files-error");
+        let error = try_run(&dir, &["--max-files", "2", "--max-files-error"])
+            .err()
+            .unwrap();
+        assert_eq!(
+            error.to_string(),
+            "Found 5 files to combine, more than --max-files 2"
+        );
+    }
+
+    #[test]
+    fn analyze_counts_line_endings() {
+        let dir = temp_dir(
+            "analyze",
+            &[
+                ("crlf.txt", "one\r\ntwo\r\n"),
+                ("lf.txt", "one\ntwo\n"),
+                ("mixed.txt", "one\r\ntwo\n"),
+            ],
+        );
+        let (result, _) = run(&dir, &["--analyze"]);
+        let line_endings = result.line_endings.unwrap();
+        assert_eq!(line_endings.lf, 1);
+        assert_eq!(line_endings.crlf, 1);
+        assert_eq!(line_endings.mixed.len(), 1);
+        assert!(line_endings.mixed[0].ends_with("mixed.txt"));
+
+        let (result, _) = run(&dir, &[]);
+        assert!(result.line_endings.is_none());
+    }
+
+    #[test]
+    fn the_prompt_comes_first_and_counts_toward_the_total() {
+        let dir = temp_dir("prompt", &[("main.rs", "fn main() {}\n")]);
+        let (without, _) = run(&dir, &[]);
+        let (result, output) = run(&dir, &["--prompt", "Review this code carefully"]);
+
+        assert!(output.starts_with("Review this code carefully\n\nFile: "));
+        let prompt_tokens = result.prompt_tokens.unwrap();
+        assert!(prompt_tokens > 0);
+        assert_eq!(result.total_tokens, without.total_tokens + prompt_tokens);
+    }
+
+    #[test]
+    fn the_prompt_can_be_read_from_a_file() {
+        let prompt_file = temp_file("prompt.txt", "Summarize the changes.\n\n\n");
+        let dir = temp_dir("prompt-file", &[("main.rs", "fn main() {}\n")]);
+        let (_, output) = run(&dir, &["--prompt-file", prompt_file.to_str().unwrap()]);
+        assert!(output.starts_with("Summarize the changes.\n\nFile: "));
+    }
+
+    // A processor that collects entries instead of writing them
+    fn collecting_processor() -> FileProcessor<'static> {
+        FileProcessor {
+            source: &OsFiles,
+            output: OutputSink::Collect(Mutex::new(Vec::new())),
+            layout: Layout {
+                format: OutputFormat::Text,
+                custom: None,
+                separator: None,
+                file_separator: String::new(),
+                front_matter: None,
+                json_pretty: false,
+                git_ref: None,
+                empty_dirs: None,
+                trailing_newline: true,
+                write_buffer_size: 8 * 1024,
+            },
+            files_written: AtomicUsize::new(0),
+            separators_written: AtomicUsize::new(0),
+            progress: None,
+            bpe: Arc::new(Tokenizer::Bpe(cl100k_base().unwrap())),
+            pipeline: ContentPipeline {
+                transformers: Vec::new(),
+                redactor: None,
+                redactions: AtomicUsize::new(0),
+                wrap: None,
+            },
+            comparisons: Vec::new(),
+            file_metadata: None,
+            line_endings: None,
+            transcoded: None,
+            words: None,
+            compacted: None,
+            delimiter_tokens: None,
+            read_retries: 0,
+            retried: None,
+            binary_limit: None,
+            verbose: 0,
+            display_names: HashMap::new(),
+            cpu_pool: ThreadPoolBuilder::new().num_threads(1).build().unwrap(),
+            stream_threshold: u64::MAX,
+            mirror_dir: None,
+        }
+    }
+
+    // Files under /proc report a size of 0 but read back their contents, so
+    // only the size of what was read can be right
+    #[cfg(target_os = "linux")]
+    #[test]
+    fn file_size_is_the_number_of_bytes_read() {
+        let path = Path::new("/proc/self/status");
+        assert_eq!(fs::metadata(path).unwrap().len(), 0);
+
+        let processor = collecting_processor();
+        let (_, file_size) = processor.process_file(path, 0).unwrap();
+        let entries = match processor.output {
+            OutputSink::Collect(collected) => collected.into_inner().unwrap(),
+            _ => unreachable!(),
+        };
+        assert!(file_size > 0);
+        assert_eq!(file_size, entries[0].content.len() as u64);
+    }
+
+    #[test]
+    fn detect_encoding_transcodes_a_latin1_file() {
+        let dir = temp_dir("latin1", &[("ascii.txt", "plain\n")]);
+        fs::write(dir.join("latin1.txt"), b"caf\xe9 cr\xe8me\n").unwrap();
+
+        let (result, output) = run(&dir, &[]);
+        assert_eq!(result.files_transcoded, None);
+        assert_eq!(result.skipped_files.len(), 1);
+        assert!(!output.contains("caf"));
+
+        let (result, output) = run(&dir, &["--detect-encoding"]);
+        assert_eq!(result.files_transcoded, Some(1));
+        assert!(result.skipped_files.is_empty());
+        assert!(output.contains("café crème\n"));
+    }
+
+    #[test]
+    fn flatten_gives_colliding_files_unique_names() {
+        let dir = temp_dir(
+            "flatten",
+            &[
+                ("server/main.rs", "mod server;\n"),
+                ("client/main.rs", "mod client;\n"),
+            ],
+        );
+        let (result, output) = run(&dir, &["--flatten"]);
+        assert_eq!(result.flatten_renames, Some(1));
+        let entries: Vec<&str> = output.split("File: ").skip(1).collect();
+        assert_eq!(entries.len(), 2);
+        for entry in entries {
+            if entry.starts_with("\"main.rs\"\n") {
+                assert!(entry.contains("mod client;"), "{}", output);
+            } else {
+                assert!(entry.starts_with("\"main_2.rs\"\n"), "{}", output);
+                assert!(entry.contains("mod server;"), "{}", output);
+            }
+        }
+    }
+
+    #[test]
+    fn include_keeps_only_matching_files() {
+        let dir = temp_dir(
+            "include",
+            &[
+                ("main.py", "print(\"main\")\n"),
+                ("cmd/tool/tool.py", "print(\"tool\")\n"),
+                ("README.md", "# Readme\n"),
+                ("src/lib.rs", "pub fn lib() {}\n"),
+            ],
+        );
+        let (result, output) = run(&dir, &["--include", "*.py"]);
+        assert_eq!(result.files_processed, 2);
+        assert!(output.contains("print(\"main\")"));
+        assert!(output.contains("print(\"tool\")"));
+        assert!(!output.contains("# Readme"));
+        assert_eq!(result.skip_counts[&SkipReason::NotIncluded], 2);
+    }
+
+    #[test]
+    fn the_estimated_size_matches_the_written_output() {
+        // The estimate leaves out the line break added after contents that
+        // do not end with one, as in each of the five files
+        let dir = five_files("estimate");
+        let (result, output) = run(&dir, &[]);
+        assert_eq!(result.estimated_size + 5, output.len() as u64);
+
+        let (result, output) = run(&dir, &["--flatten", "--prompt", "Review this code."]);
+        assert_eq!(result.estimated_size + 5, output.len() as u64);
+    }
+
+    #[test]
+    fn yes_writes_output_over_the_confirmation_threshold() {
+        let dir = five_files("confirm-over");
+        let (result, output) = run(&dir, &["--confirm-over", "10", "--yes"]);
+        assert!(result.estimated_size > 10);
+        assert_eq!(result.files_processed, 5);
+        assert_eq!(result.estimated_size + 5, output.len() as u64);
+    }
+
+    #[test]
+    fn every_listed_tokenizer_name_loads_its_encoding() {
+        for (name, method) in &TOKENIZER_NAMES {
+            let parsed = TokenizationMethod::from_str(name).unwrap();
+            assert_eq!(&parsed, method, "{}", name);
+            let bpe = get_tokenizer(&parsed).unwrap();
+            assert!(bpe.count("fn main() {}") > 0, "{}", name);
+        }
+    }
+
+    #[test]
+    fn jsonl_writes_one_decodable_object_per_line() {
+        let dir = temp_dir(
+            "jsonl",
+            &[
+                ("a.rs", "fn a() {\n    \"quoted\"\n}\n"),
+                ("b.txt", "line one\r\nline two\n"),
+            ],
+        );
+        let (result, output) = run(&dir, &["--format", "jsonl", "--prompt", "Review\nthis"]);
+        let lines: Vec<serde_json::Value> = output
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect();
+        assert_eq!(lines.len(), 3);
+        assert_eq!(
+            lines[0],
+            serde_json::json!({ "prompt": "Review\nthis\n\n" })
+        );
+
+        let mut files = lines[1..].to_vec();
+        files.sort_by_key(|file| file["path"].as_str().unwrap().to_string());
+        assert!(files[0]["path"].as_str().unwrap().ends_with("a.rs"));
+        assert_eq!(files[0]["contents"], "fn a() {\n    \"quoted\"\n}\n");
+        assert_eq!(files[1]["contents"], "line one\r\nline two\n");
+        let tokens: u64 = files
+            .iter()
+            .map(|file| file["tokens"].as_u64().unwrap())
+            .sum();
+        assert_eq!(
+            tokens as usize + result.prompt_tokens.unwrap(),
+            result.total_tokens
+        );
+    }
+
+    #[test]
+    fn the_estimated_size_matches_jsonl_output() {
+        let dir = five_files("estimate-jsonl");
+        let (result, output) = run(&dir, &["--format", "jsonl"]);
+        assert_eq!(result.estimated_size, output.len() as u64);
+    }
+
+    #[test]
+    fn concurrency_settings_do_not_change_the_result() {
+        let dir = five_files("concurrency");
+        let (expected, expected_output) = run(&dir, &[]);
+        for args in [
+            ["--io-concurrency", "1", "--cpu-concurrency", "1"],
+            ["--io-concurrency", "8", "--cpu-concurrency", "2"],
+        ] {
+            let (result, output) = run(&dir, &args);
+            assert_eq!(result.files_processed, expected.files_processed);
+            assert_eq!(result.total_tokens, expected.total_tokens);
+            let mut lines: Vec<&str> = output.lines().collect();
+            let mut expected_lines: Vec<&str> = expected_output.lines().collect();
+            lines.sort();
+            expected_lines.sort();
+            assert_eq!(lines, expected_lines);
+        }
+    }
+
+    #[test]
+    fn headers_show_paths_relative_to_the_input_directory() {
+        let dir = temp_dir("relative", &[("src/nested/lib.rs", "pub fn lib() {}\n")]);
+        let (_, output) = run(&dir, &[]);
+        assert!(
+            output.starts_with("File: \"src/nested/lib.rs\"\n"),
+            "{}",
+            output
+        );
+    }
+
+    #[test]
+    fn samples_are_spread_evenly_from_the_first_item() {
+        let items: Vec<usize> = (0..10).collect();
+        assert_eq!(sample_evenly(&items, 3), [0, 3, 6]);
+        assert_eq!(sample_evenly(&items, 5), [0, 2, 4, 6, 8]);
+        assert_eq!(sample_evenly(&items, 10), items);
+    }
+
+    #[test]
+    fn sample_combines_exactly_that_many_files_deterministically() {
+        let dir = five_files("sample");
+        let (result, output) = run(&dir, &["--sample", "2"]);
+        assert_eq!(result.files_processed, 2);
+        assert_eq!(result.sample, Some((2, 5)));
+        assert!(output.contains("File: \"a.txt\"\n"), "{}", output);
+        assert!(output.contains("File: \"c.txt\"\n"), "{}", output);
+
+        let (_, again) = run(&dir, &["--sample", "2"]);
+        assert_eq!(again.len(), output.len());
+        assert!(again.contains("File: \"a.txt\"\n"), "{}", again);
+        assert!(again.contains("File: \"c.txt\"\n"), "{}", again);
+    }
+
+    #[test]
+    fn a_sample_larger_than_the_candidates_keeps_every_file() {
+        let dir = five_files("sample-all");
+        let (result, _) = run(&dir, &["--sample", "9"]);
+        assert_eq!(result.files_processed, 5);
+        assert_eq!(result.sample, None);
+    }
+
+    #[test]
+    fn chat_overhead_is_added_once_per_file() {
+        let dir = five_files("chat-overhead");
+        let (without, _) = run(&dir, &[]);
+        assert_eq!(without.chat_overhead_tokens, None);
+
+        let (result, _) = run(&dir, &["--chat-overhead"]);
+        assert_eq!(result.chat_overhead_tokens, Some(5 * DEFAULT_CHAT_OVERHEAD));
+        assert_eq!(
+            result.total_tokens,
+            without.total_tokens + 5 * DEFAULT_CHAT_OVERHEAD
+        );
+
+        let (result, _) = run(&dir, &["--chat-overhead", "7", "--max-files", "2"]);
+        assert_eq!(result.chat_overhead_tokens, Some(14));
+    }
+
+    #[test]
+    fn a_custom_separator_replaces_the_file_header() {
+        let dir = temp_dir("separator", &[("main.rs", "fn main() {}\n")]);
+        let (result, output) = run(&dir, &["--separator", "=== {path} ({index}) ==="]);
+        assert_eq!(output, "=== main.rs (1) ===\nfn main() {}\n");
+        assert_eq!(result.estimated_size, output.len() as u64);
+    }
+
+    #[test]
+    fn separator_indexes_count_every_file() {
+        let dir = five_files("separator-index");
+        let (_, output) = run(&dir, &["--separator", "#{index} {path}"]);
+        for index in 1..=5 {
+            assert_eq!(
+                output.matches(&format!("#{} ", index)).count(),
+                1,
+                "{}",
+                output
+            );
+        }
+    }
+
+    #[test]
+    fn a_separator_is_rejected_for_jsonl() {
+        let dir = five_files("separator-jsonl");
+        let error = try_run(&dir, &["--format", "jsonl", "--separator", "{path}"])
+            .err()
+            .unwrap();
+        assert_eq!(
+            error.to_string(),
+            "--separator only applies to the text output format"
+        );
+    }
+
+    #[test]
+    fn use_dockerignore_skips_what_the_dockerignore_excludes() {
+        let dir = temp_dir(
+            "dockerignore",
+            &[
+                (
+                    ".dockerignore",
+                    "# build context\nnode_modules\n*.md\n!README.md\n/docs/internal\n",
+                ),
+                ("node_modules/dep/index.js", "module.exports = 1;\n"),
+                ("src/app.js", "console.log(\"app\");\n"),
+                ("src/node_modules.js", "// not a directory\n"),
+                ("CHANGELOG.md", "# Changes\n"),
+                ("README.md", "# Readme\n"),
+                ("docs/internal/notes.txt", "internal\n"),
+                ("docs/guide.txt", "guide\n"),
+            ],
+        );
+        let (result, output) = run(&dir, &["--use-dockerignore"]);
+        let mut combined: Vec<&str> = result
+            .file_stats
+            .iter()
+            .map(|(path, _, _)| path.strip_prefix(dir.to_str().unwrap()).unwrap())
+            .collect();
+        combined.sort();
+        assert_eq!(
+            combined,
+            [
+                "/README.md",
+                "/docs/guide.txt",
+                "/src/app.js",
+                "/src/node_modules.js"
+            ],
+            "{}",
+            output
+        );
+
+        let (result, _) = run(&dir, &[]);
+        assert_eq!(result.files_processed, 7);
+    }
+
+    // Several pieces' worth of short lines, so a streamed file is cut more
+    // than once
+    fn large_contents() -> String {
+        "let value = \"ä\";\n".repeat(3 * STREAM_CHUNK_SIZE / 16)
+    }
+
+    #[test]
+    fn streamed_files_are_written_like_files_read_whole() {
+        let contents = large_contents();
+        let dir = temp_dir("stream", &[("big.rs", &contents)]);
+
+        let (whole, whole_output) = run(&dir, &[]);
+        let (streamed, streamed_output) = run(&dir, &["--stream-threshold", "1KB"]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(streamed_output, whole_output);
+        assert_eq!(streamed.total_tokens, whole.total_tokens);
+        assert_eq!(streamed.file_stats[0].2, contents.len() as u64);
+    }
+
+    #[test]
+    fn streamed_jsonl_entries_are_valid_json() {
+        let contents = large_contents();
+        let dir = temp_dir("stream-jsonl", &[("big.rs", &contents)]);
+
+        let (result, output) = run(&dir, &["--format", "jsonl", "--stream-threshold", "1KB"]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        let entry: serde_json::Value =
+            serde_json::from_str(output.lines().next().unwrap()).unwrap();
+        assert_eq!(entry["path"], "big.rs");
+        assert_eq!(entry["contents"], contents.as_str());
+        assert_eq!(entry["tokens"], result.total_tokens);
+    }
+
+    fn git_layout(format: OutputFormat) -> Layout {
+        Layout {
+            format,
+            custom: None,
+            separator: None,
+            file_separator: String::new(),
+            front_matter: None,
+            json_pretty: false,
+            git_ref: Some(GitRef {
+                commit: "0123abc".to_string(),
+                branch: Some("main".to_string()),
+            }),
+            empty_dirs: None,
+            trailing_newline: true,
+            write_buffer_size: 8 * 1024,
+        }
+    }
+
+    #[test]
+    fn the_git_revision_follows_the_prompt() {
+        let mut output = Vec::new();
+        git_layout(OutputFormat::Text)
+            .write_preamble(&mut output, Some("Review this\n\n"), None)
+            .unwrap();
+        assert_eq!(
+            String::from_utf8(output).unwrap(),
+            "Review this\n\nGit revision: 0123abc (main)\n\n"
+        );
+    }
+
+    #[test]
+    fn the_git_revision_is_a_jsonl_line_of_its_own() {
+        let mut output = Vec::new();
+        git_layout(OutputFormat::Jsonl)
+            .write_preamble(&mut output, None, None)
+            .unwrap();
+        let line: serde_json::Value = serde_json::from_slice(&output).unwrap();
+        assert_eq!(line["git"]["commit"], "0123abc");
+        assert_eq!(line["git"]["branch"], "main");
+    }
+
+    #[test]
+    fn the_git_header_is_left_out_outside_a_repository() {
+        let dir = temp_dir("git-header", &[("main.rs", "fn main() {}\n")]);
+        let (_, output) = run(&dir, &["--git-ref-header"]);
+        fs::remove_dir_all(&dir).unwrap();
+        assert!(!output.contains("Git revision:"));
+        assert!(output.starts_with("File: \"main.rs\""));
+    }
+
+    fn entry(path: &str, content: &str) -> FileEntry {
+        FileEntry {
+            path: path.to_string(),
+            metadata: None,
+            encoding: None,
+            content: content.to_string(),
+            tokens: 0,
+            size: content.len() as u64,
+            position: 0,
+        }
+    }
+
+    #[test]
+    fn every_entry_ends_with_one_line_break() {
+        let layout = Layout {
+            format: OutputFormat::Text,
+            custom: None,
+            separator: None,
+            file_separator: String::new(),
+            front_matter: None,
+            json_pretty: false,
+            git_ref: None,
+            empty_dirs: None,
+            trailing_newline: true,
+            write_buffer_size: 8 * 1024,
+        };
+        let mut output = Vec::new();
+        layout
+            .write_entry(&mut output, &entry("a.rs", "fn a() {}\n"), 1)
+            .unwrap();
+        layout
+            .write_entry(&mut output, &entry("b.rs", "fn b() {}"), 2)
+            .unwrap();
+
+        let dashes = "-".repeat(80);
+        assert_eq!(
+            String::from_utf8(output).unwrap(),
+            format!(
+                "File: \"a.rs\"\n{0}\nfn a() {{}}\n{0}\nFile: \"b.rs\"\n{0}\nfn b() {{}}\n{0}\n",
+                dashes
+            )
+        );
+    }
+
+    #[test]
+    fn custom_separators_follow_content_on_a_line_of_their_own() {
+        let layout = Layout {
+            format: OutputFormat::Text,
+            custom: None,
+            separator: Some("=== {path}".to_string()),
+            file_separator: String::new(),
+            front_matter: None,
+            json_pretty: false,
+            git_ref: None,
+            empty_dirs: None,
+            trailing_newline: true,
+            write_buffer_size: 8 * 1024,
+        };
+        let mut output = Vec::new();
+        layout
+            .write_entry(&mut output, &entry("a.rs", "fn a() {}"), 1)
+            .unwrap();
+        layout
+            .write_entry(&mut output, &entry("b.rs", "fn b() {}\n"), 2)
+            .unwrap();
+
+        assert_eq!(
+            String::from_utf8(output).unwrap(),
+            "=== a.rs\nfn a() {}\n=== b.rs\nfn b() {}\n"
+        );
+    }
+
+    #[test]
+    fn no_trailing_newline_drops_the_final_newline_only() {
+        let dir = temp_dir("trailing-newline", &[("a.rs", "fn a() {}")]);
+        let dashes = "-".repeat(80);
+
+        let (_, output) = run(&dir, &[]);
+        assert_eq!(
+            output,
+            format!("File: \"a.rs\"\n{0}\nfn a() {{}}\n{0}\n", dashes)
+        );
+        let (_, output) = run(&dir, &["--no-trailing-newline"]);
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(
+            output,
+            format!("File: \"a.rs\"\n{0}\nfn a() {{}}\n{0}", dashes)
+        );
+    }
+
+    #[test]
+    fn streamed_files_without_a_final_newline_get_one() {
+        let dir = temp_dir("trailing-newline-stream", &[("a.rs", "fn a() {}")]);
+        let (_, whole) = run(&dir, &[]);
+        let (_, streamed) = run(&dir, &["--stream-threshold", "1"]);
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(streamed, whole);
+    }
+
+    #[test]
+    fn lockfiles_are_recognized_by_name() {
+        assert!(is_lockfile(Path::new("package-lock.json")));
+        assert!(is_lockfile(Path::new("web/yarn.lock")));
+        assert!(is_lockfile(Path::new("Cargo.lock")));
+        assert!(!is_lockfile(Path::new("package.json")));
+        assert!(!is_lockfile(Path::new("docs/Cargo.lock.md")));
+    }
+
+    #[test]
+    fn exclude_lockfiles_skips_lockfiles_as_lockfiles() {
+        let dir = temp_dir(
+            "lockfiles",
+            &[
+                ("package.json", "{}\n"),
+                ("package-lock.json", "{\"lockfileVersion\": 3}\n"),
+                ("go.sum", "example.com/mod v1.0.0 h1:abc=\n"),
+            ],
+        );
+
+        let (result, output) = run(&dir, &["--exclude-lockfiles"]);
+        assert_eq!(result.files_processed, 1);
+        assert!(!output.contains("lockfileVersion"));
+        assert_eq!(result.skip_counts[&SkipReason::Lockfile], 2);
+        assert_eq!(result.unexpected_skips(), 0);
+
+        let (result, output) = run(&dir, &[]);
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(result.files_processed, 2);
+        assert!(output.contains("lockfileVersion"));
+        assert_eq!(result.skip_counts[&SkipReason::NonText], 1);
+    }
+
+    #[test]
+    fn sort_mtime_writes_the_newest_file_first() {
+        let dir = temp_dir(
+            "sort-mtime",
+            &[
+                ("old.rs", "fn old() {}\n"),
+                ("new.rs", "fn new() {}\n"),
+                ("mid.rs", "fn mid() {}\n"),
+            ],
+        );
+        let now = std::time::SystemTime::now();
+        for (name, age) in [("old.rs", 300), ("mid.rs", 200), ("new.rs", 100)] {
+            File::options()
+                .write(true)
+                .open(dir.join(name))
+                .unwrap()
+                .set_modified(now - std::time::Duration::from_secs(age))
+                .unwrap();
+        }
+
+        let (_, output) = run(&dir, &["--sort", "mtime"]);
+        fs::remove_dir_all(&dir).unwrap();
+        let headers: Vec<&str> = output
+            .lines()
+            .filter(|line| line.starts_with("File: "))
+            .collect();
+        assert_eq!(
+            headers,
+            ["File: \"new.rs\"", "File: \"mid.rs\"", "File: \"old.rs\""]
+        );
+    }
+
+    #[test]
+    fn max_files_keeps_the_first_files_in_sort_order() {
+        let dir = temp_dir(
+            "sort-max-files",
+            &[
+                ("small.rs", "fn s() {}\n"),
+                ("large.rs", "fn large() { let x = 1; }\n"),
+            ],
+        );
+        let (_, output) = run(&dir, &["--sort", "size", "--max-files", "1"]);
+        fs::remove_dir_all(&dir).unwrap();
+        assert!(output.contains("fn large()"));
+        assert!(!output.contains("fn s()"));
+    }
+
+    // The 8-byte PNG signature followed by the start of an IHDR chunk
+    const PNG_BYTES: &[u8] = b"\x89PNG\r\n\x1a\n\0\0\0\rIHDR\0\0\0\x01\0\0\0\x01\x08\x06\0\0\0";
+
+    #[test]
+    fn binary_files_are_included_base64_encoded() {
+        let dir = temp_dir("base64", &[("main.rs", "fn main() {}\n")]);
+        fs::write(dir.join("pixel.png"), PNG_BYTES).unwrap();
+
+        let (result, output) = run(
+            &dir,
+            &["--include-binary-as-base64", "--max-binary-size", "1K"],
+        );
+        let (_, jsonl) = run(
+            &dir,
+            &[
+                "--include-binary-as-base64",
+                "--max-binary-size",
+                "1K",
+                "--format",
+                "jsonl",
+            ],
+        );
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(result.files_processed, 2);
+        let encoded = BASE64.encode(PNG_BYTES);
+        assert!(output.contains(&format!(
+            "File: \"pixel.png\"\nEncoding: base64\n{}\n{}\n",
+            "-".repeat(80),
+            encoded
+        )));
+        let png: serde_json::Value = jsonl
+            .lines()
+            .map(|line| serde_json::from_str::<serde_json::Value>(line).unwrap())
+            .find(|entry| entry["path"] == "pixel.png")
+            .unwrap();
+        assert_eq!(png["encoding"], "base64");
+        assert_eq!(png["contents"], encoded.as_str());
+    }
+
+    #[test]
+    fn binary_files_over_the_size_guard_are_skipped() {
+        let dir = temp_dir("base64-large", &[]);
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(dir.join("pixel.png"), PNG_BYTES).unwrap();
+
+        let (result, output) = run(
+            &dir,
+            &["--include-binary-as-base64", "--max-binary-size", "8"],
+        );
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(result.files_processed, 0);
+        assert_eq!(result.skip_counts[&SkipReason::NonText], 1);
+        assert!(!output.contains("pixel.png"));
+    }
+
+    #[test]
+    fn text_files_with_unknown_extensions_are_not_included_as_binary() {
+        let dir = temp_dir("base64-text", &[("notes.unknown", "plain text\n")]);
+        let (result, _) = run(
+            &dir,
+            &["--include-binary-as-base64", "--max-binary-size", "1K"],
+        );
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(result.files_processed, 0);
+        assert_eq!(result.skip_counts[&SkipReason::NonText], 1);
+    }
+
+    #[test]
+    fn including_binary_files_needs_a_size_guard() {
+        assert!(Opt::from_iter_safe(["combiner", "--include-binary-as-base64"]).is_err());
+    }
+
+    #[test]
+    fn nul_bytes_or_invalid_utf8_look_binary() {
+        assert!(looks_binary(b"a\0b"));
+        assert!(looks_binary(b"\xff\xfe"));
+        assert!(!looks_binary("plain text é".as_bytes()));
+        // A character cut off by the scan limit is not binary
+        assert!(!looks_binary(&"é".as_bytes()[..1]));
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn links_to_files_are_combined_unless_symlinks_are_ignored() {
+        let dir = temp_dir("symlinks", &[("real.rs", "fn real() {}\n")]);
+        std::os::unix::fs::symlink(dir.join("real.rs"), dir.join("link.rs")).unwrap();
+
+        let (result, output) = run(&dir, &[]);
+        assert_eq!(result.files_processed, 2);
+        assert!(output.contains("File: \"link.rs\""));
+
+        let (result, output) = run(&dir, &["--ignore-symlinks"]);
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(result.files_processed, 1);
+        assert!(!output.contains("File: \"link.rs\""));
+        assert_eq!(result.skip_counts[&SkipReason::Symlink], 1);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn links_to_directories_are_not_followed() {
+        let dir = temp_dir("symlinked-dir", &[("src/lib.rs", "pub fn f() {}\n")]);
+        std::os::unix::fs::symlink(dir.join("src"), dir.join("linked")).unwrap();
+
+        let (result, output) = run(&dir, &[]);
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(result.files_processed, 1);
+        assert!(!output.contains("linked"));
+    }
+
+    // Each file's token count keyed by file name
+    fn tokens_by_name(result: &ProcessingResult) -> HashMap<String, usize> {
+        result
+            .file_stats
+            .iter()
+            .map(|(path, tokens, _)| {
+                let name = Path::new(path).file_name().unwrap().to_string_lossy();
+                (name.into_owned(), *tokens)
+            })
+            .collect()
+    }
+
+    #[test]
+    fn the_toc_lists_every_file_with_its_token_count() {
+        let dir = temp_dir(
+            "toc",
+            &[
+                ("b.rs", "fn b() { let x = 1; }\n"),
+                ("a.rs", "fn a() {}\n"),
+                ("c.rs", "fn c() { println!(\"c\"); }\n"),
+            ],
+        );
+        let (result, output) = run(&dir, &["--toc", "--prompt", "Review this."]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        let tokens = tokens_by_name(&result);
+        let files_total: usize = tokens.values().sum();
+        let expected = format!(
+            "Review this.\n\nTable of Contents:\n1. a.rs ({} tokens)\n2. b.rs ({} tokens)\n3. c.rs ({} tokens)\nTotal: {} tokens in 3 files\n\nFile: \"a.rs\"\n",
+            tokens["a.rs"], tokens["b.rs"], tokens["c.rs"], files_total
+        );
+        assert!(output.starts_with(&expected), "{}", output);
+
+        let toc_tokens = result.toc_tokens.unwrap();
+        assert!(toc_tokens > 0);
+        assert_eq!(
+            result.total_tokens,
+            files_total + result.prompt_tokens.unwrap() + toc_tokens
+        );
+    }
+
+    #[test]
+    fn the_jsonl_toc_is_a_line_of_its_own() {
+        let dir = temp_dir(
+            "toc-jsonl",
+            &[("b.rs", "fn b() {}\n"), ("a.rs", "fn a() {}\n")],
+        );
+        let (result, output) = run(&dir, &["--toc", "--format", "jsonl"]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        let tokens = tokens_by_name(&result);
+        let toc: serde_json::Value = serde_json::from_str(output.lines().next().unwrap()).unwrap();
+        assert_eq!(toc["toc"]["files"][0]["path"], "a.rs");
+        assert_eq!(toc["toc"]["files"][0]["tokens"], tokens["a.rs"]);
+        assert_eq!(toc["toc"]["files"][1]["path"], "b.rs");
+        assert_eq!(toc["toc"]["total_tokens"], tokens["a.rs"] + tokens["b.rs"]);
+    }
+
+    #[test]
+    fn files_with_matching_content_are_skipped() {
+        let dir = temp_dir(
+            "exclude-content",
+            &[
+                ("clean.rs", "fn clean() {}\n"),
+                ("wip.rs", "// DO NOT COMMIT\nfn wip() {}\n"),
+            ],
+        );
+        let (result, output) = run(&dir, &["--exclude-content-matching", "DO NOT COMMIT"]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(result.files_processed, 1);
+        assert!(output.contains("fn clean() {}"));
+        assert!(!output.contains("fn wip() {}"));
+        assert_eq!(result.skip_counts[&SkipReason::ContentExcluded], 1);
+    }
+
+    #[test]
+    fn an_invalid_content_regex_is_rejected_when_parsing() {
+        assert!(Opt::from_iter_safe(["combiner", "--exclude-content-matching", "("]).is_err());
+    }
+
+    #[test]
+    fn directories_with_a_file_anywhere_below_them_are_not_empty() {
+        let visited_dirs: BTreeSet<PathBuf> = ["src", "src/nested", "docs", "docs/old"]
+            .iter()
+            .map(PathBuf::from)
+            .collect();
+        let files = [Path::new("src/nested/deep.rs")];
+        assert_eq!(find_empty_dirs(visited_dirs, &files), ["docs", "docs/old"]);
+    }
+
+    #[test]
+    fn empty_directories_are_listed_before_the_first_file() {
+        let dir = temp_dir(
+            "empty-dirs",
+            &[("src/main.rs", "fn main() {}\n"), ("logs/run.txt", "log\n")],
+        );
+        fs::create_dir_all(dir.join("assets")).unwrap();
+        let (result, output) = run(&dir, &["--note-empty-dirs", "--include", "*.rs"]);
+        let (without, _) = run(&dir, &["--include", "*.rs"]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        let assets = dir.join("assets").to_string_lossy().into_owned();
+        let logs = dir.join("logs").to_string_lossy().into_owned();
+        assert_eq!(result.empty_dirs, Some(vec![assets.clone(), logs.clone()]));
+        assert!(output.starts_with(&format!(
+            "Directories with no files combined:\n- {}\n- {}\n\n",
+            assets, logs
+        )));
+        assert_eq!(without.empty_dirs, None);
+    }
+
+    #[test]
+    fn a_likely_secret_aborts_before_the_output_is_written() {
+        let dir = temp_dir(
+            "abort-on-secret",
+            &[
+                ("main.rs", "fn main() {}\n"),
+                ("settings.py", "# settings\nAPI_KEY=sk_live_abcdef123456\n"),
+            ],
+        );
+        let output_file = dir.with_extension("out.txt");
+        let error = try_run(&dir, &["--abort-on-secret"])
+            .err()
+            .expect("a secret should abort the run");
+        let (_, clean) = run(&dir, &["--abort-on-secret", "--include", "*.rs"]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        let message = error.to_string();
+        assert!(message.starts_with("Aborted: likely secrets found"));
+        assert!(message.contains(&format!("{}:2", dir.join("settings.py").display())));
+        assert!(!message.contains("main.rs"));
+        assert!(!output_file.exists());
+        assert!(clean.contains("fn main() {}"));
+    }
+
+    #[test]
+    fn a_leading_byte_order_mark_is_dropped() {
+        let contents = large_contents();
+        let with_bom = format!("\u{feff}{}", contents);
+        let dir = temp_dir(
+            "bom",
+            &[
+                ("small.rs", "\u{feff}fn main() {}\n"),
+                ("big.rs", &with_bom),
+            ],
+        );
+
+        let (whole, whole_output) = run(&dir, &[]);
+        let (streamed, streamed_output) = run(&dir, &["--stream-threshold", "1KB"]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert!(!whole_output.contains('\u{feff}'));
+        assert!(whole_output.contains("\nfn main() {}\n"));
+        assert!(whole_output.contains(&format!("\n{}", contents)));
+        assert_eq!(streamed_output, whole_output);
+        assert_eq!(streamed.total_tokens, whole.total_tokens);
+        // Sizes still count the bytes read
+        let big_size = |result: &ProcessingResult| {
+            result
+                .file_stats
+                .iter()
+                .find(|(name, _, _)| name.ends_with("big.rs"))
+                .map(|(_, _, size)| *size)
+        };
+        assert_eq!(big_size(&whole), Some(with_bom.len() as u64));
+        assert_eq!(big_size(&streamed), Some(with_bom.len() as u64));
+    }
+
+    #[test]
+    fn only_a_leading_byte_order_mark_is_dropped() {
+        assert_eq!(strip_bom("\u{feff}a\u{feff}".to_string()), "a\u{feff}");
+        assert_eq!(strip_bom("a".to_string()), "a");
+    }
+
+    #[test]
+    fn each_encoding_is_loaded_once_and_shared() {
+        let first = get_tokenizer(&TokenizationMethod::R50kBase).unwrap();
+        let second = get_tokenizer(&TokenizationMethod::R50kBase).unwrap();
+        let other = get_tokenizer(&TokenizationMethod::P50kEdit).unwrap();
+        assert!(Arc::ptr_eq(&first, &second));
+        assert!(!Arc::ptr_eq(&first, &other));
+    }
+
+    #[test]
+    fn file_separators_go_between_files_and_count_as_tokens() {
+        let dir = temp_dir(
+            "file-separator",
+            &[
+                ("a.rs", "fn a() {}\n"),
+                ("b.rs", "fn b() {}\n"),
+                ("c.rs", "fn c() {}\n"),
+            ],
+        );
+        let (plain, _) = run(&dir, &["--sort", "path"]);
+        let (result, output) = run(&dir, &["--sort", "path", "--file-separator", r"\n=====\n"]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        let dashes = "-".repeat(80);
+        assert_eq!(output.matches("\n=====\n").count(), 2);
+        assert!(output.contains(&format!("{}\n\n=====\nFile: \"b.rs\"", dashes)));
+        assert!(!output.starts_with('\n'));
+        assert!(output.ends_with(&format!("fn c() {{}}\n{}\n", dashes)));
+
+        let separator_tokens = get_tokenizer(&DEFAULT_TOKENIZATION_METHOD)
+            .unwrap()
+            .count("\n=====\n")
+            * 2;
+        assert_eq!(result.separator_tokens, Some(separator_tokens));
+        assert_eq!(result.total_tokens, plain.total_tokens + separator_tokens);
+    }
+
+    #[test]
+    fn file_separators_only_apply_to_text_output() {
+        let dir = temp_dir("file-separator-jsonl", &[("a.rs", "fn a() {}\n")]);
+        let error = try_run(&dir, &["--format", "jsonl", "--file-separator", "blank"])
+            .err()
+            .unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(
+            error.to_string(),
+            "--file-separator only applies to the text output format"
+        );
+    }
+
+    #[test]
+    fn json_output_is_one_document_with_a_files_array() {
+        let contents = large_contents();
+        let dir = temp_dir(
+            "json",
+            &[
+                ("a.rs", "fn a() {}\n"),
+                ("big.rs", &contents),
+                ("c.rs", "\"c\"\n"),
+            ],
+        );
+        let args = [
+            "--format",
+            "json",
+            "--prompt",
+            "Review",
+            "--toc",
+            "--stream-threshold",
+            "1KB",
+        ];
+        let (result, output) = run(&dir, &args);
+        let mut pretty_args = args.to_vec();
+        pretty_args.push("--json-pretty");
+        let (_, pretty) = run(&dir, &pretty_args);
+        fs::remove_dir_all(&dir).unwrap();
+
+        let document: serde_json::Value = serde_json::from_str(&output).unwrap();
+        assert_eq!(document["schema_version"], SCHEMA_VERSION);
+        assert_eq!(document["prompt"], "Review\n\n");
+        assert_eq!(document["toc"]["files"].as_array().unwrap().len(), 3);
+        let files = document["files"].as_array().unwrap();
+        assert_eq!(files.len(), 3);
+        assert_eq!(files[0]["path"], "a.rs");
+        assert_eq!(files[1]["contents"], contents.as_str());
+        assert_eq!(files[2]["contents"], "\"c\"\n");
+        let tokens: u64 = files
+            .iter()
+            .map(|file| file["tokens"].as_u64().unwrap())
+            .sum();
+        assert_eq!(
+            tokens as usize,
+            result.total_tokens - result.toc_tokens.unwrap() - result.prompt_tokens.unwrap()
+        );
+
+        // Pretty output is the same document, indented as serde_json would
+        let pretty_document: serde_json::Value = serde_json::from_str(&pretty).unwrap();
+        assert_eq!(pretty_document, document);
+        assert!(pretty.starts_with(
+            "{\n  \"schema_version\": 2,\n  \"prompt\": \"Review\\n\\n\",\n  \"toc\": {\n"
+        ));
+        assert!(pretty.contains(
+            "\n  \"files\": [\n    {\n      \"path\": \"a.rs\",\n      \"contents\": \"fn a() {}\\n\",\n      \"tokens\": "
+        ));
+        assert!(pretty.ends_with("\n    }\n  ]\n}\n"));
+    }
+
+    #[test]
+    fn json_pretty_and_split_output_are_checked_against_the_format() {
+        let dir = temp_dir("json-options", &[("a.rs", "fn a() {}\n")]);
+        let pretty_error = try_run(&dir, &["--json-pretty"]).err().unwrap();
+        let split_error = try_run(&dir, &["--format", "json", "--split-tokens", "100"])
+            .err()
+            .unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(
+            pretty_error.to_string(),
+            "--json-pretty only applies to the json output format"
+        );
+        assert_eq!(
+            split_error.to_string(),
+            "--split-tokens does not support the json output format; use jsonl"
+        );
+    }
+
+    #[test]
+    fn words_are_counted_across_unicode_whitespace() {
+        let contents = "one two\tthree\u{3000}four\n".repeat(STREAM_CHUNK_SIZE / 8);
+        let dir = temp_dir(
+            "count-words",
+            &[
+                ("small.md", "Hello,  world!\n\nBye"),
+                ("big.txt", &contents),
+            ],
+        );
+        fs::write(dir.join("pixel.png"), PNG_BYTES).unwrap();
+        let args = [
+            "--count-words",
+            "--include-binary-as-base64",
+            "--max-binary-size",
+            "1K",
+        ];
+        let (whole, _) = run(&dir, &args);
+        let mut streamed_args = args.to_vec();
+        streamed_args.extend(["--stream-threshold", "1KB"]);
+        let (streamed, _) = run(&dir, &streamed_args);
+        let (uncounted, _) = run(&dir, &[]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        let words = 3 + 4 * (STREAM_CHUNK_SIZE / 8);
+        assert_eq!(whole.files_processed, 3);
+        assert_eq!(whole.total_words, Some(words));
+        assert_eq!(streamed.total_words, Some(words));
+        assert_eq!(uncounted.total_words, None);
+    }
+
+    #[test]
+    fn token_breakdown_counts_each_files_framing() {
+        let contents = "let x = 1;\n".repeat(STREAM_CHUNK_SIZE / 4);
+        let dir = temp_dir(
+            "token-breakdown",
+            &[("main.rs", "fn main() {}\n"), ("big.rs", &contents)],
+        );
+        let (plain, _) = run(&dir, &[]);
+        let (whole, _) = run(&dir, &["--token-breakdown"]);
+        let (streamed, _) = run(&dir, &["--token-breakdown", "--stream-threshold", "1KB"]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        let processor = collecting_processor();
+        let framing: usize = plain
+            .file_stats
+            .iter()
+            .map(|(path, _, _)| {
+                let framing = processor.layout.framing(path, None, None, 1).unwrap();
+                processor.bpe.count(&framing)
+            })
+            .sum();
+        assert!(framing > 0);
+        assert_eq!(plain.delimiter_tokens, None);
+        assert_eq!(whole.delimiter_tokens, Some(framing));
+        assert_eq!(streamed.delimiter_tokens, Some(framing));
+        assert_eq!(whole.total_tokens, plain.total_tokens + framing);
+    }
+
+    #[test]
+    fn an_interrupted_run_is_resumed_without_repeating_files() {
+        let dir = temp_dir(
+            "resume",
+            &[
+                ("a.rs", "fn a() {}\n"),
+                ("b.rs", "fn b() {}\n"),
+                ("c.rs", "fn c() {}\n"),
+            ],
+        );
+        let progress_file = dir.with_extension("progress");
+        let args = ["--resume", progress_file.to_str().unwrap()];
+        let (_, complete) = run(&dir, &args);
+
+        // Keep the first recorded file, and leave half an entry and half a
+        // progress line behind as a killed run would
+        let progress = fs::read_to_string(&progress_file).unwrap();
+        let first = progress.lines().next().unwrap();
+        let end = serde_json::from_str::<serde_json::Value>(first).unwrap()["end"]
+            .as_u64()
+            .unwrap() as usize;
+        fs::write(&progress_file, format!("{}\n{{\"path\":", first)).unwrap();
+        let output_file = dir.with_extension("out.txt");
+        fs::write(&output_file, format!("{}File: half", &complete[..end])).unwrap();
+
+        let (result, output) = run(&dir, &args);
+        fs::remove_file(&progress_file).unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(result.files_resumed, Some(1));
+        assert_eq!(result.files_processed, 2);
+        assert!(!output.contains("File: half"));
+        assert_eq!(output.len(), complete.len());
+        for name in ["a", "b", "c"] {
+            assert_eq!(output.matches(&format!("fn {}()", name)).count(), 1);
+        }
+    }
+
+    #[test]
+    fn resume_only_supports_appendable_formats() {
+        let dir = temp_dir("resume-json", &[("main.rs", "fn main() {}\n")]);
+        let progress_file = dir.with_extension("progress");
+        let error = try_run(
+            &dir,
+            &[
+                "--resume",
+                progress_file.to_str().unwrap(),
+                "--format",
+                "json",
+            ],
+        )
+        .err()
+        .unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(
+            error.to_string(),
+            "--resume only supports the text and jsonl output formats"
+        );
+        assert!(!progress_file.exists());
+    }
+
+    #[test]
+    fn contents_are_normalized_before_they_are_written() {
+        let dir = temp_dir("normalize-unicode", &[("notes.md", "cafe\u{301}\n")]);
+        let (_, normalized) = run(&dir, &["--normalize-unicode", "NFC"]);
+        let (_, untouched) = run(&dir, &[]);
+        fs::remove_dir_all(&dir).unwrap();
+        assert!(normalized.contains("caf\u{e9}\n"));
+        assert!(untouched.contains("cafe\u{301}\n"));
+    }
+
+    #[test]
+    fn roots_walked_in_parallel_are_listed_as_if_walked_in_turn() {
+        let dir = temp_dir(
+            "parallel-roots",
+            &[
+                ("app/main.rs", "fn main() {}\n"),
+                ("app/src/lib.rs", "pub fn lib() {}\n"),
+                ("tools/gen.rs", "fn gen() {}\n"),
+            ],
+        );
+        let app = dir.join("app");
+        let src = app.join("src");
+        let tools = dir.join("tools");
+        let mut args = vec!["--sort", "path"];
+        for root in [&app, &src, &tools] {
+            args.extend(["-d", root.to_str().unwrap()]);
+        }
+        let (in_turn, in_turn_output) = run(&dir, &args);
+        args.extend(["--parallel-roots", "3"]);
+        let (parallel, parallel_output) = run(&dir, &args);
+        fs::remove_dir_all(&dir).unwrap();
+
+        // Every file is under more than one root but listed once
+        assert_eq!(in_turn.files_processed, 3);
+        assert_eq!(parallel.files_processed, 3);
+        assert_eq!(parallel_output, in_turn_output);
+    }
+
+    #[test]
+    fn trailing_blank_lines_are_stripped_from_each_file() {
+        let dir = temp_dir(
+            "strip-trailing-newlines",
+            &[("a.rs", "fn a() {}\n\n\n"), ("b.rs", "fn b() {}")],
+        );
+        let (_, stripped) = run(&dir, &["--strip-trailing-newlines-per-file"]);
+        let (_, kept) = run(&dir, &[]);
+        fs::remove_dir_all(&dir).unwrap();
+        assert!(stripped.contains("fn a() {}\n---"));
+        assert!(stripped.contains("fn b() {}\n---"));
+        assert!(kept.contains("fn a() {}\n\n\n---"));
+    }
+
+    #[test]
+    fn since_last_run_appends_only_new_and_modified_files() {
+        use std::time::{Duration, SystemTime};
+
+        let dir = temp_dir(
+            "since-last-run",
+            &[("a.rs", "fn a() {}\n"), ("b.rs", "fn b() {}\n")],
+        );
+        let cache_file = dir.with_extension("mtimes.json");
+        // run() removes the output, which would start every run afresh
+        let output_file = dir.with_extension("since.txt");
+        let combine = || {
+            let mut opt = Opt::from_iter([
+                "combiner",
+                "-d",
+                dir.to_str().unwrap(),
+                "--since-last-run",
+                cache_file.to_str().unwrap(),
+                "--prompt",
+                "Review",
+            ]);
+            let config = load_config(&mut opt).unwrap();
+            process_files(&opt, &output_file, &[], &config).unwrap()
+        };
+        let first = combine();
+        let unchanged = combine();
+
+        fs::write(dir.join("a.rs"), "fn a() { edited() }\n").unwrap();
+        File::options()
+            .write(true)
+            .open(dir.join("a.rs"))
+            .unwrap()
+            .set_modified(SystemTime::now() + Duration::from_secs(60))
+            .unwrap();
+        fs::write(dir.join("c.rs"), "fn c() {}\n").unwrap();
+        let changed = combine();
+        let output = fs::read_to_string(&output_file).unwrap();
+        fs::remove_file(&output_file).unwrap();
+        fs::remove_file(&cache_file).unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(first.files_unchanged, None);
+        assert_eq!(first.files_processed, 2);
+        assert_eq!(unchanged.files_unchanged, Some(2));
+        assert_eq!(unchanged.files_processed, 0);
+        assert_eq!(changed.files_unchanged, Some(1));
+        assert_eq!(changed.files_processed, 2);
+        // The edited file is appended after its earlier entry
+        assert_eq!(output.matches("Review").count(), 1);
+        assert_eq!(output.matches("fn b() {}").count(), 1);
+        assert_eq!(output.matches("fn c() {}").count(), 1);
+        assert!(output.find("fn a() {}").unwrap() < output.find("edited()").unwrap());
+    }
+
+    #[test]
+    fn paths_start_with_the_root_name_except_for_input_files() {
+        let dir = temp_dir("root-name", &[("src/main.rs", "fn main() {}\n")]);
+        let notes = temp_file("root-name-notes.md", "# Notes\n");
+        let root = dir.file_name().unwrap().to_str().unwrap().to_string();
+        let (_, output) = run(
+            &dir,
+            &["--include-root-name", "-d", notes.to_str().unwrap()],
+        );
+        fs::remove_dir_all(&dir).unwrap();
+        fs::remove_file(&notes).unwrap();
+        assert!(output.contains(&format!("File: \"{}/src/main.rs\"", root)));
+        assert!(output.contains(&format!("File: {:?}", notes.to_str().unwrap())));
+    }
+
+    #[test]
+    fn compacting_removes_blank_lines_and_counts_the_tokens_saved() {
+        let dir = temp_dir(
+            "compact",
+            &[("main.rs", "fn main() {\n\n    run();\n    \n}\n\n\n")],
+        );
+        let (compacted, output) = run(&dir, &["--compact"]);
+        let (plain, _) = run(&dir, &[]);
+        fs::remove_dir_all(&dir).unwrap();
+        assert!(output.contains("fn main() {\n    run();\n}\n"));
+        assert_eq!(plain.compact_tokens_saved, None);
+        let saved = compacted.compact_tokens_saved.unwrap();
+        assert_eq!(compacted.total_tokens + saved, plain.total_tokens);
+    }
+
+    #[test]
+    fn front_matter_describes_each_file_before_its_contents() {
+        let dir = temp_dir("front-matter", &[("src/main.rs", "fn main() {}\n")]);
+        let (yaml_result, yaml) = run(&dir, &["--front-matter", "yaml"]);
+        let (_, json) = run(&dir, &["--front-matter", "json"]);
+        let error = try_run(&dir, &["--front-matter", "yaml", "--format", "jsonl"])
+            .err()
+            .unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+
+        let tokens = yaml_result.file_stats[0].1;
+        assert!(yaml.contains(&format!(
+            "---\npath: \"src/main.rs\"\nsize: 13\ntokens: {}\nlanguage: \"Rust\"\n---\nfn main() {{}}\n",
+            tokens
+        )));
+        let line = json.lines().find(|line| line.starts_with('{')).unwrap();
+        let fields: serde_json::Value = serde_json::from_str(line).unwrap();
+        assert_eq!(fields["path"], "src/main.rs");
+        assert_eq!(fields["size"], 13);
+        assert_eq!(fields["tokens"], tokens);
+        assert_eq!(fields["language"], "Rust");
+        assert_eq!(
+            error.to_string(),
+            "--front-matter only applies to the text output format"
+        );
+    }
+
+    #[test]
+    fn proportional_truncation_keeps_the_same_share_of_every_file() {
+        let bpe = Tokenizer::Bpe(cl100k_base().unwrap());
+        let mut entries: Vec<FileEntry> =
+            ["one two three four\n".repeat(30), "five six\n".repeat(10)]
+                .iter()
+                .map(|content| FileEntry {
+                    tokens: bpe.count(content),
+                    ..entry("a.txt", content)
+                })
+                .collect();
+        let before: Vec<usize> = entries.iter().map(|entry| entry.tokens).collect();
+        let total: usize = before.iter().sum();
+
+        let (cut, removed) = truncate_proportionally(&mut entries, total / 2, &bpe);
+        assert_eq!(cut, 2);
+        let after: usize = entries.iter().map(|entry| entry.tokens).sum();
+        assert_eq!(after, total - removed);
+        assert!(after <= total / 2);
+        for (entry, before) in entries.iter().zip(before) {
+            assert!(entry.tokens <= before * (total / 2) / total);
+            assert!(entry.tokens > 0);
+            assert_eq!(bpe.count(&entry.content), entry.tokens);
+        }
+        assert!(entries[0].content.starts_with("one two three four\n"));
+
+        // Within the budget nothing is cut
+        assert_eq!(truncate_proportionally(&mut entries, total, &bpe), (0, 0));
+    }
+
+    #[test]
+    fn proportional_truncation_fits_the_files_into_max_tokens() {
+        let dir = temp_dir(
+            "proportional-truncate",
+            &[
+                ("a.rs", &"let a = 1;\n".repeat(40)),
+                ("b.rs", &"let b = 2;\n".repeat(20)),
+            ],
+        );
+        let (full, _) = run(&dir, &[]);
+        let budget = full.total_tokens / 2;
+        let budget_arg = budget.to_string();
+        let (cut, output) = run(
+            &dir,
+            &["--max-tokens", &budget_arg, "--proportional-truncate"],
+        );
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(full.files_cut_to_budget, None);
+        assert_eq!(cut.files_cut_to_budget, Some(2));
+        assert!(cut.total_tokens <= budget);
+        let file_tokens: usize = cut.file_stats.iter().map(|(_, tokens, _)| tokens).sum();
+        assert_eq!(file_tokens, cut.total_tokens);
+        assert!(output.contains("a.rs") && output.contains("b.rs"));
+    }
+
+    #[test]
+    fn skipped_files_are_listed_in_path_order_with_their_reason() {
+        let dir = temp_dir(
+            "list-skipped",
+            &[("main.rs", "fn main() {}\n"), ("notes.md", "# Notes\n")],
+        );
+        fs::write(dir.join("pixel.png"), PNG_BYTES).unwrap();
+        let args = ["--include", "*.rs", "--include", "*.png"];
+        let mut listed_args = args.to_vec();
+        listed_args.push("--list-skipped");
+        let (listed, _) = run(&dir, &listed_args);
+        let (unlisted, _) = run(&dir, &args);
+        fs::remove_dir_all(&dir).unwrap();
+
+        let skip_list: Vec<(&str, SkipReason)> = listed
+            .skip_list
+            .as_ref()
+            .unwrap()
+            .iter()
+            .map(|(path, reason)| {
+                let name = Path::new(path).file_name().unwrap().to_str().unwrap();
+                (name, *reason)
+            })
+            .collect();
+        assert_eq!(
+            skip_list,
+            [
+                ("notes.md", SkipReason::NotIncluded),
+                ("pixel.png", SkipReason::NonText)
+            ]
+        );
+        assert_eq!(unlisted.skip_list, None);
+        assert_eq!(unlisted.skip_counts, listed.skip_counts);
+    }
+
+    #[test]
+    fn also_output_writes_the_same_files_in_each_format() {
+        let dir = temp_dir(
+            "also-output",
+            &[("a.rs", "fn a() {}\n"), ("b.rs", "fn b() {}\n")],
+        );
+        let json_file = dir.with_extension("also.json");
+        let jsonl_file = dir.with_extension("also.jsonl");
+        let json_arg = format!("{}:json", json_file.display());
+        let jsonl_arg = format!("{}:jsonl", jsonl_file.display());
+        let (result, text) = run(
+            &dir,
+            &[
+                "--also-output",
+                &json_arg,
+                "--also-output",
+                &jsonl_arg,
+                "--separator",
+                "== {path} ==",
+            ],
+        );
+        let json = fs::read_to_string(&json_file).unwrap();
+        let jsonl = fs::read_to_string(&jsonl_file).unwrap();
+        let only_jsonl = try_run(&dir, &["--format", "jsonl", "--json-pretty"])
+            .err()
+            .unwrap();
+        fs::remove_file(&json_file).unwrap();
+        fs::remove_file(&jsonl_file).unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(result.also_outputs, [json_file, jsonl_file]);
+        // --separator applies to the text output only
+        assert!(text.contains("== a.rs ==\nfn a() {}\n"));
+        let document: serde_json::Value = serde_json::from_str(&json).unwrap();
+        assert_eq!(document["files"].as_array().unwrap().len(), 2);
+        assert_eq!(jsonl.lines().count(), 2);
+        assert!(!jsonl.contains("=="));
+        assert_eq!(
+            only_jsonl.to_string(),
+            "--json-pretty only applies to the json output format"
+        );
+    }
+
+    #[test]
+    fn test_file_patterns_cover_each_language() {
+        let patterns = test_file_patterns().unwrap();
+        for path in [
+            "pkg/foo_test.go",
+            "tests/test_foo.py",
+            "web/foo.test.ts",
+            "web/foo.spec.js",
+            "src/main/java/FooTest.java",
+            "spec/foo_spec.rb",
+        ] {
+            assert!(patterns.matches(Path::new(path)), "{} is a test file", path);
+        }
+        for path in ["pkg/foo.go", "src/testing.py", "web/foo.ts", "src/Foo.java"] {
+            assert!(
+                !patterns.matches(Path::new(path)),
+                "{} is not a test file",
+                path
+            );
+        }
+    }
+
+    #[test]
+    fn exclude_tests_skips_test_files_only_when_on() {
+        let dir = temp_dir(
+            "exclude-tests",
+            &[
+                ("app.py", "print('app')\n"),
+                ("test_app.py", "def test_app(): pass\n"),
+                ("web/app.spec.ts", "it('works', () => {});\n"),
+            ],
+        );
+        let (excluded, _) = run(&dir, &["--exclude-tests"]);
+        let (kept, _) = run(&dir, &[]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(excluded.files_processed, 1);
+        assert_eq!(excluded.skip_counts.get(&SkipReason::Test), Some(&2));
+        assert_eq!(kept.files_processed, 3);
+        assert_eq!(kept.skip_counts.get(&SkipReason::Test), None);
+    }
+
+    #[test]
+    fn files_left_out_by_patterns_are_not_counted_as_non_text() {
+        let mut files = MemoryFiles::new();
+        files.insert("LICENSE", "MIT\n");
+        files.insert("assets/logo.png", "\u{89}PNG\n");
+        let ignore_patterns = PatternSet::new(&["*.png".to_string()]).unwrap();
+        let include_patterns = PatternSet::new(&["*.png".to_string()]).unwrap();
+        let mut filters = Filters {
+            ignore_patterns: &ignore_patterns,
+            test_patterns: None,
+            include_patterns: None,
+            generated_markers: None,
+            exclude_lockfiles: false,
+            ignore_symlinks: false,
+            binary_limit: None,
+            excluded_content: None,
+            max_file_size: None,
+        };
+        assert_eq!(
+            skip_reason(&files, Path::new("assets/logo.png"), &filters),
+            Some(SkipReason::Ignored)
+        );
+        assert_eq!(
+            skip_reason(&files, Path::new("LICENSE"), &filters),
+            Some(SkipReason::NonText)
+        );
+        filters.include_patterns = Some(&include_patterns);
+        assert_eq!(
+            skip_reason(&files, Path::new("LICENSE"), &filters),
+            Some(SkipReason::NotIncluded)
+        );
+    }
+
+    #[test]
+    fn test_files_are_told_apart_before_the_extension_check() {
+        let mut files = MemoryFiles::new();
+        files.insert("pkg/foo_test.go", "package foo\n");
+        files.insert("pkg/logo_test.png", "\u{89}PNG\n");
+        let ignore_patterns = PatternSet::new(&[]).unwrap();
+        let test_patterns = test_file_patterns().unwrap();
+        let filters = Filters {
+            ignore_patterns: &ignore_patterns,
+            test_patterns: Some(&test_patterns),
+            include_patterns: None,
+            generated_markers: None,
+            exclude_lockfiles: false,
+            ignore_symlinks: false,
+            binary_limit: None,
+            excluded_content: None,
+            max_file_size: None,
+        };
+        assert_eq!(
+            skip_reason(&files, Path::new("pkg/foo_test.go"), &filters),
+            Some(SkipReason::Test)
+        );
+        assert_eq!(
+            skip_reason(&files, Path::new("pkg/logo_test.png"), &filters),
+            Some(SkipReason::NonText)
+        );
+    }
+
+    #[test]
+    fn source_files_of_common_languages_are_text() {
+        for name in [
+            "main.go",
+            "Main.java",
+            "Main.kt",
+            "app.rb",
+            "Program.cs",
+            "App.jsx",
+            "App.tsx",
+        ] {
+            assert!(is_text_file(Path::new(name)), "{} is a text file", name);
+        }
+        assert!(!is_text_file(Path::new("logo.png")));
+    }
+
+    #[test]
+    fn go_test_files_are_combined_unless_tests_are_excluded() {
+        let dir = temp_dir(
+            "go-tests",
+            &[
+                ("foo.go", "package foo\n"),
+                ("foo_test.go", "package foo\n"),
+            ],
+        );
+        let (excluded, _) = run(&dir, &["--exclude-tests"]);
+        let (kept, _) = run(&dir, &[]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(excluded.files_processed, 1);
+        assert_eq!(excluded.skip_counts.get(&SkipReason::Test), Some(&1));
+        assert_eq!(kept.files_processed, 2);
+        assert!(kept.skip_counts.is_empty());
+    }
+
+    #[test]
+    fn streamed_files_that_are_not_utf8_leave_nothing_behind() {
+        let dir = temp_dir(
+            "stream-rollback",
+            &[("a.rs", "fn a() {}\n"), ("c.rs", "fn c() {}\n")],
+        );
+        let (whole, whole_output) = run(&dir, &["--stream-threshold", "1KB"]);
+        let mut contents = large_contents().into_bytes();
+        contents.extend([0xff, b'\n']);
+        fs::write(dir.join("b.rs"), contents).unwrap();
+
+        let (streamed, streamed_output) = run(&dir, &["--stream-threshold", "1KB"]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(streamed_output, whole_output);
+        assert_eq!(streamed.total_tokens, whole.total_tokens);
+    }
+
+    #[test]
+    fn estimate_truncates_to_whole_tokens() {
+        let tokenizer = Tokenizer::Estimate;
+        assert_eq!(tokenizer.truncate("one two three four", 2), "one two");
+        assert_eq!(tokenizer.truncate("one two", 5), "one two");
+        assert_eq!(tokenizer.truncate("one two", 0), "");
+    }
+
+    #[test]
+    fn estimate_is_a_tokenization_method() {
+        let dir = temp_dir("estimate-method", &[("a.rs", "fn main() {}\n")]);
+        let (result, _) = run(
+            &dir,
+            &[
+                "--tokenization-method",
+                "estimate",
+                "--compare-tokenizers",
+                "estimate",
+            ],
+        );
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(result.total_tokens, estimate_tokens("fn main() {}\n"));
+    }
+
+    #[test]
+    fn content_is_matched_a_line_at_a_time() {
+        let mut source = MemoryFiles::new();
+        source.insert("a.txt", "fine\n// DO NOT COMMIT\nfine\n");
+        source.insert("b.txt", "DO NOT\nCOMMIT\n");
+        let regex = Regex::new("DO NOT COMMIT").unwrap();
+        assert!(has_matching_content(&source, Path::new("a.txt"), &regex));
+        assert!(!has_matching_content(&source, Path::new("b.txt"), &regex));
+        assert!(!has_matching_content(
+            &source,
+            Path::new("missing.txt"),
+            &regex
+        ));
+    }
+
+    struct Tagged;
+
+    impl Formatter for Tagged {
+        fn write_file(&self, output: &mut dyn Write, file: &FormattedFile) -> Result<()> {
+            writeln!(output, "<{}>", file.path)?;
+            Ok(())
+        }
+
+        fn write_footer(&self, output: &mut dyn Write) -> Result<()> {
+            output.write_all(b"</files>")?;
+            Ok(())
+        }
+    }
+
+    fn layout(format: OutputFormat, custom: Option<Arc<dyn Formatter>>) -> Layout {
+        Layout {
+            format,
+            custom,
+            separator: None,
+            file_separator: String::new(),
+            front_matter: None,
+            json_pretty: false,
+            git_ref: None,
+            empty_dirs: None,
+            trailing_newline: false,
+            write_buffer_size: 64,
+        }
+    }
+
+    fn finished_bytes(
+        name: &str,
+        format: OutputFormat,
+        custom: Option<Arc<dyn Formatter>>,
+        body: &str,
+    ) -> Vec<u8> {
+        let layout = layout(format, custom);
+        let path =
+            std::env::temp_dir().join(format!("combiner-finish-{}-{}", std::process::id(), name));
+        let mut output = BufWriter::new(create_output(&path).unwrap());
+        output.write_all(body.as_bytes()).unwrap();
+        layout.finish(output).unwrap();
+        let bytes = fs::read(&path).unwrap();
+        fs::remove_file(&path).unwrap();
+        bytes
+    }
+
+    #[test]
+    fn no_trailing_newline_removes_only_a_newline() {
+        assert_eq!(
+            finished_bytes("text", OutputFormat::Text, None, "a\n"),
+            b"a"
+        );
+        assert_eq!(
+            finished_bytes(
+                "tagged",
+                OutputFormat::Custom("tagged"),
+                Some(Arc::new(Tagged)),
+                "<a>\n"
+            ),
+            b"<a>\n</files>"
+        );
+    }
+
+    #[test]
+    fn jsonl_entries_give_metadata_as_fields() {
+        let entry = FileEntry {
+            path: "src/main.rs".to_string(),
+            metadata: Some(FileMetadata {
+                mode: "644".to_string(),
+                mod_time: Some("2024-01-02T03:04:05+00:00".to_string()),
+            }),
+            encoding: None,
+            content: "fn main() {}\n".to_string(),
+            tokens: 5,
+            size: 13,
+            position: 0,
+        };
+        let mut written = Vec::new();
+        layout(OutputFormat::Jsonl, None)
+            .write_entry(&mut written, &entry, 1)
+            .unwrap();
+        let written: serde_json::Value = serde_json::from_slice(&written).unwrap();
+        assert_eq!(written["mode"], "644");
+        assert_eq!(written["mod_time"], "2024-01-02T03:04:05+00:00");
+        // Streamed entries are written by hand, in the same shape as serde's
+        assert_eq!(written, serde_json::to_value(&entry).unwrap());
+    }
+
+    #[test]
+    fn a_tokenizer_that_fails_to_load_suggests_the_estimate() {
+        let tokenizers = Mutex::new(BTreeMap::new());
+        let error = load_tokenizer(&tokenizers, &TokenizationMethod::O200kBase, |_| {
+            bail!("encoding data not found")
+        })
+        .err()
+        .unwrap();
+        let message = format!("{:#}", error);
+        assert!(message.contains("o200k_base"), "{}", message);
+        assert!(
+            message.contains("--tokenization-method estimate"),
+            "{}",
+            message
+        );
+        assert!(message.contains("encoding data not found"), "{}", message);
+
+        // The next caller tries again
+        let loaded = load_tokenizer(&tokenizers, &TokenizationMethod::O200kBase, |_| {
+            Ok(Tokenizer::Estimate)
+        });
+        assert!(loaded.is_ok());
+    }
+
+    #[test]
+    fn concurrent_callers_load_each_tokenizer_once() {
+        let tokenizers = Mutex::new(BTreeMap::new());
+        let loads = AtomicUsize::new(0);
+        let load = |_: &TokenizationMethod| {
+            loads.fetch_add(1, Ordering::Relaxed);
+            std::thread::sleep(Duration::from_millis(20));
+            Ok(Tokenizer::Estimate)
+        };
+        let loaded: Vec<Arc<Tokenizer>> = std::thread::scope(|scope| {
+            let threads: Vec<_> = (0..4)
+                .map(|_| {
+                    scope.spawn(|| {
+                        load_tokenizer(&tokenizers, &TokenizationMethod::Cl100kBase, load).unwrap()
+                    })
+                })
+                .collect();
+            threads
+                .into_iter()
+                .map(|thread| thread.join().unwrap())
+                .collect()
+        });
+        assert_eq!(loads.load(Ordering::Relaxed), 1);
+        assert!(loaded.iter().all(|bpe| Arc::ptr_eq(bpe, &loaded[0])));
+
+        load_tokenizer(&tokenizers, &TokenizationMethod::P50kBase, load).unwrap();
+        assert_eq!(loads.load(Ordering::Relaxed), 2);
+    }
+
+    #[test]
+    fn a_tokenizer_that_panics_while_loading_poisons_nothing() {
+        let tokenizers = Mutex::new(BTreeMap::new());
+        let panicked = std::panic::catch_unwind(|| {
+            load_tokenizer(&tokenizers, &TokenizationMethod::R50kBase, |_| {
+                panic!("corrupt encoding data")
+            })
+        });
+        assert!(panicked.is_err());
+
+        let loaded = load_tokenizer(&tokenizers, &TokenizationMethod::R50kBase, |_| {
+            Ok(Tokenizer::Estimate)
+        });
+        assert!(loaded.is_ok());
+    }
+
+    #[test]
+    fn also_outputs_keep_the_options_of_their_own_format() {
+        let dir = temp_dir("also-output-options", &[("a.rs", "fn a() {}\n")]);
+        let json_file = dir.with_extension("also.json");
+        let text_file = dir.with_extension("also.txt");
+        let json_arg = format!("{}:json", json_file.display());
+        let text_arg = format!("{}:text", text_file.display());
+
+        // A text output with a pretty json one
+        let (_, text) = run(&dir, &["--also-output", &json_arg, "--json-pretty"]);
+        let json = fs::read_to_string(&json_file).unwrap();
+        // A json output with a text one that has a separator
+        let (_, main_json) = run(
+            &dir,
+            &[
+                "--format",
+                "json",
+                "--also-output",
+                &text_arg,
+                "--separator",
+                "== {path} ==",
+            ],
+        );
+        let also_text = fs::read_to_string(&text_file).unwrap();
+        fs::remove_file(&json_file).unwrap();
+        fs::remove_file(&text_file).unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert!(!text.contains("{\n"));
+        assert!(json.starts_with("{\n  \"schema_version\""), "{}", json);
+        assert!(!main_json.contains("=="));
+        assert!(
+            also_text.contains("== a.rs ==\nfn a() {}\n"),
+            "{}",
+            also_text
+        );
+    }
+
+    #[test]
+    fn streamed_lines_longer_than_a_piece_are_wrapped_whole() {
+        let contents = format!("{}\n", "word ".repeat(STREAM_CHUNK_SIZE / 4)).repeat(2);
+        let dir = temp_dir("stream-long-lines", &[("big.txt", &contents)]);
+
+        let (whole, whole_output) = run(&dir, &["--wrap", "100"]);
+        let (streamed, streamed_output) =
+            run(&dir, &["--wrap", "100", "--stream-threshold", "1KB"]);
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert!(streamed_output == whole_output);
+        assert_eq!(streamed.total_tokens, whole.total_tokens);
+    }
+
+    #[test]
+    fn separators_appended_by_a_later_run_are_counted_in_it() {
+        use std::time::{Duration, SystemTime};
+
+        let dir = temp_dir(
+            "since-last-run-separators",
+            &[("a.rs", "fn a() {}\n"), ("b.rs", "fn b() {}\n")],
+        );
+        let cache_file = dir.with_extension("mtimes.json");
+        let output_file = dir.with_extension("since.txt");
+        let combine = || {
+            let mut opt = Opt::from_iter([
+                "combiner",
+                "-d",
+                dir.to_str().unwrap(),
+                "--since-last-run",
+                cache_file.to_str().unwrap(),
+                "--file-separator",
+                "\n=====\n",
+            ]);
+            let config = load_config(&mut opt).unwrap();
+            process_files(&opt, &output_file, &[], &config).unwrap()
+        };
+        let first = combine();
+        File::options()
+            .write(true)
+            .open(dir.join("a.rs"))
+            .unwrap()
+            .set_modified(SystemTime::now() + Duration::from_secs(60))
+            .unwrap();
+        fs::write(dir.join("c.rs"), "fn c() {}\n").unwrap();
+        let changed = combine();
+        let output = fs::read_to_string(&output_file).unwrap();
+        fs::remove_file(&output_file).unwrap();
+        fs::remove_file(&cache_file).unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+
+        let separator_tokens = get_tokenizer(&DEFAULT_TOKENIZATION_METHOD)
+            .unwrap()
+            .count("\n=====\n");
+        // One between the first run's files, then one before each file
+        // appended after them
+        assert_eq!(output.matches("\n=====\n").count(), 3);
+        assert_eq!(first.separator_tokens, Some(separator_tokens));
+        assert_eq!(changed.separator_tokens, Some(2 * separator_tokens));
+    }
+
+    #[test]
+    fn a_thread_pool_has_the_requested_size() {
+        assert_eq!(thread_pool(Some(3), 1).unwrap().current_num_threads(), 3);
+        assert_eq!(
+            thread_pool(Some(2), IO_THREADS_PER_CPU)
+                .unwrap()
+                .current_num_threads(),
+            2
+        );
+    }
+
+    #[test]
+    fn a_thread_pool_defaults_to_a_share_of_each_cpu() {
+        let cpus = std::thread::available_parallelism().unwrap().get();
+        assert_eq!(thread_pool(None, 1).unwrap().current_num_threads(), cpus);
+        assert_eq!(
+            thread_pool(None, IO_THREADS_PER_CPU)
+                .unwrap()
+                .current_num_threads(),
+            cpus * IO_THREADS_PER_CPU
+        );
+    }
+}
@@ -0,0 +1,104 @@
+use anyhow::Result;
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::fmt;
+use std::io::Write;
+use std::sync::{Arc, RwLock};
+
+// A custom output format, selected with --format by the name it is
+// registered under. Each output file (each chunk with --split-tokens) gets a
+// header, one write_file call per file in output order, and a footer.
+pub trait Formatter: Send + Sync {
+    fn write_header(&self, output: &mut dyn Write, header: &Header) -> Result<()> {
+        if let Some(prompt) = header.prompt {
+            output.write_all(prompt.as_bytes())?;
+        }
+        Ok(())
+    }
+
+    fn write_file(&self, output: &mut dyn Write, file: &FormattedFile) -> Result<()>;
+
+    fn write_footer(&self, _output: &mut dyn Write) -> Result<()> {
+        Ok(())
+    }
+
+    // Used for the default output file name
+    fn extension(&self) -> &'static str {
+        "txt"
+    }
+}
+
+// What comes before the first file
+pub struct Header<'a> {
+    pub prompt: Option<&'a str>,
+    // The commit and branch, with --git-ref-header
+    pub git_revision: Option<String>,
+    // With --note-empty-dirs
+    pub empty_dirs: Option<&'a [String]>,
+}
+
+pub struct FormattedFile<'a> {
+    pub path: &'a str,
+    // Permissions and modification time, with --include-metadata
+    pub metadata: Option<&'a FileMetadata>,
+    // The encoding the contents were converted from, if not UTF-8
+    pub encoding: Option<&'a str>,
+    pub contents: &'a str,
+    pub tokens: usize,
+    // 1-based position in the output
+    pub index: usize,
+}
+
+// A file's permissions and modification time, for --include-metadata
+#[derive(Clone, Debug, Serialize)]
+pub struct FileMetadata {
+    // The permission bits in octal (e.g. "644"), or "read-only" or
+    // "read-write" on platforms without them
+    pub mode: String,
+    // RFC 3339, in local time; None where the platform does not record it
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub mod_time: Option<String>,
+}
+
+// The line written below a file's header in the text format
+impl fmt::Display for FileMetadata {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(
+            f,
+            "Mode: {}, Modified: {}",
+            self.mode,
+            self.mod_time.as_deref().unwrap_or("unknown")
+        )
+    }
+}
+
+static FORMATTERS: RwLock<BTreeMap<&'static str, Arc<dyn Formatter>>> =
+    RwLock::new(BTreeMap::new());
+
+// Makes a formatter available to --format. Formatters must be registered
+// before the options are parsed, and the built-in `text`, `json` and `jsonl`
+// names cannot be taken over. Registering a name again replaces its formatter.
+pub fn register_formatter(name: &'static str, formatter: impl Formatter + 'static) {
+    FORMATTERS
+        .write()
+        .unwrap()
+        .insert(name, Arc::new(formatter));
+}
+
+pub fn formatter(name: &str) -> Option<Arc<dyn Formatter>> {
+    FORMATTERS.read().unwrap().get(name).cloned()
+}
+
+// The registered name matching `name`, ignoring case like the built-in names
+pub fn formatter_name(name: &str) -> Option<&'static str> {
+    FORMATTERS
+        .read()
+        .unwrap()
+        .keys()
+        .find(|registered| registered.eq_ignore_ascii_case(name))
+        .copied()
+}
+
+pub fn formatter_names() -> Vec<&'static str> {
+    FORMATTERS.read().unwrap().keys().copied().collect()
+}
@@ -0,0 +1,104 @@
+use std::path::Path;
+use std::process::Command;
+
+// The revision a directory is checked out at
+#[derive(Clone)]
+pub struct GitRef {
+    pub commit: String,
+    // None for a detached HEAD
+    pub branch: Option<String>,
+}
+
+impl GitRef {
+    pub fn describe(&self) -> String {
+        match &self.branch {
+            Some(branch) => format!("{} ({})", self.commit, branch),
+            None => self.commit.clone(),
+        }
+    }
+}
+
+// Reads the current commit and branch with `git rev-parse`. Returns None when
+// `dir` is not inside a git repository or git is not installed.
+pub fn current_ref(dir: &Path) -> Option<GitRef> {
+    let commit = rev_parse(dir, &["HEAD"])?;
+    let branch = rev_parse(dir, &["--abbrev-ref", "HEAD"]).filter(|branch| branch != "HEAD");
+    Some(GitRef { commit, branch })
+}
+
+fn rev_parse(dir: &Path, args: &[&str]) -> Option<String> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(dir)
+        .arg("rev-parse")
+        .args(args)
+        .output()
+        .ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    Some(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn git(dir: &Path, args: &[&str]) -> String {
+        let output = Command::new("git")
+            .arg("-C")
+            .arg(dir)
+            .args(["-c", "user.name=Test", "-c", "user.email=test@example.com"])
+            .args(args)
+            .output()
+            .unwrap();
+        assert!(output.status.success(), "git {:?} failed", args);
+        String::from_utf8_lossy(&output.stdout).trim().to_string()
+    }
+
+    // A fresh repository with a single commit on `main`
+    fn temp_repo(name: &str) -> std::path::PathBuf {
+        let dir =
+            std::env::temp_dir().join(format!("combiner-git-{}-{}", std::process::id(), name));
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(&dir).unwrap();
+        git(&dir, &["init", "-q", "-b", "main"]);
+        std::fs::write(dir.join("main.rs"), "fn main() {}\n").unwrap();
+        git(&dir, &["add", "main.rs"]);
+        git(&dir, &["commit", "-q", "-m", "Initial commit"]);
+        dir
+    }
+
+    #[test]
+    fn reads_the_commit_and_branch_of_a_repository() {
+        let dir = temp_repo("branch");
+        let commit = git(&dir, &["rev-parse", "HEAD"]);
+
+        let git_ref = current_ref(&dir).unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(git_ref.commit, commit);
+        assert_eq!(git_ref.branch.as_deref(), Some("main"));
+        assert_eq!(git_ref.describe(), format!("{} (main)", commit));
+    }
+
+    #[test]
+    fn a_detached_head_has_no_branch() {
+        let dir = temp_repo("detached");
+        git(&dir, &["checkout", "-q", "--detach"]);
+
+        let git_ref = current_ref(&dir).unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(git_ref.branch, None);
+        assert_eq!(git_ref.describe(), git_ref.commit);
+    }
+
+    #[test]
+    fn a_directory_outside_a_repository_has_no_ref() {
+        let dir = std::env::temp_dir().join(format!("combiner-git-{}-none", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+
+        let git_ref = current_ref(&dir);
+        std::fs::remove_dir_all(&dir).unwrap();
+        assert!(git_ref.is_none());
+    }
+}
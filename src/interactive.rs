@@ -0,0 +1,64 @@
+use anyhow::Result;
+use std::io::{self, BufRead, Write};
+use std::path::Path;
+
+#[cfg(feature = "interactive")]
+pub fn prompt_selection(paths: &[&Path], defaults: &[bool]) -> Result<Vec<bool>> {
+    let items: Vec<String> = paths
+        .iter()
+        .map(|path| path.to_string_lossy().into_owned())
+        .collect();
+
+    let chosen = dialoguer::MultiSelect::new()
+        .with_prompt("Select files to combine (space to toggle, enter to confirm)")
+        .items(&items)
+        .defaults(defaults)
+        .interact()?;
+
+    Ok(chosen_selection(&chosen, paths.len()))
+}
+
+// Turns the indices of the items picked in the prompt into whether each of
+// `len` paths is kept
+#[cfg(any(feature = "interactive", test))]
+fn chosen_selection(chosen: &[usize], len: usize) -> Vec<bool> {
+    let mut selection = vec![false; len];
+    for &index in chosen {
+        selection[index] = true;
+    }
+    selection
+}
+
+#[cfg(not(feature = "interactive"))]
+pub fn prompt_selection(_paths: &[&Path], _defaults: &[bool]) -> Result<Vec<bool>> {
+    anyhow::bail!("Interactive mode is unavailable: rebuild combiner with `--features interactive`")
+}
+
+// Asks on the terminal whether to go ahead and write a large output file.
+pub fn confirm_output_size(estimated_size: u64) -> Result<bool> {
+    print!(
+        "Estimated output size is {:.2} MB. Write it anyway? [y/N] ",
+        estimated_size as f64 / 1_048_576.0
+    );
+    io::stdout().flush()?;
+
+    let mut answer = String::new();
+    io::stdin().lock().read_line(&mut answer)?;
+    Ok(matches!(answer.trim().to_lowercase().as_str(), "y" | "yes"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn chosen_items_keep_their_paths() {
+        assert_eq!(chosen_selection(&[2, 0], 4), vec![true, false, true, false]);
+    }
+
+    #[test]
+    fn choosing_nothing_keeps_no_path() {
+        assert_eq!(chosen_selection(&[], 3), vec![false; 3]);
+        assert!(chosen_selection(&[], 0).is_empty());
+    }
+}
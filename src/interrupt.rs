@@ -0,0 +1,22 @@
+use anyhow::Result;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+pub const EXIT_INTERRUPTED: i32 = 130;
+
+static INTERRUPTED: AtomicBool = AtomicBool::new(false);
+
+// Installs a Ctrl-C handler that stops the run early: files not yet started
+// are skipped and what was collected so far is still written. A second Ctrl-C
+// exits immediately.
+pub fn install_handler() -> Result<()> {
+    ctrlc::set_handler(|| {
+        if INTERRUPTED.swap(true, Ordering::SeqCst) {
+            std::process::exit(EXIT_INTERRUPTED);
+        }
+    })?;
+    Ok(())
+}
+
+pub fn interrupted() -> bool {
+    INTERRUPTED.load(Ordering::SeqCst)
+}
@@ -0,0 +1,257 @@
+use anyhow::{Context, Result};
+use std::io::Read;
+use std::path::PathBuf;
+use std::time::{Duration, Instant};
+
+pub mod analysis;
+pub mod baseline;
+pub mod config;
+pub mod encoding;
+pub mod estimate;
+pub mod file_processing;
+pub mod formatter;
+pub mod git;
+pub mod interactive;
+pub mod interrupt;
+pub mod manifest;
+pub mod mtime_cache;
+pub mod output;
+pub mod paths;
+pub mod patterns;
+pub mod profile;
+pub mod redact;
+pub mod report;
+pub mod resume;
+pub mod sort;
+pub mod source;
+pub mod split;
+pub mod stamp;
+pub mod stats;
+pub mod transform;
+
+use config::{
+    determine_output_file, load_config, load_pattern_file, merge_patterns, print_verbose_info,
+    split_root_depths, validate_input_path, Config, Opt, TokenizationMethod,
+    DEFAULT_TOKENIZATION_METHOD,
+};
+use file_processing::{process_files, process_files_from, ProcessingResult};
+use source::{GitTrackedFiles, MemoryFiles};
+
+pub const DEFAULT_OUTPUT_PREFIX: &str = "combiner_";
+
+// The version of the layout of the json output format and --output-stats-only
+// files, written as their `schema_version`. Bumped whenever a field is
+// removed or renamed or changes meaning; adding a field does not bump it.
+pub const SCHEMA_VERSION: u32 = 2;
+
+pub struct Combined {
+    pub result: ProcessingResult,
+    pub config: Config,
+    pub output_file: PathBuf,
+    pub ignore_patterns: Vec<String>,
+    pub processing_time: Duration,
+    pub unchanged: bool,
+}
+
+impl Combined {
+    pub fn tokenization_method(&self) -> &TokenizationMethod {
+        self.config
+            .tokenization_method
+            .as_ref()
+            .unwrap_or(&DEFAULT_TOKENIZATION_METHOD)
+    }
+}
+
+// Runs the whole pipeline: loads configuration, walks the input directory,
+// and writes the combined output. `opt` is updated with the resolved config
+// and output file paths.
+pub fn combine(opt: &mut Opt) -> Result<Combined> {
+    let start_time = Instant::now();
+
+    // Fail fast on a mistyped input path
+    split_root_depths(opt)?;
+    for input in &opt.input_dirs {
+        validate_input_path(input)?;
+    }
+
+    // Load configuration
+    let config = load_config(opt)?;
+    let mut user_patterns = merge_patterns(&opt.ignore_patterns, &config.ignore_patterns);
+    for ignore_file in &opt.ignore_from {
+        user_patterns.extend(load_pattern_file(ignore_file)?);
+    }
+
+    // 'target' and the git directory are ignored by default, ahead of the
+    // user's patterns so that a `!` pattern can re-include files in them
+    let mut ignore_patterns: Vec<String> = ["target", ".git"]
+        .into_iter()
+        .filter(|default| !user_patterns.iter().any(|pattern| pattern == default))
+        .map(String::from)
+        .collect();
+    let defaults = ignore_patterns.len();
+    ignore_patterns.extend(user_patterns);
+    let user_patterns_end = ignore_patterns.len();
+
+    // Determine output file
+    let output_file = determine_output_file(opt, &config)?;
+
+    // The files combiner writes or reads itself come after the user's
+    // patterns, so that no `!` pattern can combine the output into itself
+    ignore_patterns.push(output_file.to_string_lossy().into_owned());
+    if opt.split_tokens.is_some() {
+        ignore_patterns.push(split::chunk_glob(&output_file));
+        ignore_patterns.push(
+            split::chunk_manifest_path(&output_file)
+                .to_string_lossy()
+                .into_owned(),
+        );
+    }
+    for also_output in &opt.also_output {
+        ignore_patterns.push(also_output.path.to_string_lossy().into_owned());
+    }
+    if let Some(config_file) = &opt.config_file {
+        ignore_patterns.push(config_file.to_string_lossy().into_owned());
+    }
+    if let Some(manifest_file) = &opt.manifest {
+        ignore_patterns.push(manifest_file.to_string_lossy().into_owned());
+    }
+    if let Some(progress_file) = &opt.resume {
+        ignore_patterns.push(progress_file.to_string_lossy().into_owned());
+    }
+    if let Some(cache_file) = &opt.since_last_run {
+        ignore_patterns.push(cache_file.to_string_lossy().into_owned());
+    }
+    if let Some(baseline_file) = &opt.baseline {
+        ignore_patterns.push(baseline_file.to_string_lossy().into_owned());
+    }
+    if let Some(report_file) = &opt.report {
+        ignore_patterns.push(report_file.to_string_lossy().into_owned());
+    }
+    if let Some(stats_file) = &opt.output_stats_only {
+        ignore_patterns.push(stats_file.to_string_lossy().into_owned());
+    }
+    for ignore_file in &opt.ignore_from {
+        ignore_patterns.push(ignore_file.to_string_lossy().into_owned());
+    }
+    if let Some(mirror_dir) = &opt.mirror_to {
+        ignore_patterns.push(mirror_dir.to_string_lossy().into_owned());
+    }
+
+    // Print verbose information if enabled
+    print_verbose_info(opt, &output_file, &ignore_patterns, &config);
+
+    // Process files
+    let written_file = if opt.skip_unchanged {
+        stamp::staging_path(&output_file)
+    } else {
+        output_file.clone()
+    };
+    let mut result = if opt.stdin {
+        process_stdin(
+            std::io::stdin(),
+            opt,
+            &written_file,
+            &ignore_patterns,
+            &config,
+        )?
+    } else if opt.git_tracked {
+        let files = GitTrackedFiles::open(&opt.input_dirs)?;
+        process_files_from(&files, opt, &written_file, &ignore_patterns, &config)?
+    } else {
+        process_files(opt, &written_file, &ignore_patterns, &config)?
+    };
+    if let Some(unused) = &mut result.unused_ignores {
+        let own_patterns: Vec<&String> = ignore_patterns[..defaults]
+            .iter()
+            .chain(&ignore_patterns[user_patterns_end..])
+            .collect();
+        unused.retain(|pattern| !own_patterns.contains(&pattern));
+    }
+
+    // Stamp the output with its hash. A partial output from an interrupted
+    // run is not stamped, and with --skip-unchanged it stays at the staging path.
+    let unchanged = if result.interrupted {
+        false
+    } else if opt.stamp || opt.skip_unchanged {
+        stamp::finalize(&output_file, &written_file, opt.skip_unchanged)?
+    } else {
+        false
+    };
+    let output_file = if result.interrupted {
+        written_file
+    } else {
+        output_file
+    };
+
+    Ok(Combined {
+        result,
+        config,
+        output_file,
+        ignore_patterns,
+        processing_time: start_time.elapsed(),
+        unchanged,
+    })
+}
+
+// Combines `stdin` as a single file named by --stdin-name. The configuration
+// is still found in the input directory.
+fn process_stdin(
+    mut stdin: impl Read,
+    opt: &mut Opt,
+    output_file: &std::path::Path,
+    ignore_patterns: &[String],
+    config: &Config,
+) -> Result<ProcessingResult> {
+    let mut contents = Vec::new();
+    stdin
+        .read_to_end(&mut contents)
+        .context("Failed to read stdin")?;
+    let mut files = MemoryFiles::new();
+    files.insert(opt.stdin_name.clone(), contents);
+
+    // The pseudo-file is the only input while it is combined, so it skips
+    // every filter. The input directories are put back afterwards.
+    let input_dirs = std::mem::replace(&mut opt.input_dirs, vec![opt.stdin_name.clone()]);
+    let result = process_files_from(&files, opt, output_file, ignore_patterns, config);
+    opt.input_dirs = input_dirs;
+    result
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+    use structopt::StructOpt;
+
+    #[test]
+    fn stdin_is_combined_without_replacing_the_input_directories() {
+        let dir = std::env::temp_dir().join(format!("combiner-lib-stdin-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let output_file = dir.join("out.txt");
+        let mut opt = Opt::from_iter([
+            "combiner",
+            "-d",
+            dir.to_str().unwrap(),
+            "--stdin",
+            "--stdin-name",
+            "notes.txt",
+        ]);
+
+        let result = process_stdin(
+            "the quick brown fox".as_bytes(),
+            &mut opt,
+            &output_file,
+            &[],
+            &Config::default(),
+        )
+        .unwrap();
+        let written = fs::read_to_string(&output_file).unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(opt.input_dirs, vec![dir]);
+        assert_eq!(result.files_processed, 1);
+        assert_eq!(result.file_stats[0].0, "notes.txt");
+        assert!(result.file_stats[0].1 > 0);
+        assert!(written.contains("the quick brown fox"), "{}", written);
+    }
+}
@@ -1,71 +1,164 @@
 use anyhow::Result;
-use std::time::Instant;
 use structopt::StructOpt;
 
-mod config;
-mod file_processing;
-mod output;
-
-use config::{determine_output_file, load_config, merge_ignore_patterns, print_verbose_info, Opt};
-use file_processing::process_files;
-use output::{print_skipped_files, print_table};
-
-const DEFAULT_OUTPUT_PREFIX: &str = "combiner_";
+use combiner::baseline::{Baseline, EXIT_BASELINE_EXCEEDED};
+use combiner::combine;
+use combiner::config::{Opt, EXIT_TOKENS_OUT_OF_RANGE};
+use combiner::file_processing::EXIT_SKIPPED;
+use combiner::interrupt::{install_handler, EXIT_INTERRUPTED};
+use combiner::manifest::{compare, Manifest};
+use combiner::output::{
+    init_color, print_baseline_exceeded, print_manifest_diff, print_mixed_line_endings,
+    print_skip_list, print_skipped_files, print_table, print_token_histogram,
+    print_token_range_error, print_token_tree, print_tokenizers, print_truncation_warning,
+    print_unexpected_skips, print_unused_ignores,
+};
+use combiner::profile::Profiler;
+use combiner::report::write_markdown_report;
+use combiner::stamp::EXIT_UNCHANGED;
+use combiner::stats::Stats;
+
+// Lets --mem-profile track allocations
+#[cfg(feature = "profiling")]
+#[global_allocator]
+static ALLOC: dhat::Alloc = dhat::Alloc;
 
 fn main() -> Result<()> {
-    let start_time = Instant::now();
     let mut opt = Opt::from_args();
+    init_color(opt.no_color);
 
-    // Load configuration
-    let config = load_config(&mut opt)?;
-    let mut ignore_patterns = merge_ignore_patterns(&opt.ignore_patterns, &config.ignore_patterns);
-
-    // Ensure 'target' is in ignore patterns
-    if !ignore_patterns.contains(&"target".to_string()) {
-        ignore_patterns.push("target".to_string());
+    if opt.list_tokenizers {
+        print_tokenizers();
+        return Ok(());
     }
+    install_handler()?;
 
-    // Determine output file
-    let output_file = determine_output_file(&mut opt, &config)?;
+    // Profiles are written even when the run fails, so `run` returns the exit
+    // code instead of exiting itself
+    let profiler = Profiler::start(opt.cpu_profile.as_deref(), opt.mem_profile.as_deref())?;
+    let exit_code = run(&mut opt);
+    profiler.finish()?;
 
-    // Add output and config files to ignore patterns
-    ignore_patterns.push(output_file.to_string_lossy().into_owned());
-    if let Some(config_file) = &opt.config_file {
-        ignore_patterns.push(config_file.to_string_lossy().into_owned());
+    match exit_code? {
+        0 => Ok(()),
+        code => std::process::exit(code),
     }
+}
 
-    // Print verbose information if enabled
-    print_verbose_info(&opt, &output_file, &ignore_patterns, &config);
-
-    // Process files
-    let (files_processed, total_tokens, file_stats, skipped_files) =
-        process_files(&opt, &output_file, &ignore_patterns, &config)?;
-
-    let processing_time = start_time.elapsed();
-
-    // Calculate files failed and ignored
-    let files_failed = skipped_files.len();
-    let total_files = files_processed + files_failed + ignore_patterns.len();
-    let files_ignored = total_files - files_processed - files_failed;
+fn run(opt: &mut Opt) -> Result<i32> {
+    let combined = combine(opt)?;
+    let result = &combined.result;
+    let tokenization_method = combined.tokenization_method();
 
     // Print results
     print_table(
-        files_processed,
-        total_tokens,
-        &output_file,
-        &file_stats,
-        processing_time,
-        config
-            .tokenization_method
-            .as_ref()
-            .unwrap_or(&opt.tokenization_method),
-        files_failed,
-        files_ignored,
+        result,
+        &combined.output_file,
+        combined.processing_time,
+        tokenization_method,
     );
 
+    if opt.dry_run {
+        print_token_tree(result);
+    }
+
+    if opt.histogram {
+        print_token_histogram(result, &opt.histogram_buckets);
+    }
+
     // Print skipped files
-    print_skipped_files(&skipped_files);
+    print_skipped_files(&result.skipped_files);
+    print_skip_list(result);
+    print_truncation_warning(result.files_processed, result.files_truncated);
+    print_mixed_line_endings(result);
+    if let Some(unused_ignores) = &result.unused_ignores {
+        print_unused_ignores(unused_ignores);
+    }
 
-    Ok(())
-}
+    // Write Markdown report
+    if let Some(report_file) = &opt.report {
+        write_markdown_report(
+            report_file,
+            result,
+            &combined.output_file,
+            combined.processing_time,
+            tokenization_method,
+        )?;
+    }
 
+    // Record and compare manifests
+    if opt.manifest.is_some() || opt.compare.is_some() {
+        let manifest = Manifest::from_stats(result.total_tokens, &result.file_stats);
+        if let Some(previous_file) = &opt.compare {
+            let previous = Manifest::load(previous_file)?;
+            print_manifest_diff(&compare(&previous, &manifest));
+        }
+        // A partial run would make the next comparison misleading
+        if let (Some(manifest_file), false) = (&opt.manifest, result.interrupted) {
+            manifest.save(manifest_file)?;
+        }
+    }
+
+    // Like the manifest, statistics of a partial run are not saved
+    if let (Some(stats_file), false) = (&opt.output_stats_only, result.interrupted) {
+        Stats::from_result(result, combined.processing_time, tokenization_method)
+            .save(stats_file)?;
+    }
+
+    if result.interrupted {
+        if result.output_discarded {
+            println!("\nInterrupted after {} files.", result.files_processed);
+        } else {
+            println!(
+                "\nInterrupted: wrote the {} files combined so far to {:?}.",
+                result.files_processed, combined.output_file
+            );
+        }
+        return Ok(EXIT_INTERRUPTED);
+    }
+
+    if opt.fail_on_skip && result.unexpected_skips() > 0 {
+        print_unexpected_skips(result);
+        return Ok(EXIT_SKIPPED);
+    }
+
+    if let Some(range) = &opt.expect_tokens {
+        if !range.contains(result.total_tokens) {
+            print_token_range_error(result.total_tokens, range);
+            return Ok(EXIT_TOKENS_OUT_OF_RANGE);
+        }
+    }
+
+    // The baseline is only updated once the run has passed every check
+    if let Some(baseline_file) = &opt.baseline {
+        match Baseline::load(baseline_file)? {
+            Some(baseline)
+                if baseline.is_exceeded_by(result.total_tokens, opt.baseline_threshold) =>
+            {
+                print_baseline_exceeded(result.total_tokens, &baseline, opt.baseline_threshold);
+                return Ok(EXIT_BASELINE_EXCEEDED);
+            }
+            None if !opt.update_baseline => println!(
+                "\nNo baseline found at {:?}; pass --update-baseline to create it.",
+                baseline_file
+            ),
+            _ => {}
+        }
+        if opt.update_baseline {
+            Baseline {
+                total_tokens: result.total_tokens,
+            }
+            .save(baseline_file)?;
+        }
+    }
+
+    if combined.unchanged {
+        println!(
+            "\nOutput unchanged since the last stamped run; left {:?} as is.",
+            combined.output_file
+        );
+        return Ok(EXIT_UNCHANGED);
+    }
+
+    Ok(0)
+}
@@ -0,0 +1,121 @@
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::Path;
+
+#[derive(Debug, Default, Deserialize, Serialize)]
+pub struct Manifest {
+    pub total_tokens: usize,
+    pub files: BTreeMap<String, usize>,
+}
+
+#[derive(Debug, Default)]
+pub struct ManifestDiff {
+    pub added: Vec<(String, usize)>,
+    pub removed: Vec<(String, usize)>,
+    pub changed: Vec<(String, usize, usize)>,
+    pub token_delta: i64,
+}
+
+impl Manifest {
+    pub fn from_stats(total_tokens: usize, file_stats: &[(String, usize, u64)]) -> Self {
+        Manifest {
+            total_tokens,
+            files: file_stats
+                .iter()
+                .map(|(path, tokens, _)| (path.clone(), *tokens))
+                .collect(),
+        }
+    }
+
+    pub fn load(path: &Path) -> Result<Self> {
+        let manifest_str = fs::read_to_string(path)
+            .with_context(|| format!("Failed to read manifest: {:?}", path))?;
+        serde_json::from_str(&manifest_str)
+            .with_context(|| format!("Failed to parse manifest: {:?}", path))
+    }
+
+    pub fn save(&self, path: &Path) -> Result<()> {
+        let manifest_str = serde_json::to_string_pretty(self)?;
+        fs::write(path, manifest_str)
+            .with_context(|| format!("Failed to write manifest: {:?}", path))
+    }
+}
+
+pub fn compare(previous: &Manifest, current: &Manifest) -> ManifestDiff {
+    let mut diff = ManifestDiff {
+        token_delta: current.total_tokens as i64 - previous.total_tokens as i64,
+        ..Default::default()
+    };
+
+    for (path, &tokens) in &current.files {
+        match previous.files.get(path) {
+            None => diff.added.push((path.clone(), tokens)),
+            Some(&old_tokens) if old_tokens != tokens => {
+                diff.changed.push((path.clone(), old_tokens, tokens))
+            }
+            Some(_) => {}
+        }
+    }
+    for (path, &tokens) in &previous.files {
+        if !current.files.contains_key(path) {
+            diff.removed.push((path.clone(), tokens));
+        }
+    }
+
+    diff
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn manifest(files: &[(&str, usize)]) -> Manifest {
+        Manifest {
+            total_tokens: files.iter().map(|(_, tokens)| tokens).sum(),
+            files: files
+                .iter()
+                .map(|(path, tokens)| (path.to_string(), *tokens))
+                .collect(),
+        }
+    }
+
+    #[test]
+    fn compare_finds_added_and_removed_files() {
+        let previous = manifest(&[("src/main.rs", 100), ("src/old.rs", 40)]);
+        let current = manifest(&[("src/main.rs", 100), ("src/new.rs", 70)]);
+
+        let diff = compare(&previous, &current);
+        assert_eq!(diff.added, [("src/new.rs".to_string(), 70)]);
+        assert_eq!(diff.removed, [("src/old.rs".to_string(), 40)]);
+        assert!(diff.changed.is_empty());
+        assert_eq!(diff.token_delta, 30);
+    }
+
+    #[test]
+    fn compare_reports_changed_token_counts() {
+        let previous = manifest(&[("src/main.rs", 100)]);
+        let current = manifest(&[("src/main.rs", 80)]);
+
+        let diff = compare(&previous, &current);
+        assert_eq!(diff.changed, [("src/main.rs".to_string(), 100, 80)]);
+        assert_eq!(diff.token_delta, -20);
+    }
+
+    #[test]
+    fn a_saved_manifest_loads_back() {
+        let path =
+            std::env::temp_dir().join(format!("combiner-{}-manifest.json", std::process::id()));
+        let saved = Manifest::from_stats(
+            12,
+            &[("a.rs".to_string(), 5, 20), ("b.rs".to_string(), 7, 30)],
+        );
+        saved.save(&path).unwrap();
+        let loaded = Manifest::load(&path).unwrap();
+        fs::remove_file(&path).unwrap();
+
+        assert_eq!(loaded.total_tokens, 12);
+        assert_eq!(loaded.files, saved.files);
+    }
+}
@@ -0,0 +1,104 @@
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+// The modification time of every file combined by a --since-last-run run,
+// in nanoseconds since the Unix epoch, so the next run can combine only
+// what changed since
+#[derive(Debug, Default, Deserialize, Serialize)]
+pub struct MtimeCache {
+    files: BTreeMap<PathBuf, u64>,
+}
+
+impl MtimeCache {
+    // None when there is no cache yet, i.e. on the first run
+    pub fn load(path: &Path) -> Result<Option<Self>> {
+        let cache_str = match fs::read_to_string(path) {
+            Ok(cache_str) => cache_str,
+            Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(None),
+            Err(e) => {
+                return Err(e).with_context(|| format!("Failed to read mtime cache: {:?}", path))
+            }
+        };
+        serde_json::from_str(&cache_str)
+            .map(Some)
+            .with_context(|| format!("Failed to parse mtime cache: {:?}", path))
+    }
+
+    pub fn save(&self, path: &Path) -> Result<()> {
+        let cache_str = serde_json::to_string_pretty(self)?;
+        fs::write(path, cache_str)
+            .with_context(|| format!("Failed to write mtime cache: {:?}", path))
+    }
+
+    pub fn len(&self) -> usize {
+        self.files.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.files.is_empty()
+    }
+
+    // Whether `path` is new, or was modified after it was recorded. A file
+    // without a usable modification time always counts as changed.
+    pub fn is_changed(&self, path: &Path, modified: Option<SystemTime>) -> bool {
+        match (self.files.get(path), modified.and_then(nanos)) {
+            (Some(recorded), Some(modified)) => modified > *recorded,
+            _ => true,
+        }
+    }
+
+    pub fn record(&mut self, path: &Path, modified: Option<SystemTime>) {
+        if let Some(modified) = modified.and_then(nanos) {
+            self.files.insert(path.to_path_buf(), modified);
+        }
+    }
+}
+
+fn nanos(time: SystemTime) -> Option<u64> {
+    let since_epoch = time.duration_since(UNIX_EPOCH).ok()?;
+    u64::try_from(since_epoch.as_nanos()).ok()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+
+    #[test]
+    fn files_are_changed_when_new_or_modified_since_recorded() {
+        let recorded = UNIX_EPOCH + Duration::from_secs(1_000);
+        let mut cache = MtimeCache::default();
+        cache.record(Path::new("a.rs"), Some(recorded));
+        cache.record(Path::new("unknown.rs"), None);
+
+        assert!(!cache.is_changed(Path::new("a.rs"), Some(recorded)));
+        assert!(cache.is_changed(Path::new("a.rs"), Some(recorded + Duration::from_nanos(1))));
+        assert!(cache.is_changed(Path::new("a.rs"), None));
+        assert!(cache.is_changed(Path::new("b.rs"), Some(recorded)));
+        assert!(cache.is_changed(Path::new("unknown.rs"), Some(recorded)));
+        assert_eq!(cache.len(), 1);
+    }
+
+    #[test]
+    fn the_cache_round_trips_through_its_file() {
+        let path = std::env::temp_dir().join(format!("combiner-mtime-{}", std::process::id()));
+        assert!(MtimeCache::load(&path).unwrap().is_none());
+
+        let recorded = UNIX_EPOCH + Duration::from_secs(1_000);
+        let mut cache = MtimeCache::default();
+        cache.record(Path::new("a.rs"), Some(recorded));
+        cache.save(&path).unwrap();
+        let loaded = MtimeCache::load(&path).unwrap().unwrap();
+        fs::write(&path, "not json").unwrap();
+        let corrupt = MtimeCache::load(&path);
+        fs::remove_file(&path).unwrap();
+
+        assert!(!loaded.is_changed(Path::new("a.rs"), Some(recorded)));
+        assert!(corrupt.is_err());
+    }
+}
@@ -1,49 +1,202 @@
-use prettytable::{row, Table};
-use std::path::Path;
+use prettytable::{row, Attr, Table};
+use std::collections::BTreeMap;
+use std::env;
+use std::io::{self, IsTerminal};
+use std::path::{Component, Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
 use std::time::Duration;
 
-use crate::config::TokenizationMethod;
+use crate::baseline::Baseline;
+use crate::config::{TokenRange, TokenizationMethod, TOKENIZER_NAMES};
+use crate::file_processing::{ProcessingResult, SkipReason};
+use crate::manifest::ManifestDiff;
 
 pub const TOP_FILES_TO_SHOW: usize = 10;
 
+static COLOR: AtomicBool = AtomicBool::new(false);
+
+// Decides once whether tables are styled. Color is off with --no-color, with
+// a non-empty NO_COLOR (https://no-color.org), or when stdout is not a terminal.
+pub fn init_color(no_color: bool) {
+    let no_color_env = env::var_os("NO_COLOR").map_or(false, |value| !value.is_empty());
+    COLOR.store(
+        !no_color && !no_color_env && io::stdout().is_terminal(),
+        Ordering::Relaxed,
+    );
+}
+
+// Prints a table to stdout with its header row in bold, or as plain text
+// when color is off
+fn print_std(table: &mut Table) {
+    if !COLOR.load(Ordering::Relaxed) {
+        let _ = table.print(&mut io::stdout());
+        return;
+    }
+    if let Some(header) = table.get_mut_row(0) {
+        for cell in header.iter_mut() {
+            cell.style(Attr::Bold);
+        }
+    }
+    let _ = table.print_tty(true);
+}
+
 pub fn print_table(
-    files_processed: usize,
-    total_tokens: usize,
+    result: &ProcessingResult,
     output_file: &Path,
-    file_stats: &[(String, usize, u64)],
     processing_time: Duration,
     tokenization_method: &TokenizationMethod,
-    files_failed: usize,
-    files_ignored: usize,
 ) {
     let mut table = Table::new();
     table.add_row(row!["Statistic", "Value"]);
+    for (statistic, value) in
+        summary_rows(result, output_file, processing_time, tokenization_method)
+    {
+        table.add_row(row![statistic, value]);
+    }
+    print_std(&mut table);
+
+    // Top files table
+    let mut details_table = Table::new();
+    details_table.add_row(row!["File", "Tokens", "Size (bytes)", "% of Total Tokens"]);
+    for (file, tokens, size) in top_files(&result.file_stats) {
+        let percentage = token_percentage(tokens, result.total_tokens);
+        details_table.add_row(row![file, tokens, size, format!("{:.0}%", percentage)]);
+    }
+    println!("\nTop {} Files by Token Count:", details_table.len() - 1);
+    print_std(&mut details_table);
+
+    if !result.tokenizer_totals.is_empty() {
+        print_tokenizer_comparison(result, tokenization_method);
+    }
+}
+
+fn print_tokenizer_comparison(result: &ProcessingResult, tokenization_method: &TokenizationMethod) {
+    let mut comparison_table = Table::new();
+    comparison_table.add_row(row!["Tokenizer", "Total Tokens", "vs. Selected"]);
+    comparison_table.add_row(row![
+        format!("{} (selected)", tokenization_method.to_string()),
+        result.total_tokens,
+        "-"
+    ]);
+    for (method, total) in &result.tokenizer_totals {
+        let difference = if result.total_tokens > 0 {
+            format!("{:+.1}%", percentage(*total, result.total_tokens) - 100.0)
+        } else {
+            "-".to_string()
+        };
+        comparison_table.add_row(row![method.to_string(), total, difference]);
+    }
+    println!("\nTokenizer Comparison:");
+    print_std(&mut comparison_table);
+}
+
+pub fn summary_rows(
+    result: &ProcessingResult,
+    output_file: &Path,
+    processing_time: Duration,
+    tokenization_method: &TokenizationMethod,
+) -> Vec<(String, String)> {
+    let files_processed = result.files_processed;
+    let total_tokens = result.total_tokens;
+    let files_unreadable = result.skipped_files.len();
+    // Non-text files are counted apart from the ones the user's own filters
+    // left out
+    let files_not_text = result
+        .skip_counts
+        .get(&SkipReason::NonText)
+        .copied()
+        .unwrap_or(0);
+    let files_ignored: usize = result.skip_counts.values().sum::<usize>() - files_not_text;
+
+    let mut rows = Vec::new();
+    let mut add_row = |statistic: &str, value: String| rows.push((statistic.to_string(), value));
 
     // File statistics
-    table.add_row(row!["Files Processed", files_processed]);
-    table.add_row(row!["Files Failed", files_failed]);
-    table.add_row(row!["Files Ignored", files_ignored]);
-    table.add_row(row![
+    add_row("Files Processed", files_processed.to_string());
+    add_row("Files Unreadable", files_unreadable.to_string());
+    add_row("Files Not Text", files_not_text.to_string());
+    add_row("Files Ignored", files_ignored.to_string());
+    for (reason, count) in result
+        .skip_counts
+        .iter()
+        .filter(|(reason, _)| reason.is_deliberate())
+    {
+        add_row(
+            &format!("  Ignored ({})", reason.as_str()),
+            count.to_string(),
+        );
+    }
+    if let Some(files_resumed) = result.files_resumed {
+        add_row("Files Resumed", files_resumed.to_string());
+    }
+    if let Some(files_unchanged) = result.files_unchanged {
+        add_row(
+            "Files Unchanged Since Last Run",
+            files_unchanged.to_string(),
+        );
+    }
+    if let Some(files_cut) = result.files_cut_to_budget {
+        add_row("Files Cut to Fit --max-tokens", files_cut.to_string());
+    }
+    if let Some(files_transcoded) = result.files_transcoded {
+        add_row("Files Transcoded", files_transcoded.to_string());
+    }
+    if let Some(files_retried) = result.files_retried {
+        add_row("Files Read After Retry", files_retried.to_string());
+    }
+    if let Some(empty_dirs) = &result.empty_dirs {
+        add_row("Empty Directories", empty_dirs.len().to_string());
+    }
+    if let Some(flatten_renames) = result.flatten_renames {
+        add_row("Flattened Names Renamed", flatten_renames.to_string());
+    }
+    if let Some((sampled, candidates)) = result.sample {
+        add_row(
+            "Sampled Files",
+            format!(
+                "{} of {} ({:.1}%)",
+                sampled,
+                candidates,
+                percentage(sampled, candidates)
+            ),
+        );
+    }
+    if result.files_truncated > 0 {
+        add_row("Files Truncated", result.files_truncated.to_string());
+    }
+    let files_unsampled = result
+        .sample
+        .map_or(0, |(sampled, candidates)| candidates - sampled);
+    add_row(
         "Total Files",
-        files_processed + files_failed + files_ignored
-    ]);
+        (files_processed
+            + files_unreadable
+            + files_not_text
+            + files_ignored
+            + result.files_resumed.unwrap_or(0)
+            + result.files_unchanged.unwrap_or(0)
+            + result.files_truncated
+            + files_unsampled)
+            .to_string(),
+    );
 
     // Size statistics
-    let total_size: u64 = file_stats.iter().map(|(_, _, size)| size).sum();
-    table.add_row(row![
+    let total_size: u64 = result.file_stats.iter().map(|(_, _, size)| size).sum();
+    add_row(
         "Total File Size",
-        format!("{:.2} MB", total_size as f64 / 1_048_576.0)
-    ]);
+        format!("{:.2} MB", total_size as f64 / 1_048_576.0),
+    );
 
     let avg_size = if files_processed > 0 {
         total_size as f64 / files_processed as f64
     } else {
         0.0
     };
-    table.add_row(row![
-        "Average File Size",
-        format!("{:.2} KB", avg_size / 1024.0)
-    ]);
+    add_row("Average File Size", format!("{:.2} KB", avg_size / 1024.0));
+    add_row(
+        "Estimated Output Size",
+        format!("{:.2} MB", result.estimated_size as f64 / 1_048_576.0),
+    );
 
     // Averages
     let avg_tokens = if files_processed > 0 {
@@ -53,33 +206,287 @@ pub fn print_table(
     };
 
     // Token statistics
-    table.add_row(row!["Total Tokens", total_tokens]);
+    add_row("Total Tokens", total_tokens.to_string());
+    if let Some(delimiter_tokens) = result.delimiter_tokens {
+        let content_tokens: usize = result.file_stats.iter().map(|(_, tokens, _)| tokens).sum();
+        add_row("Content Tokens", content_tokens.to_string());
+        add_row("Path and Delimiter Tokens", delimiter_tokens.to_string());
+    }
+    if let Some(prompt_tokens) = result.prompt_tokens {
+        add_row("Prompt Tokens", prompt_tokens.to_string());
+    }
+    if let Some(toc_tokens) = result.toc_tokens {
+        add_row("Table of Contents Tokens", toc_tokens.to_string());
+    }
+    if let Some(separator_tokens) = result.separator_tokens {
+        add_row("File Separator Tokens", separator_tokens.to_string());
+    }
+    if let Some(chat_overhead_tokens) = result.chat_overhead_tokens {
+        add_row("Chat Overhead Tokens", chat_overhead_tokens.to_string());
+    }
+    add_row("Average Tokens per File", format!("{:.2}", avg_tokens));
+    if let Some(total_words) = result.total_words {
+        add_row("Total Words", total_words.to_string());
+    }
 
-    table.add_row(row![
-        "Average Tokens per File",
-        format!("{:.2}", avg_tokens)
-    ]);
+    // Analysis
+    if let Some(line_endings) = &result.line_endings {
+        add_row("Line Endings (LF)", line_endings.lf.to_string());
+        add_row("Line Endings (CRLF)", line_endings.crlf.to_string());
+        add_row("Line Endings (Mixed)", line_endings.mixed.len().to_string());
+    }
 
-    // Other information
-    table.add_row(row!["Tokenization Method", tokenization_method.to_string()]);
-    table.add_row(row!["Output File", output_file.to_string_lossy()]);
-    table.add_row(row!["Processing Time", format!("{:.2?}", processing_time)]);
+    if let Some(redactions) = result.redactions {
+        add_row("Secrets Redacted", redactions.to_string());
+    }
+    if let Some(compact_tokens_saved) = result.compact_tokens_saved {
+        add_row(
+            "Tokens Saved by Compacting",
+            compact_tokens_saved.to_string(),
+        );
+    }
 
-    table.printstd();
+    // Other information
+    add_row("Tokenization Method", tokenization_method.to_string());
+    if result.output_discarded {
+        add_row("Output File", "None (not written)".to_string());
+    } else if result.chunks.is_empty() {
+        add_row("Output File", output_file.to_string_lossy().into_owned());
+        for also_output in &result.also_outputs {
+            add_row(
+                "Also Written To",
+                also_output.to_string_lossy().into_owned(),
+            );
+        }
+    } else {
+        add_row("Output Chunks", result.chunks.len().to_string());
+        for chunk in &result.chunks {
+            add_row(
+                &format!("  {}", chunk.path.to_string_lossy()),
+                format!("{} files, {} tokens", chunk.files.len(), chunk.tokens),
+            );
+        }
+    }
+    add_row("Processing Time", format!("{:.2?}", processing_time));
+    if let Some(timings) = &result.timings {
+        add_row("  Traversal", format!("{:.2?}", timings.traversal));
+        add_row(
+            "  Reading and Tokenizing",
+            format!("{:.2?}", timings.processing),
+        );
+        add_row("  Writing", format!("{:.2?}", timings.writing));
+    }
 
-    // Top files table
-    let mut details_table = Table::new();
-    details_table.add_row(row!["File", "Tokens", "Size (bytes)", "% of Total Tokens"]);
+    rows
+}
 
-    // Sort file_stats by token count (descending) and take top N
+// Sort file_stats by token count (descending) and take top N. file_stats is
+// in the order files finished processing, which varies between runs, so ties
+// go to the smaller path.
+pub fn top_files(file_stats: &[(String, usize, u64)]) -> Vec<(String, usize, u64)> {
     let mut sorted_stats = file_stats.to_vec();
-    sorted_stats.sort_by(|a, b| b.1.cmp(&a.1));
-    for (file, tokens, size) in sorted_stats.iter().take(TOP_FILES_TO_SHOW) {
-        let percentage = ((*tokens as f64 / total_tokens as f64) * 100.0).round();
-        details_table.add_row(row![file, tokens, size, format!("{:.0}%", percentage)]);
+    sorted_stats.sort_by(|a, b| b.1.cmp(&a.1).then_with(|| a.0.cmp(&b.0)));
+    sorted_stats.truncate(TOP_FILES_TO_SHOW);
+    sorted_stats
+}
+
+// A run whose files are all empty has no tokens to share out, and shows 0%
+// rather than NaN
+pub fn token_percentage(tokens: usize, total_tokens: usize) -> f64 {
+    percentage(tokens, total_tokens).round()
+}
+
+// `part` as a percentage of `whole`, or 0 when there is no whole to divide
+fn percentage(part: usize, whole: usize) -> f64 {
+    if whole == 0 {
+        return 0.0;
     }
-    println!("\nTop {} Files by Token Count:", details_table.len() - 1);
-    details_table.printstd();
+    part as f64 / whole as f64 * 100.0
+}
+
+pub fn language_breakdown(file_stats: &[(String, usize, u64)]) -> Vec<(String, usize, usize)> {
+    let mut languages: BTreeMap<String, (usize, usize)> = BTreeMap::new();
+    for (file, tokens, _) in file_stats {
+        let entry = languages.entry(language_name(Path::new(file))).or_default();
+        entry.0 += 1;
+        entry.1 += tokens;
+    }
+
+    let mut breakdown: Vec<_> = languages
+        .into_iter()
+        .map(|(language, (files, tokens))| (language, files, tokens))
+        .collect();
+    breakdown.sort_by(|a, b| b.2.cmp(&a.2));
+    breakdown
+}
+
+pub fn language_name(path: &Path) -> String {
+    let ext = path.extension().and_then(|ext| ext.to_str()).unwrap_or("");
+    match ext {
+        "rs" => "Rust",
+        "py" => "Python",
+        "js" => "JavaScript",
+        "ts" => "TypeScript",
+        "md" => "Markdown",
+        "toml" => "TOML",
+        "json" => "JSON",
+        "yaml" | "yml" => "YAML",
+        "html" => "HTML",
+        "css" => "CSS",
+        "sh" | "bash" => "Shell",
+        "xml" => "XML",
+        "svg" => "SVG",
+        "c" | "h" => "C",
+        "cpp" | "hpp" => "C++",
+        "txt" => "Text",
+        "" => "Other",
+        ext => return ext.to_uppercase(),
+    }
+    .to_string()
+}
+
+// Width of the bar for the fullest histogram bucket
+const HISTOGRAM_BAR_WIDTH: usize = 40;
+
+// Counts files per token bucket. `bounds` are the buckets' exclusive upper
+// bounds; files at or above the last bound land in a final open bucket.
+pub fn token_histogram(
+    file_stats: &[(String, usize, u64)],
+    bounds: &[usize],
+) -> Vec<(String, usize)> {
+    let mut bounds = bounds.to_vec();
+    bounds.sort_unstable();
+    bounds.dedup();
+
+    let mut counts = vec![0; bounds.len() + 1];
+    for (_, tokens, _) in file_stats {
+        let bucket = bounds.partition_point(|bound| *bound <= *tokens);
+        counts[bucket] += 1;
+    }
+
+    let mut lower = 0;
+    let mut labels: Vec<String> = bounds
+        .iter()
+        .map(|upper| {
+            let label = format!("{}-{}", lower, upper);
+            lower = *upper;
+            label
+        })
+        .collect();
+    labels.push(format!("{}+", lower));
+
+    labels.into_iter().zip(counts).collect()
+}
+
+pub fn print_token_histogram(result: &ProcessingResult, bounds: &[usize]) {
+    let histogram = token_histogram(&result.file_stats, bounds);
+    let max_count = histogram.iter().map(|(_, count)| *count).max().unwrap_or(0);
+
+    let mut histogram_table = Table::new();
+    histogram_table.add_row(row!["Tokens", "Files", ""]);
+    for (label, count) in histogram {
+        let width = if max_count > 0 {
+            (count * HISTOGRAM_BAR_WIDTH).div_ceil(max_count)
+        } else {
+            0
+        };
+        histogram_table.add_row(row![label, count, "#".repeat(width)]);
+    }
+    println!("\nToken Histogram:");
+    print_std(&mut histogram_table);
+}
+
+// A directory or file of the --dry-run tree, with the tokens of everything
+// under it
+#[derive(Default)]
+struct TreeNode {
+    tokens: usize,
+    children: BTreeMap<String, TreeNode>,
+}
+
+// Builds the tree of the combined files below the directory they all share,
+// which is returned as the name of the root
+fn token_tree(file_stats: &[(String, usize, u64)]) -> (String, TreeNode) {
+    let files: Vec<(Vec<String>, usize)> = file_stats
+        .iter()
+        .map(|(path, tokens, _)| {
+            let components = Path::new(path)
+                .components()
+                .filter(|component| !matches!(component, Component::CurDir))
+                .map(|component| component.as_os_str().to_string_lossy().into_owned())
+                .collect();
+            (components, *tokens)
+        })
+        .collect();
+
+    // The shared directory leaves out the file names
+    let mut shared = match files.first() {
+        Some((components, _)) => components.len().saturating_sub(1),
+        None => 0,
+    };
+    for (components, _) in &files {
+        shared = shared.min(components.len().saturating_sub(1));
+        while components[..shared] != files[0].0[..shared] {
+            shared -= 1;
+        }
+    }
+    let root_name = match files.first() {
+        Some((components, _)) if shared > 0 => components[..shared]
+            .iter()
+            .collect::<PathBuf>()
+            .to_string_lossy()
+            .into_owned(),
+        _ => ".".to_string(),
+    };
+
+    let mut root = TreeNode::default();
+    for (components, tokens) in &files {
+        root.tokens += tokens;
+        let mut node = &mut root;
+        for component in &components[shared..] {
+            node = node.children.entry(component.clone()).or_default();
+            node.tokens += tokens;
+        }
+    }
+    (root_name, root)
+}
+
+pub fn print_token_tree(result: &ProcessingResult) {
+    let (root_name, root) = token_tree(&result.file_stats);
+    println!("\nToken Tree:");
+    println!(
+        "{}/ ({} tokens)",
+        root_name.trim_end_matches('/'),
+        root.tokens
+    );
+    print_tree_children(&root, "");
+}
+
+fn print_tree_children(node: &TreeNode, indent: &str) {
+    let last = node.children.len().saturating_sub(1);
+    for (i, (name, child)) in node.children.iter().enumerate() {
+        let (branch, next_indent) = if i == last {
+            ("└── ", "    ")
+        } else {
+            ("├── ", "│   ")
+        };
+        // Only directories have children
+        let slash = if child.children.is_empty() { "" } else { "/" };
+        println!(
+            "{}{}{}{} ({} tokens)",
+            indent, branch, name, slash, child.tokens
+        );
+        print_tree_children(child, &format!("{}{}", indent, next_indent));
+    }
+}
+
+pub fn print_tokenizers() {
+    let mut table = Table::new();
+    table.add_row(row!["Name", "Encoding"]);
+    for (name, method) in &TOKENIZER_NAMES {
+        table.add_row(row![name, method.encoding_name()]);
+    }
+    print_std(&mut table);
 }
 
 pub fn print_skipped_files(skipped_files: &[(String, String)]) {
@@ -93,5 +500,222 @@ pub fn print_skipped_files(skipped_files: &[(String, String)]) {
     for (file, reason) in skipped_files {
         skipped_table.add_row(row![file, reason]);
     }
-    skipped_table.printstd();
+    print_std(&mut skipped_table);
+}
+
+pub fn print_manifest_diff(diff: &ManifestDiff) {
+    println!("\nChanges Since Previous Run:");
+    if diff.added.is_empty() && diff.removed.is_empty() && diff.changed.is_empty() {
+        println!("No files added, removed, or changed.");
+    } else {
+        let mut diff_table = Table::new();
+        diff_table.add_row(row!["Change", "File", "Tokens"]);
+        for (file, tokens) in &diff.added {
+            diff_table.add_row(row!["Added", file, format!("+{}", tokens)]);
+        }
+        for (file, tokens) in &diff.removed {
+            diff_table.add_row(row!["Removed", file, format!("-{}", tokens)]);
+        }
+        for (file, old_tokens, new_tokens) in &diff.changed {
+            diff_table.add_row(row![
+                "Changed",
+                file,
+                format!("{} -> {}", old_tokens, new_tokens)
+            ]);
+        }
+        print_std(&mut diff_table);
+    }
+    println!("Token Difference: {:+}", diff.token_delta);
+}
+
+pub fn print_truncation_warning(files_processed: usize, files_truncated: usize) {
+    if files_truncated == 0 {
+        return;
+    }
+
+    println!(
+        "\nWARNING: Output truncated to {} files by --max-files; {} more files were left out.",
+        files_processed, files_truncated
+    );
+}
+
+pub fn print_unused_ignores(unused_ignores: &[String]) {
+    if unused_ignores.is_empty() {
+        return;
+    }
+
+    println!("\nWARNING: These ignore patterns did not match any file:");
+    for pattern in unused_ignores {
+        println!("  {}", pattern);
+    }
+}
+
+pub fn print_token_range_error(total_tokens: usize, range: &TokenRange) {
+    println!(
+        "\nERROR: {} total tokens is outside the expected range {}; failing because of --expect-tokens.",
+        total_tokens, range
+    );
+}
+
+pub fn print_baseline_exceeded(total_tokens: usize, baseline: &Baseline, threshold: f64) {
+    println!(
+        "\nERROR: {} total tokens is more than {}% above the baseline of {}; failing because of --baseline.",
+        total_tokens, threshold, baseline.total_tokens
+    );
+}
+
+pub fn print_unexpected_skips(result: &ProcessingResult) {
+    let mut breakdown: Vec<String> = result
+        .skip_counts
+        .iter()
+        .filter(|(reason, _)| !reason.is_deliberate())
+        .map(|(reason, count)| format!("{} {}", count, reason.as_str()))
+        .collect();
+    if !result.skipped_files.is_empty() {
+        breakdown.push(format!("{} unreadable", result.skipped_files.len()));
+    }
+
+    println!(
+        "\nERROR: {} files were skipped ({}); failing because of --fail-on-skip.",
+        result.unexpected_skips(),
+        breakdown.join(", ")
+    );
+}
+
+// For --list-skipped: files left out by filters, then files that failed to
+// read. Written to stderr so the list stays apart from the statistics.
+pub fn print_skip_list(result: &ProcessingResult) {
+    let skip_list = match &result.skip_list {
+        Some(skip_list) => skip_list,
+        None => return,
+    };
+    if skip_list.is_empty() && result.skipped_files.is_empty() {
+        eprintln!("\nNo files were skipped.");
+        return;
+    }
+    eprintln!("\nSkipped Files:");
+    for (file, reason) in skip_list {
+        eprintln!("{}: {}", file, reason.as_str());
+    }
+    for (file, error) in &result.skipped_files {
+        eprintln!("{}: unreadable ({})", file, error);
+    }
+}
+
+pub fn print_mixed_line_endings(result: &ProcessingResult) {
+    let mixed = match &result.line_endings {
+        Some(line_endings) if !line_endings.mixed.is_empty() => &line_endings.mixed,
+        _ => return,
+    };
+
+    println!("\nWARNING: Files with mixed CRLF/LF line endings:");
+    for file in mixed {
+        println!("  {}", file);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn stats(tokens: &[usize]) -> Vec<(String, usize, u64)> {
+        tokens
+            .iter()
+            .enumerate()
+            .map(|(i, tokens)| (format!("file{}.rs", i), *tokens, 0))
+            .collect()
+    }
+
+    #[test]
+    fn files_land_in_the_bucket_below_their_upper_bound() {
+        let histogram = token_histogram(
+            &stats(&[0, 99, 100, 499, 500, 1999, 2000, 50_000]),
+            &[100, 500, 2000],
+        );
+        assert_eq!(
+            histogram,
+            vec![
+                ("0-100".to_string(), 2),
+                ("100-500".to_string(), 2),
+                ("500-2000".to_string(), 2),
+                ("2000+".to_string(), 2),
+            ]
+        );
+    }
+
+    #[test]
+    fn bucket_bounds_are_sorted_and_deduplicated() {
+        let histogram = token_histogram(&stats(&[5, 15]), &[10, 10, 1]);
+        assert_eq!(
+            histogram,
+            vec![
+                ("0-1".to_string(), 0),
+                ("1-10".to_string(), 1),
+                ("10+".to_string(), 1),
+            ]
+        );
+    }
+
+    #[test]
+    fn no_bounds_put_every_file_in_one_bucket() {
+        let histogram = token_histogram(&stats(&[0, 10_000]), &[]);
+        assert_eq!(histogram, vec![("0+".to_string(), 2)]);
+    }
+
+    #[test]
+    fn top_files_with_equal_tokens_are_ordered_by_path() {
+        let file_stats = vec![
+            ("c.rs".to_string(), 5, 0),
+            ("b.rs".to_string(), 9, 0),
+            ("a.rs".to_string(), 5, 0),
+        ];
+        let mut reversed = file_stats.clone();
+        reversed.reverse();
+
+        let names = |stats: &[(String, usize, u64)]| -> Vec<String> {
+            top_files(stats)
+                .into_iter()
+                .map(|(name, _, _)| name)
+                .collect()
+        };
+        assert_eq!(names(&file_stats), ["b.rs", "a.rs", "c.rs"]);
+        assert_eq!(names(&reversed), names(&file_stats));
+    }
+
+    #[test]
+    fn the_token_tree_sums_each_directory_below_the_shared_one() {
+        let file_stats = vec![
+            ("repo/src/main.rs".to_string(), 10, 0),
+            ("repo/src/cli/args.rs".to_string(), 5, 0),
+            ("repo/README.md".to_string(), 2, 0),
+        ];
+        let (root_name, root) = token_tree(&file_stats);
+        assert_eq!(root_name, "repo");
+        assert_eq!(root.tokens, 17);
+        let src = &root.children["src"];
+        assert_eq!(src.tokens, 15);
+        assert_eq!(src.children["cli"].tokens, 5);
+        assert_eq!(src.children["main.rs"].tokens, 10);
+        assert!(src.children["main.rs"].children.is_empty());
+        assert_eq!(root.children["README.md"].tokens, 2);
+    }
+
+    #[test]
+    fn files_with_no_shared_directory_hang_off_the_current_one() {
+        let file_stats = vec![
+            ("main.rs".to_string(), 3, 0),
+            ("./src/lib.rs".to_string(), 4, 0),
+        ];
+        let (root_name, root) = token_tree(&file_stats);
+        assert_eq!(root_name, ".");
+        assert_eq!(root.children["main.rs"].tokens, 3);
+        assert_eq!(root.children["src"].children["lib.rs"].tokens, 4);
+    }
+
+    #[test]
+    fn a_run_with_no_tokens_shows_zero_percent() {
+        assert_eq!(token_percentage(0, 0), 0.0);
+        assert_eq!(token_percentage(1, 3), 33.0);
+        assert_eq!(token_percentage(3, 3), 100.0);
+    }
 }
@@ -0,0 +1,232 @@
+use std::collections::{HashMap, HashSet};
+use std::path::{Component, Path, PathBuf};
+
+// Path of `path` relative to the input `root`, with `/` separators on every
+// platform. Falls back to the path as walked when it is not under `root`, or
+// is `root` itself (a single input file).
+pub fn relative_display_path(root: &Path, path: &Path) -> String {
+    let relative = match path.strip_prefix(root) {
+        Ok(relative) if !relative.as_os_str().is_empty() => relative,
+        _ => path,
+    };
+    slash_path(relative)
+}
+
+// The name of an input directory for --include-root-name, with `.` and `..`
+// resolved to the directory they stand for
+pub fn root_name(root: &Path) -> Option<String> {
+    let root = std::fs::canonicalize(root).unwrap_or_else(|_| root.to_path_buf());
+    root.file_name()
+        .map(|name| name.to_string_lossy().into_owned())
+}
+
+// `path` with `/` separators on every platform. Only the platform's own
+// separator is replaced: on Unix a backslash is part of a file name.
+pub fn slash_path(path: &Path) -> String {
+    path.to_string_lossy()
+        .replace(std::path::MAIN_SEPARATOR, "/")
+}
+
+// Where --mirror-to writes a file shown as `display_path`. Only the plain
+// name components are kept, so a path walked from outside the input (e.g.
+// `../lib.rs`) or an absolute one still lands inside `dir`.
+pub fn mirror_path(dir: &Path, display_path: &str) -> PathBuf {
+    let mut path = dir.to_path_buf();
+    for component in Path::new(display_path).components() {
+        if let Component::Normal(name) = component {
+            path.push(name);
+        }
+    }
+    path
+}
+
+// Maps each file to its base name for --flatten. When base names collide, the
+// first file (in path order) keeps the plain name and later ones get a
+// counter, e.g. `main_2.rs`. Returns the names and how many were renamed.
+pub fn flatten_names(files: &[&Path]) -> (HashMap<PathBuf, String>, usize) {
+    let mut sorted: Vec<&Path> = files.to_vec();
+    sorted.sort();
+    // A file given twice keeps one name rather than being renamed after itself
+    sorted.dedup();
+
+    let mut used: HashSet<String> = HashSet::new();
+    let mut names = HashMap::new();
+    let mut renamed = 0;
+
+    for path in sorted {
+        let base_name = path
+            .file_name()
+            .map(|name| name.to_string_lossy().into_owned())
+            .unwrap_or_else(|| path.to_string_lossy().into_owned());
+
+        let mut name = base_name.clone();
+        let mut counter = 1;
+        while used.contains(&name) {
+            counter += 1;
+            name = numbered_name(&base_name, counter);
+        }
+        if counter > 1 {
+            renamed += 1;
+        }
+
+        used.insert(name.clone());
+        names.insert(path.to_path_buf(), name);
+    }
+
+    (names, renamed)
+}
+
+fn numbered_name(base_name: &str, counter: usize) -> String {
+    match base_name.rsplit_once('.') {
+        Some((stem, ext)) if !stem.is_empty() => format!("{}_{}.{}", stem, counter, ext),
+        _ => format!("{}_{}", base_name, counter),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn unique_names_are_kept() {
+        let (names, renamed) = flatten_names(&[Path::new("src/lib.rs"), Path::new("README.md")]);
+        assert_eq!(renamed, 0);
+        assert_eq!(names[Path::new("src/lib.rs")], "lib.rs");
+        assert_eq!(names[Path::new("README.md")], "README.md");
+    }
+
+    #[test]
+    fn colliding_names_are_numbered_in_path_order() {
+        let files = [
+            Path::new("cmd/server/main.go"),
+            Path::new("cmd/client/main.go"),
+            Path::new("main.go"),
+        ];
+        let (names, renamed) = flatten_names(&files);
+        assert_eq!(renamed, 2);
+        assert_eq!(names[Path::new("cmd/client/main.go")], "main.go");
+        assert_eq!(names[Path::new("cmd/server/main.go")], "main_2.go");
+        assert_eq!(names[Path::new("main.go")], "main_3.go");
+    }
+
+    #[test]
+    fn a_numbered_name_skips_names_already_taken() {
+        let files = [
+            Path::new("a/main_2.go"),
+            Path::new("b/main.go"),
+            Path::new("c/main.go"),
+        ];
+        let (names, renamed) = flatten_names(&files);
+        assert_eq!(renamed, 1);
+        assert_eq!(names[Path::new("a/main_2.go")], "main_2.go");
+        assert_eq!(names[Path::new("b/main.go")], "main.go");
+        assert_eq!(names[Path::new("c/main.go")], "main_3.go");
+    }
+
+    #[test]
+    fn names_without_an_extension_are_numbered_at_the_end() {
+        let files = [Path::new("a/Makefile"), Path::new("b/Makefile")];
+        let (names, _) = flatten_names(&files);
+        assert_eq!(names[Path::new("b/Makefile")], "Makefile_2");
+    }
+
+    #[test]
+    fn paths_under_the_dot_root_lose_the_dot() {
+        assert_eq!(
+            relative_display_path(Path::new("."), Path::new("./src/main.rs")),
+            "src/main.rs"
+        );
+        assert_eq!(
+            relative_display_path(Path::new("."), Path::new("./.env.example")),
+            ".env.example"
+        );
+    }
+
+    #[test]
+    fn paths_under_an_absolute_root_are_relative_to_it() {
+        assert_eq!(
+            relative_display_path(Path::new("/work/repo"), Path::new("/work/repo/Cargo.toml")),
+            "Cargo.toml"
+        );
+        assert_eq!(
+            relative_display_path(Path::new("/work/repo/"), Path::new("/work/repo/src/a/b.rs")),
+            "src/a/b.rs"
+        );
+    }
+
+    #[test]
+    fn the_walked_path_is_kept_when_it_is_not_under_the_root() {
+        assert_eq!(
+            relative_display_path(Path::new("notes.txt"), Path::new("notes.txt")),
+            "notes.txt"
+        );
+        assert_eq!(
+            relative_display_path(Path::new("/work/repo"), Path::new("/work/other/a.rs")),
+            "/work/other/a.rs"
+        );
+    }
+
+    #[test]
+    fn mirrored_files_keep_their_relative_path() {
+        assert_eq!(
+            mirror_path(Path::new("mirror"), "src/lib/main.rs"),
+            Path::new("mirror/src/lib/main.rs")
+        );
+    }
+
+    #[test]
+    fn mirrored_files_stay_inside_the_mirror_directory() {
+        assert_eq!(
+            mirror_path(Path::new("mirror"), "../lib.rs"),
+            Path::new("mirror/lib.rs")
+        );
+        assert_eq!(
+            mirror_path(Path::new("mirror"), "/etc/./passwd"),
+            Path::new("mirror/etc/passwd")
+        );
+        assert_eq!(
+            mirror_path(Path::new("mirror"), "a/../../b.rs"),
+            Path::new("mirror/a/b.rs")
+        );
+    }
+
+    #[test]
+    fn slash_paths_use_forward_slashes() {
+        let path: PathBuf = ["src", "lib", "main.rs"].iter().collect();
+        assert_eq!(slash_path(&path), "src/lib/main.rs");
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn slash_paths_keep_backslashes_in_unix_names() {
+        assert_eq!(slash_path(Path::new(r"a\b.rs")), r"a\b.rs");
+    }
+
+    #[test]
+    fn root_names_resolve_dot_to_the_directory_it_stands_for() {
+        let cwd = std::env::current_dir().unwrap();
+        let name = cwd.file_name().unwrap().to_str().unwrap();
+        assert_eq!(root_name(Path::new(".")).as_deref(), Some(name));
+        let project = std::env::temp_dir().join(format!("combiner-root-{}", std::process::id()));
+        std::fs::create_dir_all(project.join("src")).unwrap();
+        let parent = root_name(&project.join("src").join(".."));
+        std::fs::remove_dir_all(&project).unwrap();
+        assert_eq!(
+            parent,
+            project.file_name().unwrap().to_str().map(String::from)
+        );
+        assert_eq!(
+            root_name(Path::new("missing/project")).as_deref(),
+            Some("project")
+        );
+    }
+
+    #[test]
+    fn a_file_listed_twice_gets_one_name() {
+        let files = [Path::new("src/main.rs"), Path::new("src/main.rs")];
+        let (names, renamed) = flatten_names(&files);
+        assert_eq!(renamed, 0);
+        assert_eq!(names.len(), 1);
+        assert_eq!(names[Path::new("src/main.rs")], "main.rs");
+    }
+}
@@ -0,0 +1,363 @@
+use anyhow::{Context, Result};
+use regex::Regex;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+use crate::paths::{relative_display_path, slash_path};
+
+const NEGATION_PREFIX: char = '!';
+
+// An ordered list of ignore or include patterns. Patterns are evaluated in
+// the order they were given and the last matching pattern decides, so a later
+// `!pattern` can exclude what an earlier pattern matched (and vice versa).
+// Each pattern counts the paths it decided, so unused patterns can be found.
+pub struct PatternSet {
+    matchers: Vec<Matcher>,
+}
+
+struct Matcher {
+    pattern: String,
+    kind: MatchKind,
+    negated: bool,
+    hits: AtomicUsize,
+}
+
+enum MatchKind {
+    // A whole file or directory name at any depth, as in .gitignore
+    Component(String),
+    Substring(String),
+    Suffix(String),
+    Glob(Regex),
+    // Matched against the path relative to a root directory
+    Anchored(PathBuf, Regex),
+}
+
+impl PatternSet {
+    pub fn new(patterns: &[String]) -> Result<Self> {
+        let matchers = patterns
+            .iter()
+            .map(|pattern| Matcher::new(pattern))
+            .collect::<Result<Vec<_>>>()?;
+        Ok(PatternSet { matchers })
+    }
+
+    // Appends patterns with .dockerignore semantics: each pattern is anchored
+    // at `root` (a leading `/` is optional) rather than matching anywhere in
+    // the path, and a pattern matching a directory matches everything in it.
+    pub fn add_anchored(&mut self, root: &Path, patterns: &[String]) -> Result<()> {
+        for original in patterns {
+            let (negated, pattern) = match original.strip_prefix(NEGATION_PREFIX) {
+                Some(rest) => (true, rest),
+                None => (false, original.as_str()),
+            };
+            let pattern = pattern.trim_start_matches("./");
+            let regex = Regex::new(&format!("^{}", glob_to_regex_body(pattern)))
+                .with_context(|| format!("Invalid pattern: {}", pattern))?;
+            self.matchers.push(Matcher {
+                pattern: original.clone(),
+                kind: MatchKind::Anchored(root.to_path_buf(), regex),
+                negated,
+                hits: AtomicUsize::new(0),
+            });
+        }
+        Ok(())
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.matchers.is_empty()
+    }
+
+    // Paths are matched with `/` separators, whatever the platform uses, so
+    // patterns like `src/` and `docs/*.md` work everywhere
+    pub fn matches(&self, path: &Path) -> bool {
+        let path_str = slash_path(path);
+        self.matchers
+            .iter()
+            .rev()
+            .find(|matcher| matcher.kind.matches(path, &path_str))
+            .map(|matcher| {
+                matcher.hits.fetch_add(1, Ordering::Relaxed);
+                !matcher.negated
+            })
+            .unwrap_or(false)
+    }
+
+    // Whether everything under `dir` is certain to match, so a walk can skip
+    // the whole directory. That is never certain when a `!pattern` could
+    // match something inside it, or for `*.ext` patterns, which match the
+    // directory's name but not the paths of the files in it.
+    pub fn matches_dir(&self, dir: &Path) -> bool {
+        if self.matchers.iter().any(|matcher| matcher.negated) {
+            return false;
+        }
+        let dir_str = slash_path(dir);
+        self.matchers
+            .iter()
+            .rev()
+            .filter(|matcher| !matches!(matcher.kind, MatchKind::Suffix(_)))
+            .find(|matcher| matcher.kind.matches(dir, &dir_str))
+            .map(|matcher| matcher.hits.fetch_add(1, Ordering::Relaxed))
+            .is_some()
+    }
+
+    // Patterns that have not decided a single match so far, in order
+    pub fn unused(&self) -> Vec<String> {
+        self.matchers
+            .iter()
+            .filter(|matcher| matcher.hits.load(Ordering::Relaxed) == 0)
+            .map(|matcher| matcher.pattern.clone())
+            .collect()
+    }
+}
+
+impl Matcher {
+    fn new(original: &str) -> Result<Self> {
+        let (negated, pattern) = match original.strip_prefix(NEGATION_PREFIX) {
+            Some(rest) => (true, rest),
+            None => (false, original),
+        };
+        Ok(Matcher {
+            pattern: original.to_string(),
+            kind: MatchKind::new(pattern)?,
+            negated,
+            hits: AtomicUsize::new(0),
+        })
+    }
+}
+
+impl MatchKind {
+    fn new(pattern: &str) -> Result<Self> {
+        // Patterns built from native paths (like the output file) must use
+        // the same separators as the paths they are matched against
+        let pattern = &slash_path(Path::new(pattern));
+        if !has_wildcard(pattern) {
+            if pattern.contains('/') {
+                return Ok(MatchKind::Substring(pattern.to_string()));
+            }
+            return Ok(MatchKind::Component(pattern.to_string()));
+        }
+        if let Some(suffix) = pattern.strip_prefix('*') {
+            if !has_wildcard(suffix) && !suffix.contains('/') {
+                return Ok(MatchKind::Suffix(suffix.to_string()));
+            }
+        }
+        let regex = Regex::new(&glob_to_regex(pattern))
+            .with_context(|| format!("Invalid pattern: {}", pattern))?;
+        Ok(MatchKind::Glob(regex))
+    }
+
+    fn matches(&self, path: &Path, path_str: &str) -> bool {
+        match self {
+            MatchKind::Component(name) => path
+                .components()
+                .any(|component| component.as_os_str() == name.as_str()),
+            MatchKind::Substring(pattern) => path_str.contains(pattern.as_str()),
+            MatchKind::Suffix(suffix) => path_str.ends_with(suffix.as_str()),
+            MatchKind::Glob(regex) => regex.is_match(path_str),
+            MatchKind::Anchored(root, regex) => {
+                path.starts_with(root) && regex.is_match(&relative_display_path(root, path))
+            }
+        }
+    }
+}
+
+fn has_wildcard(pattern: &str) -> bool {
+    pattern.contains('*') || pattern.contains('?')
+}
+
+// Translates a glob into a regex that matches whole path components:
+// `*` and `?` stay within a component while `**` may cross separators.
+pub fn glob_to_regex(glob: &str) -> String {
+    format!("(?:^|/){}", glob_to_regex_body(glob))
+}
+
+fn glob_to_regex_body(glob: &str) -> String {
+    let mut regex = String::new();
+    let mut chars = glob.trim_matches('/').chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '*' if chars.peek() == Some(&'*') => {
+                chars.next();
+                // `**/` may also match no directories at all
+                if chars.peek() == Some(&'/') {
+                    chars.next();
+                    regex.push_str("(?:.*/)?");
+                } else {
+                    regex.push_str(".*");
+                }
+            }
+            '*' => regex.push_str("[^/]*"),
+            '?' => regex.push_str("[^/]"),
+            _ => regex.push_str(&regex::escape(&c.to_string())),
+        }
+    }
+    regex.push_str("(?:/|$)");
+    regex
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn patterns(patterns: &[&str]) -> PatternSet {
+        let patterns: Vec<String> = patterns.iter().map(|p| p.to_string()).collect();
+        PatternSet::new(&patterns).unwrap()
+    }
+
+    #[test]
+    fn a_later_negation_re_includes_a_suffix_match() {
+        let set = patterns(&["*.json", "!package.json"]);
+        assert!(set.matches(Path::new("src/config.json")));
+        assert!(!set.matches(Path::new("web/package.json")));
+    }
+
+    #[test]
+    fn a_later_ignore_overrides_an_earlier_negation() {
+        let set = patterns(&["!package.json", "*.json"]);
+        assert!(set.matches(Path::new("web/package.json")));
+    }
+
+    #[test]
+    fn order_decides_across_plain_suffix_and_glob_patterns() {
+        let set = patterns(&["build", "!build/keep/**", "*.o"]);
+        assert!(set.matches(Path::new("build/out.txt")));
+        assert!(!set.matches(Path::new("build/keep/notes.txt")));
+        assert!(set.matches(Path::new("build/keep/main.o")));
+
+        let set = patterns(&["src/**/*.rs", "!main.rs"]);
+        assert!(set.matches(Path::new("src/bin/lib.rs")));
+        assert!(!set.matches(Path::new("src/bin/main.rs")));
+    }
+
+    #[test]
+    fn globs_match_whole_path_components() {
+        let set = patterns(&["src/*.rs"]);
+        assert!(set.matches(Path::new("src/lib.rs")));
+        assert!(!set.matches(Path::new("src/a/lib.rs")));
+        assert!(!set.matches(Path::new("mysrc/lib.rs")));
+    }
+
+    #[test]
+    fn nothing_matches_without_patterns() {
+        assert!(!patterns(&[]).matches(Path::new("src/main.rs")));
+    }
+
+    #[test]
+    fn include_and_ignore_share_the_matching_rules() {
+        let set = patterns(&["*.go", "!*_test.go"]);
+        assert!(set.matches(Path::new("cmd/main.go")));
+        assert!(!set.matches(Path::new("cmd/main_test.go")));
+        assert!(!set.matches(Path::new("README.md")));
+    }
+
+    #[test]
+    fn dockerignore_patterns_are_anchored_at_the_root() {
+        let mut set = PatternSet::new(&[]).unwrap();
+        let root = Path::new("app");
+        let dockerignore: Vec<String> = ["build", "**/*.log", "!keep.log"]
+            .iter()
+            .map(|p| p.to_string())
+            .collect();
+        set.add_anchored(root, &dockerignore).unwrap();
+        assert!(set.matches(Path::new("app/build/out.o")));
+        assert!(!set.matches(Path::new("app/src/build/out.o")));
+        assert!(set.matches(Path::new("app/src/debug.log")));
+        assert!(!set.matches(Path::new("app/keep.log")));
+        assert!(!set.matches(Path::new("other/build/out.o")));
+    }
+
+    #[test]
+    fn a_leading_double_star_also_matches_at_the_top() {
+        let set = patterns(&["**/*.log"]);
+        assert!(set.matches(Path::new("debug.log")));
+        assert!(set.matches(Path::new("logs/2024/debug.log")));
+        assert!(!set.matches(Path::new("debug.log.txt")));
+    }
+
+    #[test]
+    fn plain_names_match_whole_names_at_any_depth() {
+        let set = patterns(&["config.json"]);
+        assert!(set.matches(Path::new("config.json")));
+        assert!(set.matches(Path::new("a/b/config.json")));
+        assert!(!set.matches(Path::new("a/myconfig.json")));
+        assert!(!set.matches(Path::new("a/config.json.bak")));
+    }
+
+    #[test]
+    fn substring_patterns_of_earlier_versions_are_written_as_globs() {
+        let extension = patterns(&[".json"]);
+        assert!(!extension.matches(Path::new("a/config.json")));
+        let extension = patterns(&["*.json"]);
+        assert!(extension.matches(Path::new("a/config.json")));
+
+        let part = patterns(&["*test*"]);
+        assert!(part.matches(Path::new("src/my_test_util.rs")));
+        assert!(part.matches(Path::new("tests/cli.rs")));
+        assert!(!part.matches(Path::new("src/main.rs")));
+    }
+
+    #[test]
+    fn plain_names_match_directories_at_any_depth() {
+        let set = patterns(&["target"]);
+        assert!(set.matches(Path::new("target/debug/build.rs")));
+        assert!(set.matches(Path::new("crates/app/target/debug/build.rs")));
+        assert!(!set.matches(Path::new("src/targets.rs")));
+    }
+
+    #[test]
+    fn plain_patterns_with_a_slash_match_as_substrings() {
+        let set = patterns(&["src/generated"]);
+        assert!(set.matches(Path::new("src/generated/api.rs")));
+        assert!(set.matches(Path::new("crates/app/src/generated_types.rs")));
+        assert!(!set.matches(Path::new("src/api.rs")));
+    }
+
+    #[test]
+    fn unused_patterns_are_those_that_decided_nothing() {
+        let set = patterns(&["*.log", "build", "*.tmp"]);
+        set.matches(Path::new("app.log"));
+        set.matches(Path::new("build/out.txt"));
+        assert_eq!(set.unused(), ["*.tmp"]);
+    }
+
+    #[test]
+    fn a_pattern_overridden_by_a_later_one_is_unused() {
+        let set = patterns(&["*.rs", "!*.rs"]);
+        set.matches(Path::new("main.rs"));
+        assert_eq!(set.unused(), ["*.rs"]);
+    }
+
+    #[test]
+    fn whole_directories_are_skipped_unless_a_negation_could_apply() {
+        assert!(patterns(&["node_modules"]).matches_dir(Path::new("web/node_modules")));
+        assert!(!patterns(&["node_modules"]).matches_dir(Path::new("web/src")));
+        // *.ext matches the directory's name, not the files in it
+        assert!(!patterns(&["*.d"]).matches_dir(Path::new("conf.d")));
+        assert!(!patterns(&["target", "!target/keep.rs"]).matches_dir(Path::new("target")));
+    }
+
+    #[test]
+    fn a_skipped_directory_counts_as_a_use_of_its_pattern() {
+        let set = patterns(&["node_modules", "dist"]);
+        assert!(set.matches_dir(Path::new("node_modules")));
+        assert_eq!(set.unused(), ["dist"]);
+    }
+
+    #[cfg(windows)]
+    #[test]
+    fn native_windows_paths_match_forward_slash_patterns() {
+        let set = patterns(&["src/", "docs/*.md"]);
+        assert!(set.matches(Path::new(r"src\main.rs")));
+        assert!(set.matches(Path::new(r"docs\guide.md")));
+        assert!(set.matches_dir(Path::new(r"project\src")));
+        assert!(patterns(&[r"out\combined.txt"]).matches(Path::new(r"out\combined.txt")));
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn a_backslash_is_part_of_a_unix_file_name() {
+        let set = patterns(&["src/"]);
+        assert!(set.matches(Path::new("src/main.rs")));
+        assert!(!set.matches(Path::new(r"src\main.rs")));
+    }
+}
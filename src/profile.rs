@@ -0,0 +1,64 @@
+use anyhow::Result;
+use std::path::Path;
+
+// Samples per second taken by the CPU profiler
+#[cfg(feature = "profiling")]
+const CPU_PROFILE_FREQUENCY: i32 = 1000;
+
+// Profiles the run for --cpu-profile and --mem-profile. Profiles are written
+// by `finish`, which callers should reach even when the run fails.
+#[cfg(feature = "profiling")]
+pub struct Profiler {
+    cpu: Option<(pprof::ProfilerGuard<'static>, std::path::PathBuf)>,
+    heap: Option<dhat::Profiler>,
+}
+
+#[cfg(feature = "profiling")]
+impl Profiler {
+    pub fn start(cpu_profile: Option<&Path>, mem_profile: Option<&Path>) -> Result<Self> {
+        let cpu = match cpu_profile {
+            Some(path) => Some((
+                pprof::ProfilerGuardBuilder::default()
+                    .frequency(CPU_PROFILE_FREQUENCY)
+                    .blocklist(&["libc", "libgcc", "pthread", "vdso"])
+                    .build()?,
+                path.to_path_buf(),
+            )),
+            None => None,
+        };
+        let heap = mem_profile.map(|path| dhat::Profiler::builder().file_name(path).build());
+        Ok(Profiler { cpu, heap })
+    }
+
+    pub fn finish(self) -> Result<()> {
+        use anyhow::Context;
+        use pprof::protos::Message;
+
+        if let Some((guard, path)) = self.cpu {
+            let mut content = Vec::new();
+            guard.report().build()?.pprof()?.encode(&mut content)?;
+            std::fs::write(&path, content)
+                .with_context(|| format!("Failed to write CPU profile: {:?}", path))?;
+        }
+        // The heap profile is written when the dhat profiler is dropped
+        drop(self.heap);
+        Ok(())
+    }
+}
+
+#[cfg(not(feature = "profiling"))]
+pub struct Profiler;
+
+#[cfg(not(feature = "profiling"))]
+impl Profiler {
+    pub fn start(cpu_profile: Option<&Path>, mem_profile: Option<&Path>) -> Result<Self> {
+        if cpu_profile.is_some() || mem_profile.is_some() {
+            anyhow::bail!("Profiling is unavailable: rebuild combiner with `--features profiling`");
+        }
+        Ok(Profiler)
+    }
+
+    pub fn finish(self) -> Result<()> {
+        Ok(())
+    }
+}
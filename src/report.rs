@@ -0,0 +1,213 @@
+use anyhow::{Context, Result};
+use std::fmt::Write as _;
+use std::fs;
+use std::path::Path;
+use std::time::Duration;
+
+use crate::config::TokenizationMethod;
+use crate::file_processing::ProcessingResult;
+use crate::output::{language_breakdown, summary_rows, token_percentage, top_files};
+
+pub fn write_markdown_report(
+    report_file: &Path,
+    result: &ProcessingResult,
+    output_file: &Path,
+    processing_time: Duration,
+    tokenization_method: &TokenizationMethod,
+) -> Result<()> {
+    let report = render_markdown_report(result, output_file, processing_time, tokenization_method);
+    fs::write(report_file, report)
+        .with_context(|| format!("Failed to write report: {:?}", report_file))
+}
+
+pub fn render_markdown_report(
+    result: &ProcessingResult,
+    output_file: &Path,
+    processing_time: Duration,
+    tokenization_method: &TokenizationMethod,
+) -> String {
+    let mut report = String::new();
+
+    writeln!(report, "# Combiner Report\n").unwrap();
+    writeln!(report, "## Statistics\n").unwrap();
+    writeln!(report, "| Statistic | Value |").unwrap();
+    writeln!(report, "| --- | --- |").unwrap();
+    for (statistic, value) in
+        summary_rows(result, output_file, processing_time, tokenization_method)
+    {
+        writeln!(
+            report,
+            "| {} | {} |",
+            escape_cell(statistic.trim()),
+            escape_cell(&value)
+        )
+        .unwrap();
+    }
+
+    writeln!(report, "\n## Languages\n").unwrap();
+    writeln!(report, "| Language | Files | Tokens |").unwrap();
+    writeln!(report, "| --- | ---: | ---: |").unwrap();
+    for (language, files, tokens) in language_breakdown(&result.file_stats) {
+        writeln!(report, "| {} | {} | {} |", language, files, tokens).unwrap();
+    }
+
+    writeln!(report, "\n## Top Files by Token Count\n").unwrap();
+    writeln!(
+        report,
+        "| File | Tokens | Size (bytes) | % of Total Tokens |"
+    )
+    .unwrap();
+    writeln!(report, "| --- | ---: | ---: | ---: |").unwrap();
+    for (file, tokens, size) in top_files(&result.file_stats) {
+        writeln!(
+            report,
+            "| {} | {} | {} | {:.0}% |",
+            escape_cell(&file),
+            tokens,
+            size,
+            token_percentage(tokens, result.total_tokens)
+        )
+        .unwrap();
+    }
+
+    report
+}
+
+fn escape_cell(value: &str) -> String {
+    value.replace('|', "\\|")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::file_processing::SkipReason;
+    use std::collections::BTreeMap;
+
+    fn result() -> ProcessingResult {
+        ProcessingResult {
+            files_processed: 3,
+            total_tokens: 1000,
+            file_stats: vec![
+                ("src/main.rs".to_string(), 600, 2400),
+                ("src/lib.rs".to_string(), 300, 1200),
+                ("README.md".to_string(), 100, 400),
+            ],
+            skipped_files: Vec::new(),
+            skip_counts: BTreeMap::new(),
+            skip_list: None,
+            redactions: None,
+            chunks: Vec::new(),
+            also_outputs: Vec::new(),
+            files_truncated: 0,
+            line_endings: None,
+            prompt_tokens: None,
+            toc_tokens: None,
+            separator_tokens: None,
+            chat_overhead_tokens: None,
+            delimiter_tokens: None,
+            files_transcoded: None,
+            files_resumed: None,
+            files_unchanged: None,
+            files_cut_to_budget: None,
+            total_words: None,
+            compact_tokens_saved: None,
+            files_retried: None,
+            empty_dirs: None,
+            flatten_renames: None,
+            estimated_size: 3000,
+            sample: None,
+            interrupted: false,
+            timings: None,
+            output_discarded: false,
+            unused_ignores: None,
+            tokenizer_totals: Vec::new(),
+        }
+    }
+
+    fn report() -> String {
+        report_of(&result())
+    }
+
+    fn report_of(result: &ProcessingResult) -> String {
+        render_markdown_report(
+            result,
+            Path::new("combined.txt"),
+            Duration::from_millis(5),
+            &TokenizationMethod::Cl100kBase,
+        )
+    }
+
+    #[test]
+    fn statistics_are_a_markdown_table_with_the_total_tokens() {
+        let report = report();
+        assert!(report.contains("## Statistics\n\n| Statistic | Value |\n| --- | --- |\n"));
+        assert!(report.contains("| Total Tokens | 1000 |\n"));
+        assert!(report.contains("| Files Processed | 3 |\n"));
+    }
+
+    #[test]
+    fn top_files_are_listed_by_token_count() {
+        let report = report();
+        let top_files = &report[report.find("## Top Files by Token Count").unwrap()..];
+        assert!(top_files
+            .contains("| src/main.rs | 600 | 2400 | 60% |\n| src/lib.rs | 300 | 1200 | 30% |\n"));
+    }
+
+    #[test]
+    fn languages_are_summed() {
+        assert!(report().contains("| Rust | 2 | 900 |\n| Markdown | 1 | 100 |\n"));
+    }
+
+    #[test]
+    fn pipes_in_cells_are_escaped() {
+        assert_eq!(escape_cell("a|b"), "a\\|b");
+    }
+
+    fn statistic(report: &str, statistic: &str) -> Option<String> {
+        let row = format!("| {} | ", statistic);
+        let start = report.find(&row)? + row.len();
+        Some(report[start..start + report[start..].find(" |")?].to_string())
+    }
+
+    #[test]
+    fn a_run_with_nothing_to_divide_shows_no_nan() {
+        let mut result = result();
+        result.total_tokens = 0;
+        result.file_stats = vec![("empty.rs".to_string(), 0, 0)];
+        result.sample = Some((0, 0));
+        result.tokenizer_totals = vec![(TokenizationMethod::O200kBase, 0)];
+        let report = report_of(&result);
+        assert!(!report.contains("NaN"), "report: {}", report);
+        assert_eq!(
+            statistic(&report, "Sampled Files").as_deref(),
+            Some("0 of 0 (0.0%)")
+        );
+        assert!(report.contains("| empty.rs | 0 | 0 | 0% |\n"));
+    }
+
+    #[test]
+    fn non_text_files_are_not_counted_as_ignored() {
+        let mut result = result();
+        result.skip_counts = BTreeMap::from([(SkipReason::NonText, 2), (SkipReason::Ignored, 1)]);
+        let report = report_of(&result);
+        assert_eq!(statistic(&report, "Files Not Text").as_deref(), Some("2"));
+        assert_eq!(statistic(&report, "Files Ignored").as_deref(), Some("1"));
+        assert_eq!(
+            statistic(&report, "Ignored (ignored)").as_deref(),
+            Some("1")
+        );
+        assert_eq!(statistic(&report, "Ignored (non-text)"), None);
+        assert_eq!(statistic(&report, "Total Files").as_deref(), Some("6"));
+    }
+
+    #[test]
+    fn resumed_and_unchanged_files_count_towards_the_total() {
+        let mut result = result();
+        result.files_resumed = Some(4);
+        result.files_unchanged = Some(5);
+        assert_eq!(
+            statistic(&report_of(&result), "Total Files").as_deref(),
+            Some("12")
+        );
+    }
+}
@@ -0,0 +1,164 @@
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::fs::{self, File, OpenOptions};
+use std::io::{self, BufWriter, Seek, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+// One line of a --resume progress file: a file whose entry was completely
+// written, and the length of the output once it was
+#[derive(Debug, Deserialize, Serialize)]
+struct Record {
+    path: PathBuf,
+    end: u64,
+}
+
+// What an earlier run with the same progress file got through
+#[derive(Debug, Default)]
+pub struct Resumed {
+    pub files: HashSet<PathBuf>,
+    // The output length after the last recorded file. Anything the output
+    // holds past it is a partly written entry.
+    pub output_len: Option<u64>,
+    // The length of the progress file up to its last complete line
+    pub progress_len: u64,
+}
+
+impl Resumed {
+    // A missing progress file means nothing has been done yet. A run that
+    // was killed may have left its last line half written, so lines that
+    // do not parse are ignored.
+    pub fn load(path: &Path) -> Result<Self> {
+        let progress_str = match fs::read_to_string(path) {
+            Ok(progress_str) => progress_str,
+            Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(Resumed::default()),
+            Err(e) => {
+                return Err(e).with_context(|| format!("Failed to read progress file: {:?}", path))
+            }
+        };
+        let mut resumed = Resumed {
+            progress_len: progress_str
+                .rfind('\n')
+                .map_or(0, |newline| newline as u64 + 1),
+            ..Default::default()
+        };
+        for record in progress_str
+            .lines()
+            .filter_map(|line| serde_json::from_str::<Record>(line).ok())
+        {
+            resumed.output_len = Some(record.end);
+            resumed.files.insert(record.path);
+        }
+        Ok(resumed)
+    }
+}
+
+// Records each file as its entry is written, so an interrupted run can be
+// picked up where it stopped
+pub struct Progress {
+    file: Mutex<File>,
+}
+
+impl Progress {
+    // Keeps the first `len` bytes of the progress file, so a new run passes
+    // 0 and a resumed one drops a half-written last line
+    pub fn open(path: &Path, len: u64) -> Result<Self> {
+        let mut file = OpenOptions::new()
+            .create(true)
+            .write(true)
+            .truncate(false)
+            .open(path)
+            .with_context(|| format!("Failed to open progress file: {:?}", path))?;
+        file.set_len(len)?;
+        file.seek(io::SeekFrom::End(0))?;
+        Ok(Progress {
+            file: Mutex::new(file),
+        })
+    }
+
+    // The output is flushed first, so a recorded file is always on disk
+    pub fn record(&self, path: &Path, output: &mut BufWriter<File>) -> Result<()> {
+        output.flush()?;
+        let record = Record {
+            path: path.to_path_buf(),
+            end: output.get_mut().stream_position()?,
+        };
+        let mut line = serde_json::to_string(&record)?;
+        line.push('\n');
+        self.file.lock().unwrap().write_all(line.as_bytes())?;
+        Ok(())
+    }
+}
+
+// Opens the output of an earlier run to append to it, cutting off whatever
+// was written after the last recorded file
+pub fn reopen_output(output_file: &Path, len: u64) -> Result<File> {
+    let mut file = OpenOptions::new()
+        .read(true)
+        .write(true)
+        .open(output_file)
+        .with_context(|| format!("Failed to reopen output file to resume: {:?}", output_file))?;
+    file.set_len(len)?;
+    file.seek(io::SeekFrom::End(0))?;
+    Ok(file)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn temp_path(name: &str) -> PathBuf {
+        std::env::temp_dir().join(format!("combiner-resume-{}-{}", std::process::id(), name))
+    }
+
+    #[test]
+    fn a_missing_progress_file_resumes_nothing() {
+        let resumed = Resumed::load(&temp_path("missing")).unwrap();
+        assert!(resumed.files.is_empty());
+        assert_eq!(resumed.output_len, None);
+        assert_eq!(resumed.progress_len, 0);
+    }
+
+    #[test]
+    fn recorded_files_are_resumed_and_a_half_written_line_is_dropped() {
+        let output_file = temp_path("output");
+        let progress_file = temp_path("progress");
+        let mut output = BufWriter::new(File::create(&output_file).unwrap());
+        let progress = Progress::open(&progress_file, 0).unwrap();
+        output.write_all(b"first entry\n").unwrap();
+        progress.record(Path::new("a.rs"), &mut output).unwrap();
+        output.write_all(b"second entry\n").unwrap();
+        progress.record(Path::new("b.rs"), &mut output).unwrap();
+        drop(progress);
+        let complete = fs::metadata(&progress_file).unwrap().len();
+        // A run killed while recording a third file
+        let mut progress = OpenOptions::new()
+            .append(true)
+            .open(&progress_file)
+            .unwrap();
+        progress.write_all(b"{\"path\":\"c.r").unwrap();
+
+        let resumed = Resumed::load(&progress_file).unwrap();
+        fs::remove_file(&output_file).unwrap();
+        fs::remove_file(&progress_file).unwrap();
+        assert_eq!(
+            resumed.files,
+            HashSet::from([PathBuf::from("a.rs"), PathBuf::from("b.rs")])
+        );
+        assert_eq!(resumed.output_len, Some(25));
+        assert_eq!(resumed.progress_len, complete);
+    }
+
+    #[test]
+    fn reopening_the_output_cuts_off_a_partly_written_entry() {
+        let output_file = temp_path("reopened");
+        fs::write(&output_file, "first entry\nsecond ent").unwrap();
+        let mut file = reopen_output(&output_file, 12).unwrap();
+        file.write_all(b"second entry\n").unwrap();
+        drop(file);
+        let output = fs::read_to_string(&output_file).unwrap();
+        fs::remove_file(&output_file).unwrap();
+        assert_eq!(output, "first entry\nsecond entry\n");
+    }
+}
@@ -0,0 +1,177 @@
+use anyhow::Result;
+use rayon::prelude::*;
+use std::cmp::Ordering;
+use std::path::Path;
+use std::time::SystemTime;
+
+use crate::config::{OrderWeight, SortKey};
+use crate::patterns::PatternSet;
+use crate::source::FileSource;
+
+// The globs of --order-weight, matched with the same engine as ignore
+// patterns. The first glob matching a file gives it its weight.
+pub struct OrderWeights {
+    rules: Vec<(PatternSet, i64)>,
+}
+
+impl OrderWeights {
+    pub fn new(order_weights: &[OrderWeight]) -> Result<Self> {
+        let rules = order_weights
+            .iter()
+            .map(|rule| Ok((PatternSet::new(&[rule.pattern.clone()])?, rule.weight)))
+            .collect::<Result<Vec<_>>>()?;
+        Ok(OrderWeights { rules })
+    }
+
+    fn weight(&self, path: &Path) -> Option<i64> {
+        self.rules
+            .iter()
+            .find(|(patterns, _)| patterns.matches(path))
+            .map(|(_, weight)| *weight)
+    }
+}
+
+// What files can be sorted by, looked up once per file
+struct SortInfo<'a> {
+    path: &'a Path,
+    weight: Option<i64>,
+    size: u64,
+    modified: Option<SystemTime>,
+}
+
+impl<'a> SortInfo<'a> {
+    fn new(source: &dyn FileSource, path: &'a Path, weights: &OrderWeights) -> Self {
+        SortInfo {
+            path,
+            weight: weights.weight(path),
+            size: source.len(path).unwrap_or(0),
+            modified: source
+                .metadata(path)
+                .and_then(|metadata| metadata.modified().ok()),
+        }
+    }
+}
+
+// Orders the files for --sort and --order-weight: by weight first, then by
+// the sort key. Files that compare equal stay in path order, so the output is
+// the same from run to run.
+pub fn sort_files(
+    source: &dyn FileSource,
+    files: &mut Vec<&Path>,
+    key: Option<SortKey>,
+    weights: &OrderWeights,
+) {
+    let mut infos: Vec<SortInfo> = files
+        .par_iter()
+        .map(|path| SortInfo::new(source, path, weights))
+        .collect();
+    infos.sort_by(|a, b| {
+        compare_weights(a.weight, b.weight)
+            .then_with(|| key.map_or(Ordering::Equal, |key| compare(key, a, b)))
+            .then_with(|| a.path.cmp(b.path))
+    });
+    *files = infos.into_iter().map(|info| info.path).collect();
+}
+
+// Lowest weight first; files no glob matched come after all weighted files
+fn compare_weights(a: Option<i64>, b: Option<i64>) -> Ordering {
+    match (a, b) {
+        (Some(a), Some(b)) => a.cmp(&b),
+        (Some(_), None) => Ordering::Less,
+        (None, Some(_)) => Ordering::Greater,
+        (None, None) => Ordering::Equal,
+    }
+}
+
+// A new sort key only needs a SortKey variant and an arm here
+fn compare(key: SortKey, a: &SortInfo, b: &SortInfo) -> Ordering {
+    match key {
+        SortKey::Path => a.path.cmp(b.path),
+        // Largest first
+        SortKey::Size => b.size.cmp(&a.size),
+        // Newest first; files without a modification time come last
+        SortKey::Mtime => b.modified.cmp(&a.modified),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::source::MemoryFiles;
+
+    fn sorted(key: Option<SortKey>, order_weights: &[OrderWeight]) -> Vec<String> {
+        let mut source = MemoryFiles::new();
+        source.insert("src/b.rs", "b".repeat(10));
+        source.insert("src/a.rs", "a".repeat(30));
+        source.insert("README.md", "r".repeat(20));
+        let mut files = vec![
+            Path::new("src/b.rs"),
+            Path::new("README.md"),
+            Path::new("src/a.rs"),
+        ];
+        let weights = OrderWeights::new(order_weights).unwrap();
+        sort_files(&source, &mut files, key, &weights);
+        files
+            .iter()
+            .map(|path| path.to_string_lossy().into_owned())
+            .collect()
+    }
+
+    #[test]
+    fn sorts_by_path_or_by_size() {
+        assert_eq!(
+            sorted(Some(SortKey::Path), &[]),
+            ["README.md", "src/a.rs", "src/b.rs"]
+        );
+        assert_eq!(
+            sorted(Some(SortKey::Size), &[]),
+            ["src/a.rs", "README.md", "src/b.rs"]
+        );
+    }
+
+    #[test]
+    fn files_without_a_modification_time_keep_path_order() {
+        assert_eq!(
+            sorted(Some(SortKey::Mtime), &[]),
+            ["README.md", "src/a.rs", "src/b.rs"]
+        );
+    }
+
+    #[test]
+    fn weighted_files_come_first_and_the_first_matching_glob_wins() {
+        let weights = [
+            OrderWeight {
+                pattern: "README.md".to_string(),
+                weight: 1,
+            },
+            OrderWeight {
+                pattern: "src/**".to_string(),
+                weight: 2,
+            },
+            OrderWeight {
+                pattern: "src/b.rs".to_string(),
+                weight: 0,
+            },
+        ];
+        assert_eq!(
+            sorted(Some(SortKey::Size), &weights),
+            ["README.md", "src/a.rs", "src/b.rs"]
+        );
+        assert_eq!(
+            sorted(None, &weights[..1]),
+            ["README.md", "src/a.rs", "src/b.rs"]
+        );
+    }
+
+    #[test]
+    fn unmatched_files_come_after_weighted_ones() {
+        let weights = [OrderWeight {
+            pattern: "src/b.rs".to_string(),
+            weight: 5,
+        }];
+        assert_eq!(
+            sorted(None, &weights),
+            ["src/b.rs", "README.md", "src/a.rs"]
+        );
+    }
+}
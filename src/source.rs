@@ -0,0 +1,437 @@
+use anyhow::{Context, Result};
+use git2::{ObjectType, Oid, Repository, TreeWalkMode, TreeWalkResult};
+use std::collections::BTreeMap;
+use std::fs::{self, File};
+use std::io::{self, Cursor, Read};
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use walkdir::WalkDir;
+
+use crate::interrupt::interrupted;
+
+// Where the files to combine are found and read from. `OsFiles` walks the
+// real filesystem; `MemoryFiles` serves files held in memory, so the pipeline
+// can run without touching disk (e.g. in tests or benchmarks); and
+// `GitTrackedFiles` serves the files committed at HEAD of a git repository.
+pub trait FileSource: Sync {
+    // Every file under `root` (or `root` itself when it is a file), leaving
+    // out the directories below `root` for which `skip_dir` returns true
+    // along with everything in them
+    fn files(&self, root: &Path, skip_dir: &dyn Fn(&Path) -> bool) -> Vec<PathBuf>;
+
+    // Like `files`, but also reports the paths that could not be walked
+    // (e.g. a directory without read permission) rather than leaving them out
+    fn walk(&self, root: &Path, skip_dir: &dyn Fn(&Path) -> bool) -> Walk {
+        Walk {
+            files: self.files(root, skip_dir),
+            errors: Vec::new(),
+        }
+    }
+
+    fn open(&self, path: &Path) -> io::Result<Box<dyn Read + '_>>;
+
+    fn read(&self, path: &Path) -> io::Result<Vec<u8>> {
+        let mut bytes = Vec::new();
+        self.open(path)?.read_to_end(&mut bytes)?;
+        Ok(bytes)
+    }
+
+    fn len(&self, path: &Path) -> io::Result<u64>;
+
+    // Whether `path` names a single file rather than a directory of them
+    fn is_file(&self, path: &Path) -> bool {
+        self.files(path, &|_| false) == [path]
+    }
+
+    // The path with links and `.`/`..` resolved, used to spot the same file
+    // reached through different input roots
+    fn canonicalize(&self, path: &Path) -> PathBuf {
+        path.to_path_buf()
+    }
+
+    // Whether `path` is a symbolic link rather than the file itself
+    fn is_symlink(&self, _path: &Path) -> bool {
+        false
+    }
+
+    // Permissions and modification time, where the source has them
+    fn metadata(&self, _path: &Path) -> Option<fs::Metadata> {
+        None
+    }
+}
+
+// The files found under one input, and each path that could not be walked
+// with its error
+pub struct Walk {
+    pub files: Vec<PathBuf>,
+    pub errors: Vec<(PathBuf, String)>,
+}
+
+pub struct OsFiles;
+
+impl FileSource for OsFiles {
+    fn files(&self, root: &Path, skip_dir: &dyn Fn(&Path) -> bool) -> Vec<PathBuf> {
+        self.walk(root, skip_dir).files
+    }
+
+    fn walk(&self, root: &Path, skip_dir: &dyn Fn(&Path) -> bool) -> Walk {
+        let mut walk = Walk {
+            files: Vec::new(),
+            errors: Vec::new(),
+        };
+        let entries = WalkDir::new(root)
+            .into_iter()
+            .filter_entry(|entry| {
+                entry.depth() == 0 || !entry.file_type().is_dir() || !skip_dir(entry.path())
+            })
+            .take_while(|_| !interrupted());
+        for entry in entries {
+            match entry {
+                // Links to files are combined like the files themselves;
+                // links to directories are not followed
+                Ok(entry)
+                    if entry.file_type().is_file()
+                        || (entry.path_is_symlink() && entry.path().is_file()) =>
+                {
+                    walk.files.push(entry.into_path())
+                }
+                Ok(_) => {}
+                Err(error) => {
+                    let path = error.path().unwrap_or(root).to_path_buf();
+                    walk.errors.push((path, error.to_string()));
+                }
+            }
+        }
+        walk
+    }
+
+    fn open(&self, path: &Path) -> io::Result<Box<dyn Read + '_>> {
+        Ok(Box::new(File::open(path)?))
+    }
+
+    fn read(&self, path: &Path) -> io::Result<Vec<u8>> {
+        fs::read(path)
+    }
+
+    fn len(&self, path: &Path) -> io::Result<u64> {
+        fs::metadata(path).map(|metadata| metadata.len())
+    }
+
+    fn is_file(&self, path: &Path) -> bool {
+        path.is_file()
+    }
+
+    fn canonicalize(&self, path: &Path) -> PathBuf {
+        fs::canonicalize(path).unwrap_or_else(|_| path.to_path_buf())
+    }
+
+    fn is_symlink(&self, path: &Path) -> bool {
+        fs::symlink_metadata(path).map_or(false, |metadata| metadata.file_type().is_symlink())
+    }
+
+    fn metadata(&self, path: &Path) -> Option<fs::Metadata> {
+        fs::metadata(path).ok()
+    }
+}
+
+#[derive(Default)]
+pub struct MemoryFiles {
+    files: BTreeMap<PathBuf, Vec<u8>>,
+}
+
+impl MemoryFiles {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn insert(&mut self, path: impl Into<PathBuf>, contents: impl Into<Vec<u8>>) {
+        self.files.insert(path.into(), contents.into());
+    }
+
+    fn get(&self, path: &Path) -> io::Result<&[u8]> {
+        self.files
+            .get(path)
+            .map(Vec::as_slice)
+            .ok_or_else(|| io::Error::new(io::ErrorKind::NotFound, "file not found"))
+    }
+}
+
+impl FileSource for MemoryFiles {
+    fn files(&self, root: &Path, skip_dir: &dyn Fn(&Path) -> bool) -> Vec<PathBuf> {
+        self.files
+            .keys()
+            .filter(|path| path.starts_with(root))
+            .filter(|path| {
+                !path
+                    .ancestors()
+                    .skip(1)
+                    .take_while(|dir| *dir != root)
+                    .any(|dir| skip_dir(dir))
+            })
+            .cloned()
+            .collect()
+    }
+
+    fn open(&self, path: &Path) -> io::Result<Box<dyn Read + '_>> {
+        Ok(Box::new(self.get(path)?))
+    }
+
+    fn len(&self, path: &Path) -> io::Result<u64> {
+        self.get(path).map(|contents| contents.len() as u64)
+    }
+
+    fn is_file(&self, path: &Path) -> bool {
+        self.files.contains_key(path)
+    }
+}
+
+// Git's mode for a symbolic link stored in a tree
+const GIT_SYMLINK_MODE: i32 = 0o120000;
+
+// The files committed at HEAD of the repository holding the inputs, read
+// from the repository itself rather than the working copy. Untracked and
+// modified files therefore never show up, and a bare repository works the
+// same as a checkout. Symbolic links and submodules are left out.
+pub struct GitTrackedFiles {
+    repo: Mutex<Repository>,
+    // Each file under the input it was found in, with its path in the tree
+    files: BTreeMap<PathBuf, (PathBuf, Oid)>,
+}
+
+impl GitTrackedFiles {
+    // Lists HEAD's tree of the repository containing the first input. Every
+    // input must be inside that repository (or be the bare repository).
+    pub fn open(inputs: &[PathBuf]) -> Result<Self> {
+        let repo = Repository::discover(&inputs[0])
+            .with_context(|| format!("Not in a git repository: {:?}", inputs[0]))?;
+        let base = if repo.is_bare() {
+            repo.path()
+        } else {
+            repo.workdir().unwrap_or(repo.path())
+        };
+        let base = fs::canonicalize(base)?;
+
+        // Resolving HEAD this way works on a branch and on a detached HEAD alike
+        let tree = repo
+            .head()
+            .and_then(|head| head.peel_to_tree())
+            .with_context(|| format!("Failed to read HEAD of {:?}", base))?;
+        let mut tracked = Vec::new();
+        tree.walk(TreeWalkMode::PreOrder, |dir, entry| {
+            if let (Some(ObjectType::Blob), Some(name)) = (entry.kind(), entry.name()) {
+                if entry.filemode() != GIT_SYMLINK_MODE {
+                    tracked.push((Path::new(dir).join(name), entry.id()));
+                }
+            }
+            TreeWalkResult::Ok
+        })?;
+
+        let mut files = BTreeMap::new();
+        for input in inputs {
+            let prefix = fs::canonicalize(input)
+                .ok()
+                .and_then(|input| input.strip_prefix(&base).ok().map(Path::to_path_buf))
+                .with_context(|| format!("Input is not inside the repository at {:?}", base))?;
+            for (tree_path, oid) in &tracked {
+                if let Ok(rest) = tree_path.strip_prefix(&prefix) {
+                    files.insert(input.join(rest), (tree_path.clone(), *oid));
+                }
+            }
+        }
+
+        drop(tree);
+        Ok(GitTrackedFiles {
+            repo: Mutex::new(repo),
+            files,
+        })
+    }
+
+    fn oid(&self, path: &Path) -> io::Result<Oid> {
+        self.files
+            .get(path)
+            .map(|(_, oid)| *oid)
+            .ok_or_else(|| io::Error::new(io::ErrorKind::NotFound, "file not tracked"))
+    }
+
+    fn get(&self, path: &Path) -> io::Result<Vec<u8>> {
+        let oid = self.oid(path)?;
+        let repo = self.repo.lock().unwrap();
+        let blob = repo
+            .find_blob(oid)
+            .map_err(|e| io::Error::new(io::ErrorKind::Other, e))?;
+        Ok(blob.content().to_vec())
+    }
+}
+
+impl FileSource for GitTrackedFiles {
+    fn files(&self, root: &Path, skip_dir: &dyn Fn(&Path) -> bool) -> Vec<PathBuf> {
+        self.files
+            .keys()
+            .filter(|path| path.starts_with(root))
+            .filter(|path| {
+                !path
+                    .ancestors()
+                    .skip(1)
+                    .take_while(|dir| *dir != root)
+                    .any(|dir| skip_dir(dir))
+            })
+            .cloned()
+            .collect()
+    }
+
+    fn open(&self, path: &Path) -> io::Result<Box<dyn Read + '_>> {
+        Ok(Box::new(Cursor::new(self.get(path)?)))
+    }
+
+    fn read(&self, path: &Path) -> io::Result<Vec<u8>> {
+        self.get(path)
+    }
+
+    // Only the object's header is read, so the blob is never copied
+    fn len(&self, path: &Path) -> io::Result<u64> {
+        let oid = self.oid(path)?;
+        let repo = self.repo.lock().unwrap();
+        let (size, _) = repo
+            .odb()
+            .and_then(|odb| odb.read_header(oid))
+            .map_err(|e| io::Error::new(io::ErrorKind::Other, e))?;
+        Ok(size as u64)
+    }
+
+    fn is_file(&self, path: &Path) -> bool {
+        self.files.contains_key(path)
+    }
+
+    // The same file reached through overlapping inputs has one tree path
+    fn canonicalize(&self, path: &Path) -> PathBuf {
+        self.files
+            .get(path)
+            .map(|(tree_path, _)| tree_path.clone())
+            .unwrap_or_else(|| path.to_path_buf())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn memory_files_lists_only_the_files_under_the_root() {
+        let mut files = MemoryFiles::new();
+        files.insert("repo/src/main.rs", "fn main() {}\n");
+        files.insert("repo/README.md", "# Example\n");
+        files.insert("repository/notes.txt", "not under repo\n");
+        assert_eq!(
+            files.files(Path::new("repo"), &|_| false),
+            [
+                PathBuf::from("repo/README.md"),
+                PathBuf::from("repo/src/main.rs")
+            ]
+        );
+        assert_eq!(
+            files.files(Path::new("repo/README.md"), &|_| false),
+            [PathBuf::from("repo/README.md")]
+        );
+    }
+
+    #[test]
+    fn memory_files_are_read_back() {
+        let mut files = MemoryFiles::new();
+        files.insert("repo/main.rs", "fn main() {}\n");
+        assert_eq!(
+            files.read(Path::new("repo/main.rs")).unwrap(),
+            b"fn main() {}\n"
+        );
+        assert_eq!(files.len(Path::new("repo/main.rs")).unwrap(), 13);
+        let error = files.read(Path::new("repo/missing.rs")).unwrap_err();
+        assert_eq!(error.kind(), io::ErrorKind::NotFound);
+    }
+
+    #[test]
+    fn only_stored_paths_are_memory_files() {
+        let mut files = MemoryFiles::new();
+        files.insert("repo/main.rs", "fn main() {}\n");
+        assert!(files.is_file(Path::new("repo/main.rs")));
+        assert!(!files.is_file(Path::new("repo")));
+        assert!(!files.is_file(Path::new("repo/missing.rs")));
+    }
+
+    #[test]
+    fn memory_files_leave_out_skipped_directories() {
+        let mut files = MemoryFiles::new();
+        files.insert("repo/src/main.rs", "fn main() {}\n");
+        files.insert("repo/node_modules/dep/index.js", "module.exports = {};\n");
+        assert_eq!(
+            files.files(Path::new("repo"), &|dir| dir.ends_with("node_modules")),
+            [PathBuf::from("repo/src/main.rs")]
+        );
+    }
+
+    #[test]
+    fn skipped_directories_are_not_walked() {
+        let root = std::env::temp_dir().join(format!("combiner-skip-dir-{}", std::process::id()));
+        let _ = fs::remove_dir_all(&root);
+        for i in 0..20 {
+            let dir = root
+                .join("node_modules")
+                .join(format!("dep{}", i))
+                .join("lib");
+            fs::create_dir_all(&dir).unwrap();
+            fs::write(dir.join("index.js"), "module.exports = {};\n").unwrap();
+        }
+        fs::create_dir_all(root.join("src")).unwrap();
+        fs::write(root.join("src/main.rs"), "fn main() {}\n").unwrap();
+
+        let visited = std::sync::Mutex::new(Vec::new());
+        let files = OsFiles.files(&root, &|dir| {
+            visited.lock().unwrap().push(dir.to_path_buf());
+            dir.ends_with("node_modules")
+        });
+        fs::remove_dir_all(&root).unwrap();
+
+        assert_eq!(files, [root.join("src/main.rs")]);
+        // Only node_modules itself is looked at, none of the directories in it
+        let visited = visited.into_inner().unwrap();
+        assert_eq!(
+            visited
+                .iter()
+                .filter(|dir| dir.starts_with(root.join("node_modules")))
+                .count(),
+            1
+        );
+    }
+
+    #[test]
+    fn git_tracked_files_have_the_committed_length() {
+        let root = std::env::temp_dir().join(format!("combiner-git-len-{}", std::process::id()));
+        let _ = fs::remove_dir_all(&root);
+        fs::create_dir_all(&root).unwrap();
+        fs::write(root.join("main.rs"), "fn main() {}\n").unwrap();
+        let git = |args: &[&str]| {
+            let status = std::process::Command::new("git")
+                .arg("-C")
+                .arg(&root)
+                .args(["-c", "user.name=Test", "-c", "user.email=test@example.com"])
+                .args(args)
+                .output()
+                .unwrap()
+                .status;
+            assert!(status.success(), "git {:?} failed", args);
+        };
+        git(&["init", "-q"]);
+        git(&["add", "main.rs"]);
+        git(&["commit", "-q", "-m", "Add main"]);
+        fs::write(root.join("main.rs"), "fn main() { changed(); }\n").unwrap();
+
+        let files = GitTrackedFiles::open(&[root.clone()]);
+        let len = files.as_ref().map(|files| files.len(&root.join("main.rs")));
+        let missing = files.as_ref().map(|files| files.len(&root.join("lib.rs")));
+        fs::remove_dir_all(&root).unwrap();
+
+        assert_eq!(len.unwrap().unwrap(), "fn main() {}\n".len() as u64);
+        assert_eq!(
+            missing.unwrap().unwrap_err().kind(),
+            io::ErrorKind::NotFound
+        );
+    }
+}
@@ -0,0 +1,259 @@
+use anyhow::{Context, Result};
+use serde::Serialize;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::config::SplitCohesion;
+
+#[derive(Debug)]
+pub struct Chunk {
+    pub path: PathBuf,
+    pub files: Vec<(String, usize)>,
+    pub tokens: usize,
+}
+
+// Returns the chunk file for a 1-based index, e.g. `out.txt` -> `out_part2.txt`.
+pub fn chunk_path(output_file: &Path, index: usize) -> PathBuf {
+    let stem = output_file
+        .file_stem()
+        .map(|stem| stem.to_string_lossy().into_owned())
+        .unwrap_or_default();
+    let file_name = match output_file.extension() {
+        Some(ext) => format!("{}_part{}.{}", stem, index, ext.to_string_lossy()),
+        None => format!("{}_part{}", stem, index),
+    };
+    output_file.with_file_name(file_name)
+}
+
+// Returns the file listing what went into each chunk, e.g. `out.txt` ->
+// `out_manifest.json`.
+pub fn chunk_manifest_path(output_file: &Path) -> PathBuf {
+    let stem = output_file
+        .file_stem()
+        .map(|stem| stem.to_string_lossy().into_owned())
+        .unwrap_or_default();
+    output_file.with_file_name(format!("{}_manifest.json", stem))
+}
+
+#[derive(Serialize)]
+struct ChunkManifest<'a> {
+    chunks: Vec<ChunkEntry<'a>>,
+}
+
+#[derive(Serialize)]
+struct ChunkEntry<'a> {
+    file: String,
+    tokens: usize,
+    files: Vec<FileEntry<'a>>,
+}
+
+#[derive(Serialize)]
+struct FileEntry<'a> {
+    path: &'a str,
+    tokens: usize,
+}
+
+// Writes the chunk manifest: each chunk's file name (relative to the
+// manifest) with the files it holds and their token counts, in chunk order.
+pub fn write_chunk_manifest(manifest_file: &Path, chunks: &[Chunk]) -> Result<()> {
+    let manifest = ChunkManifest {
+        chunks: chunks
+            .iter()
+            .map(|chunk| ChunkEntry {
+                file: chunk
+                    .path
+                    .file_name()
+                    .map(|name| name.to_string_lossy().into_owned())
+                    .unwrap_or_default(),
+                tokens: chunk.tokens,
+                files: chunk
+                    .files
+                    .iter()
+                    .map(|(path, tokens)| FileEntry {
+                        path,
+                        tokens: *tokens,
+                    })
+                    .collect(),
+            })
+            .collect(),
+    };
+    let manifest_str = serde_json::to_string_pretty(&manifest)?;
+    fs::write(manifest_file, manifest_str)
+        .with_context(|| format!("Failed to write chunk manifest: {:?}", manifest_file))
+}
+
+// Glob matching every chunk file produced for `output_file`.
+pub fn chunk_glob(output_file: &Path) -> String {
+    chunk_path(output_file, 0)
+        .file_name()
+        .map(|name| name.to_string_lossy().replacen("_part0", "_part*", 1))
+        .unwrap_or_default()
+}
+
+// Groups files (given as path and token count, in output order) into chunks
+// of at most `max_tokens`. A single file larger than the limit gets a chunk of
+// its own. Returns the indices of the files in each chunk.
+pub fn plan_chunks(
+    files: &[(String, usize)],
+    max_tokens: usize,
+    cohesion: SplitCohesion,
+) -> Vec<Vec<usize>> {
+    let mut chunks: Vec<Vec<usize>> = Vec::new();
+    let mut current: Vec<usize> = Vec::new();
+    let mut current_tokens = 0;
+
+    for group in group_files(files, cohesion) {
+        let group_tokens: usize = group.iter().map(|&index| files[index].1).sum();
+
+        // Keep the whole group together when it fits in the current chunk or
+        // in a fresh one; otherwise fall back to filling greedily.
+        if current_tokens + group_tokens <= max_tokens || group_tokens <= max_tokens {
+            if current_tokens + group_tokens > max_tokens && !current.is_empty() {
+                chunks.push(std::mem::take(&mut current));
+                current_tokens = 0;
+            }
+            current.extend(group);
+            current_tokens += group_tokens;
+            continue;
+        }
+
+        for index in group {
+            let tokens = files[index].1;
+            if current_tokens + tokens > max_tokens && !current.is_empty() {
+                chunks.push(std::mem::take(&mut current));
+                current_tokens = 0;
+            }
+            current.push(index);
+            current_tokens += tokens;
+        }
+    }
+
+    if !current.is_empty() {
+        chunks.push(current);
+    }
+    chunks
+}
+
+fn group_files(files: &[(String, usize)], cohesion: SplitCohesion) -> Vec<Vec<usize>> {
+    match cohesion {
+        SplitCohesion::Greedy => (0..files.len()).map(|index| vec![index]).collect(),
+        SplitCohesion::Dir => {
+            let mut groups: Vec<(Option<&Path>, Vec<usize>)> = Vec::new();
+            for (index, (path, _)) in files.iter().enumerate() {
+                let dir = Path::new(path).parent();
+                match groups.last_mut() {
+                    Some((last_dir, members)) if *last_dir == dir => members.push(index),
+                    _ => groups.push((dir, vec![index])),
+                }
+            }
+            groups.into_iter().map(|(_, members)| members).collect()
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn files(files: &[(&str, usize)]) -> Vec<(String, usize)> {
+        files
+            .iter()
+            .map(|(path, tokens)| (path.to_string(), *tokens))
+            .collect()
+    }
+
+    #[test]
+    fn chunk_files_are_numbered_before_the_extension() {
+        assert_eq!(
+            chunk_path(Path::new("out/combined.txt"), 2),
+            Path::new("out/combined_part2.txt")
+        );
+        assert_eq!(
+            chunk_path(Path::new("combined"), 1),
+            Path::new("combined_part1")
+        );
+        assert_eq!(
+            chunk_glob(Path::new("out/combined.txt")),
+            "combined_part*.txt"
+        );
+    }
+
+    #[test]
+    fn greedy_chunks_fill_up_to_the_limit() {
+        let files = files(&[("a", 40), ("b", 40), ("c", 40), ("d", 150)]);
+        assert_eq!(
+            plan_chunks(&files, 100, SplitCohesion::Greedy),
+            [vec![0, 1], vec![2], vec![3]]
+        );
+    }
+
+    #[test]
+    fn a_directory_is_kept_together_when_it_fits_in_a_chunk() {
+        let files = files(&[
+            ("src/a.rs", 30),
+            ("src/b.rs", 30),
+            ("tests/a.rs", 30),
+            ("tests/b.rs", 30),
+        ]);
+        assert_eq!(
+            plan_chunks(&files, 100, SplitCohesion::Dir),
+            [vec![0, 1], vec![2, 3]]
+        );
+        assert_eq!(
+            plan_chunks(&files, 100, SplitCohesion::Greedy),
+            [vec![0, 1, 2], vec![3]]
+        );
+    }
+
+    #[test]
+    fn a_directory_larger_than_the_limit_overflows_into_new_chunks() {
+        let files = files(&[
+            ("docs/a.md", 20),
+            ("src/a.rs", 60),
+            ("src/b.rs", 60),
+            ("src/c.rs", 60),
+        ]);
+        assert_eq!(
+            plan_chunks(&files, 100, SplitCohesion::Dir),
+            [vec![0, 1], vec![2], vec![3]]
+        );
+    }
+
+    #[test]
+    fn the_manifest_lists_each_chunk_with_its_files() {
+        let manifest_file = std::env::temp_dir().join(format!(
+            "combiner-chunk-manifest-{}.json",
+            std::process::id()
+        ));
+        let chunks = [Chunk {
+            path: Path::new("out").join("combined_part1.txt"),
+            files: vec![("src/a.rs".to_string(), 30), ("src/b.rs".to_string(), 20)],
+            tokens: 50,
+        }];
+        write_chunk_manifest(&manifest_file, &chunks).unwrap();
+        let manifest: serde_json::Value =
+            serde_json::from_str(&fs::read_to_string(&manifest_file).unwrap()).unwrap();
+        fs::remove_file(&manifest_file).unwrap();
+        assert_eq!(
+            manifest,
+            serde_json::json!({
+                "chunks": [{
+                    "file": "combined_part1.txt",
+                    "tokens": 50,
+                    "files": [
+                        {"path": "src/a.rs", "tokens": 30},
+                        {"path": "src/b.rs", "tokens": 20},
+                    ],
+                }],
+            })
+        );
+    }
+
+    #[test]
+    fn the_manifest_is_named_after_the_output() {
+        assert_eq!(
+            chunk_manifest_path(Path::new("out/combined.txt")),
+            Path::new("out/combined_manifest.json")
+        );
+    }
+}
@@ -0,0 +1,65 @@
+use anyhow::{Context, Result};
+use sha2::{Digest, Sha256};
+use std::fs::{self, File};
+use std::io;
+use std::path::{Path, PathBuf};
+
+pub const EXIT_UNCHANGED: i32 = 3;
+
+pub fn stamp_path(output_file: &Path) -> PathBuf {
+    append_extension(output_file, "sha256")
+}
+
+// With --skip-unchanged the output is written here first so the existing
+// output is left untouched when nothing changed.
+pub fn staging_path(output_file: &Path) -> PathBuf {
+    append_extension(output_file, "tmp")
+}
+
+fn append_extension(path: &Path, extension: &str) -> PathBuf {
+    let mut path = path.as_os_str().to_owned();
+    path.push(".");
+    path.push(extension);
+    PathBuf::from(path)
+}
+
+pub fn hash_file(path: &Path) -> Result<String> {
+    let mut file = File::open(path)
+        .with_context(|| format!("Failed to open output for hashing: {:?}", path))?;
+    let mut hasher = Sha256::new();
+    io::copy(&mut file, &mut hasher)?;
+    Ok(format!("{:x}", hasher.finalize()))
+}
+
+fn read_stamp(stamp_file: &Path) -> Option<String> {
+    fs::read_to_string(stamp_file)
+        .ok()?
+        .split_whitespace()
+        .next()
+        .map(|hash| hash.to_string())
+}
+
+// Hashes the freshly written output and records it next to `output_file` in
+// sha256sum format. Returns true if `skip_unchanged` is set and the hash
+// matches the existing stamp, in which case the staged output is discarded.
+pub fn finalize(output_file: &Path, written_file: &Path, skip_unchanged: bool) -> Result<bool> {
+    let hash = hash_file(written_file)?;
+    let stamp_file = stamp_path(output_file);
+
+    if skip_unchanged {
+        if output_file.exists() && read_stamp(&stamp_file).as_deref() == Some(hash.as_str()) {
+            fs::remove_file(written_file)?;
+            return Ok(true);
+        }
+        fs::rename(written_file, output_file)
+            .with_context(|| format!("Failed to replace output file: {:?}", output_file))?;
+    }
+
+    let file_name = output_file
+        .file_name()
+        .map(|name| name.to_string_lossy().into_owned())
+        .unwrap_or_default();
+    fs::write(&stamp_file, format!("{}  {}\n", hash, file_name))
+        .with_context(|| format!("Failed to write stamp file: {:?}", stamp_file))?;
+    Ok(false)
+}
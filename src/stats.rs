@@ -0,0 +1,80 @@
+use anyhow::{Context, Result};
+use serde::Serialize;
+use std::fs;
+use std::path::Path;
+use std::time::Duration;
+
+use crate::config::TokenizationMethod;
+use crate::file_processing::ProcessingResult;
+use crate::manifest::Manifest;
+use crate::SCHEMA_VERSION;
+
+// The statistics written by --output-stats-only. The per-file token counts
+// are laid out as in a manifest, so a stats file also works with --compare.
+#[derive(Debug, Serialize)]
+pub struct Stats {
+    pub schema_version: u32,
+    pub recorded_at: String,
+    pub tokenization_method: String,
+    pub files_processed: usize,
+    pub files_unreadable: usize,
+    pub processing_seconds: f64,
+    #[serde(flatten)]
+    pub manifest: Manifest,
+}
+
+impl Stats {
+    pub fn from_result(
+        result: &ProcessingResult,
+        processing_time: Duration,
+        tokenization_method: &TokenizationMethod,
+    ) -> Self {
+        Stats {
+            schema_version: SCHEMA_VERSION,
+            recorded_at: chrono::Local::now().to_rfc3339(),
+            tokenization_method: tokenization_method.to_string(),
+            files_processed: result.files_processed,
+            files_unreadable: result.skipped_files.len(),
+            processing_seconds: processing_time.as_secs_f64(),
+            manifest: Manifest::from_stats(result.total_tokens, &result.file_stats),
+        }
+    }
+
+    pub fn save(&self, path: &Path) -> Result<()> {
+        let stats_str = serde_json::to_string_pretty(self)?;
+        fs::write(path, stats_str).with_context(|| format!("Failed to write stats: {:?}", path))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn a_stats_file_loads_as_a_manifest() {
+        let stats = Stats {
+            schema_version: SCHEMA_VERSION,
+            recorded_at: "2024-01-01T00:00:00+00:00".to_string(),
+            tokenization_method: "cl100k_base".to_string(),
+            files_processed: 2,
+            files_unreadable: 0,
+            processing_seconds: 0.5,
+            manifest: Manifest::from_stats(
+                30,
+                &[("a.rs".to_string(), 10, 40), ("b.rs".to_string(), 20, 80)],
+            ),
+        };
+        let path = std::env::temp_dir().join(format!("combiner-stats-{}.json", std::process::id()));
+        stats.save(&path).unwrap();
+
+        let manifest = Manifest::load(&path);
+        let saved: serde_json::Value =
+            serde_json::from_str(&fs::read_to_string(&path).unwrap()).unwrap();
+        fs::remove_file(&path).unwrap();
+        assert_eq!(saved["schema_version"], SCHEMA_VERSION);
+        let manifest = manifest.unwrap();
+        assert_eq!(manifest.total_tokens, 30);
+        assert_eq!(manifest.files["a.rs"], 10);
+        assert_eq!(manifest.files["b.rs"], 20);
+    }
+}
@@ -0,0 +1,388 @@
+use std::path::Path;
+use unicode_normalization::{is_nfc, UnicodeNormalization};
+
+use crate::config::UnicodeForm;
+
+// A content transformation applied to each file before it is written and
+// tokenized. Transformers run in order, each receiving the previous output.
+pub trait LineTransformer: Send + Sync {
+    fn transform(&self, path: &Path, content: &str) -> String;
+}
+
+pub fn apply_transformers(
+    transformers: &[Box<dyn LineTransformer>],
+    path: &Path,
+    content: String,
+) -> String {
+    transformers.iter().fold(content, |content, transformer| {
+        transformer.transform(path, &content)
+    })
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum ImportStyle {
+    Go,
+    Python,
+    JavaScript,
+    Rust,
+}
+
+// Removes the import block at the top of a file. Only the leading header is
+// touched: blank lines and comments there are kept, and the first line that
+// is neither ends the header so nothing past it can be removed.
+pub struct StripImports;
+
+impl LineTransformer for StripImports {
+    fn transform(&self, path: &Path, content: &str) -> String {
+        let style = match import_style(path) {
+            Some(style) => style,
+            None => return content.to_string(),
+        };
+
+        let lines: Vec<&str> = content.split_inclusive('\n').collect();
+        let mut kept = String::with_capacity(content.len());
+        let mut i = 0;
+        while i < lines.len() {
+            let trimmed = lines[i].trim();
+            if let Some(span) = import_span(style, &lines[i..]) {
+                i += span;
+            } else if trimmed.is_empty() || is_header_line(style, trimmed) {
+                kept.push_str(lines[i]);
+                i += 1;
+            } else {
+                break;
+            }
+        }
+        for line in &lines[i..] {
+            kept.push_str(line);
+        }
+        kept
+    }
+}
+
+// Converts content to a Unicode normalization form, e.g. the decomposed
+// (NFD) accents some macOS tools write to precomposed NFC. Content already
+// in the form is returned as is.
+pub struct NormalizeUnicode {
+    pub form: UnicodeForm,
+}
+
+impl LineTransformer for NormalizeUnicode {
+    fn transform(&self, _path: &Path, content: &str) -> String {
+        match self.form {
+            UnicodeForm::Nfc if is_nfc(content) => content.to_string(),
+            UnicodeForm::Nfc => content.nfc().collect(),
+        }
+    }
+}
+
+// Removes the blank lines at the end of a file. The line break ending its
+// last line is kept, as is a missing one, so only the extra gap is lost.
+pub struct StripTrailingNewlines;
+
+impl LineTransformer for StripTrailingNewlines {
+    fn transform(&self, _path: &Path, content: &str) -> String {
+        let trimmed = content.trim_end_matches(['\r', '\n']);
+        let trailing = &content[trimmed.len()..];
+        let ending = if trailing.starts_with("\r\n") {
+            "\r\n"
+        } else if trailing.starts_with('\n') {
+            "\n"
+        } else {
+            ""
+        };
+        format!("{}{}", trimmed, ending)
+    }
+}
+
+// Drops empty and whitespace-only lines, for --compact
+pub struct RemoveBlankLines;
+
+impl LineTransformer for RemoveBlankLines {
+    fn transform(&self, _path: &Path, content: &str) -> String {
+        content
+            .split_inclusive('\n')
+            .filter(|line| !line.trim().is_empty())
+            .collect()
+    }
+}
+
+// Hard-wraps lines longer than `width` characters. A line is broken at the
+// last space or tab that fits, which the line break replaces, or mid-word
+// when there is none. Line endings are kept as they are.
+pub struct WrapLines {
+    pub width: usize,
+}
+
+impl LineTransformer for WrapLines {
+    fn transform(&self, _path: &Path, content: &str) -> String {
+        let mut wrapped = String::with_capacity(content.len());
+        for line in content.split_inclusive('\n') {
+            let (text, ending) = split_line_ending(line);
+            let newline = if ending.is_empty() { "\n" } else { ending };
+            let mut rest = text;
+            // The byte offset of the first character past the width, if any
+            while let Some((limit, next)) = rest.char_indices().nth(self.width) {
+                // A space right at the width is as good a break as any before it
+                let (head, tail) = match rest[..limit + next.len_utf8()].rfind([' ', '\t']) {
+                    Some(space) if !rest[..space].trim().is_empty() => {
+                        (&rest[..space], &rest[space + 1..])
+                    }
+                    _ => rest.split_at(limit),
+                };
+                wrapped.push_str(head);
+                wrapped.push_str(newline);
+                rest = tail;
+            }
+            wrapped.push_str(rest);
+            wrapped.push_str(ending);
+        }
+        wrapped
+    }
+}
+
+fn split_line_ending(line: &str) -> (&str, &str) {
+    if let Some(text) = line.strip_suffix("\r\n") {
+        (text, "\r\n")
+    } else if let Some(text) = line.strip_suffix('\n') {
+        (text, "\n")
+    } else {
+        (line, "")
+    }
+}
+
+fn import_style(path: &Path) -> Option<ImportStyle> {
+    match path.extension().and_then(|ext| ext.to_str())? {
+        "go" => Some(ImportStyle::Go),
+        "py" => Some(ImportStyle::Python),
+        "js" | "ts" | "jsx" | "tsx" | "mjs" | "cjs" => Some(ImportStyle::JavaScript),
+        "rs" => Some(ImportStyle::Rust),
+        _ => None,
+    }
+}
+
+fn is_header_line(style: ImportStyle, line: &str) -> bool {
+    match style {
+        ImportStyle::Go => line.starts_with("//") || line.starts_with("package "),
+        ImportStyle::Python => line.starts_with('#'),
+        ImportStyle::JavaScript => {
+            line.starts_with("//")
+                || line.starts_with("/*")
+                || line.starts_with('*')
+                || line == "'use strict';"
+                || line == "\"use strict\";"
+        }
+        ImportStyle::Rust => line.starts_with("//") || line.starts_with("#!["),
+    }
+}
+
+// Returns how many lines the import statement starting at `lines[0]` spans,
+// or None if the line does not start an import.
+fn import_span(style: ImportStyle, lines: &[&str]) -> Option<usize> {
+    let first = lines[0].trim();
+    match style {
+        ImportStyle::Go => {
+            if first == "import (" {
+                span_until(lines, |line| line == ")")
+            } else if first.starts_with("import \"") || is_aliased_go_import(first) {
+                Some(1)
+            } else {
+                None
+            }
+        }
+        ImportStyle::Python => {
+            let is_import = first.starts_with("import ")
+                || (first.starts_with("from ") && first.contains(" import "));
+            if !is_import {
+                None
+            } else if first.contains('(') && !first.contains(')') {
+                span_until(lines, |line| line.contains(')'))
+            } else if first.ends_with('\\') {
+                span_until(lines, |line| !line.ends_with('\\'))
+            } else {
+                Some(1)
+            }
+        }
+        ImportStyle::JavaScript => {
+            if first.starts_with("import ") || first.starts_with("import{") {
+                if is_complete_js_import(first) {
+                    Some(1)
+                } else {
+                    span_until(lines, |line| {
+                        line.contains("from '") || line.contains("from \"")
+                    })
+                }
+            } else if is_require(first) {
+                Some(1)
+            } else {
+                None
+            }
+        }
+        ImportStyle::Rust => {
+            if first.starts_with("use ") || first.starts_with("pub use ") {
+                span_until(lines, |line| line.ends_with(';'))
+            } else if first.starts_with("extern crate ") && first.ends_with(';') {
+                Some(1)
+            } else {
+                None
+            }
+        }
+    }
+}
+
+// Finds the first line (including `lines[0]`) satisfying `is_end`. An
+// unterminated statement is left alone rather than swallowing the file.
+fn span_until(lines: &[&str], is_end: impl Fn(&str) -> bool) -> Option<usize> {
+    lines
+        .iter()
+        .position(|line| is_end(line.trim()))
+        .map(|end| end + 1)
+}
+
+fn is_aliased_go_import(line: &str) -> bool {
+    let mut parts = line.split_whitespace();
+    parts.next() == Some("import")
+        && parts.next().is_some()
+        && parts.next().map(|p| p.starts_with('"')).unwrap_or(false)
+}
+
+fn is_complete_js_import(line: &str) -> bool {
+    line.contains(" from ")
+        || line.contains("}from")
+        || line.starts_with("import '")
+        || line.starts_with("import \"")
+}
+
+fn is_require(line: &str) -> bool {
+    (line.starts_with("const ") || line.starts_with("let ") || line.starts_with("var "))
+        && line.contains("= require(")
+        && (line.ends_with(");") || line.ends_with(')'))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn strip_imports(path: &str, content: &str) -> String {
+        StripImports.transform(Path::new(path), content)
+    }
+
+    #[test]
+    fn strips_the_leading_imports_of_each_language() {
+        assert_eq!(
+            strip_imports(
+                "main.rs",
+                "//! Docs\nuse std::fs;\nuse std::io::{\n    Read,\n};\n\nfn main() {}\n"
+            ),
+            "//! Docs\n\nfn main() {}\n"
+        );
+        assert_eq!(
+            strip_imports(
+                "app.py",
+                "import os\nfrom typing import (\n    List,\n)\nx = 1\n"
+            ),
+            "x = 1\n"
+        );
+        assert_eq!(
+            strip_imports(
+                "main.go",
+                "package main\n\nimport (\n\t\"fmt\"\n)\n\nfunc main() {}\n"
+            ),
+            "package main\n\n\nfunc main() {}\n"
+        );
+        assert_eq!(
+            strip_imports(
+                "app.ts",
+                "import { a,\n  b } from './ab';\nconst fs = require('fs');\nexport {};\n"
+            ),
+            "export {};\n"
+        );
+    }
+
+    #[test]
+    fn imports_after_the_header_and_other_files_are_left_alone() {
+        let rust = "fn main() {}\nuse std::fs;\n";
+        assert_eq!(strip_imports("main.rs", rust), rust);
+        let text = "import os\n";
+        assert_eq!(strip_imports("notes.txt", text), text);
+    }
+
+    #[test]
+    fn an_unterminated_import_is_kept() {
+        let rust = "use std::{\n    fs,\nfn main() {}\n";
+        assert_eq!(strip_imports("main.rs", rust), rust);
+    }
+
+    struct Uppercase;
+
+    impl LineTransformer for Uppercase {
+        fn transform(&self, _path: &Path, content: &str) -> String {
+            content.to_uppercase()
+        }
+    }
+
+    #[test]
+    fn transformers_run_in_order_on_the_previous_output() {
+        let transformers: Vec<Box<dyn LineTransformer>> =
+            vec![Box::new(StripImports), Box::new(Uppercase)];
+        assert_eq!(
+            apply_transformers(
+                &transformers,
+                Path::new("app.py"),
+                "import os\nx = 1\n".to_string()
+            ),
+            "X = 1\n"
+        );
+    }
+
+    #[test]
+    fn wraps_long_lines_at_spaces_or_mid_word() {
+        let wrap = WrapLines { width: 10 };
+        assert_eq!(
+            wrap.transform(Path::new("a.txt"), "one two three four\r\nshort\n"),
+            "one two\r\nthree four\r\nshort\n"
+        );
+        assert_eq!(
+            wrap.transform(Path::new("a.txt"), "abcdefghijklmnop"),
+            "abcdefghij\nklmnop"
+        );
+    }
+
+    #[test]
+    fn wrap_widths_count_characters_not_bytes() {
+        let wrap = WrapLines { width: 3 };
+        assert_eq!(wrap.transform(Path::new("a.txt"), "ééééé\n"), "ééé\néé\n");
+    }
+
+    #[test]
+    fn normalizes_decomposed_accents_to_nfc() {
+        let normalize = NormalizeUnicode {
+            form: UnicodeForm::Nfc,
+        };
+        assert_eq!(
+            normalize.transform(Path::new("a.txt"), "cafe\u{301}\n"),
+            "caf\u{e9}\n"
+        );
+        assert_eq!(
+            normalize.transform(Path::new("a.txt"), "caf\u{e9}\n"),
+            "caf\u{e9}\n"
+        );
+    }
+
+    #[test]
+    fn strips_blank_lines_at_the_end_but_keeps_the_last_line_break() {
+        let strip = |content| StripTrailingNewlines.transform(Path::new("a.txt"), content);
+        assert_eq!(strip("a\n\n\n"), "a\n");
+        assert_eq!(strip("a\r\n\r\n"), "a\r\n");
+        assert_eq!(strip("a"), "a");
+        assert_eq!(strip("\n\n"), "\n");
+    }
+
+    #[test]
+    fn compact_removes_blank_and_whitespace_only_lines() {
+        assert_eq!(
+            RemoveBlankLines.transform(Path::new("a.rs"), "fn a() {}\n\n  \t\r\nfn b() {}\n"),
+            "fn a() {}\nfn b() {}\n"
+        );
+    }
+}
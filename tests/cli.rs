@@ -0,0 +1,595 @@
+use std::io::{Read, Write};
+use std::process::{Command, Stdio};
+use std::time::Duration;
+
+#[test]
+fn a_missing_input_path_fails_before_writing_anything() {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-{}", std::process::id()));
+    let output_file = dir.with_extension("txt");
+    let output = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(dir.join("missing"))
+        .arg("-o")
+        .arg(&output_file)
+        .output()
+        .unwrap();
+
+    assert_eq!(output.status.code(), Some(1));
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    assert!(
+        stderr.contains("Input path does not exist"),
+        "stderr: {}",
+        stderr
+    );
+    assert!(!output_file.exists());
+}
+
+// Interrupts a run while it waits at the --confirm-over question, after the
+// files were found but before any was combined
+#[cfg(unix)]
+#[test]
+fn ctrl_c_writes_the_partial_output_and_exits_with_130() {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-interrupt-{}", std::process::id()));
+    std::fs::create_dir_all(&dir).unwrap();
+    std::fs::write(dir.join("main.rs"), "fn main() {}\n").unwrap();
+    let output_file = dir.with_extension("txt");
+    let mut child = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(&dir)
+        .arg("-o")
+        .arg(&output_file)
+        .args(["--prompt", "Partial run", "--confirm-over", "1"])
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .spawn()
+        .unwrap();
+
+    let mut stdout = child.stdout.take().unwrap();
+    let mut question = Vec::new();
+    let mut byte = [0];
+    while !String::from_utf8_lossy(&question).ends_with("[y/N] ") {
+        assert_eq!(stdout.read(&mut byte).unwrap(), 1);
+        question.push(byte[0]);
+    }
+    let killed = Command::new("kill")
+        .args(["-INT", &child.id().to_string()])
+        .status()
+        .unwrap();
+    assert!(killed.success());
+    std::thread::sleep(Duration::from_millis(200));
+    child.stdin.take().unwrap().write_all(b"y\n").unwrap();
+    let status = child.wait().unwrap();
+    let mut rest = String::new();
+    stdout.read_to_string(&mut rest).unwrap();
+
+    assert_eq!(status.code(), Some(130), "{}", rest);
+    assert!(rest.contains("Interrupted: wrote the 0 files combined so far"));
+    let written = std::fs::read_to_string(&output_file).unwrap();
+    std::fs::remove_file(&output_file).unwrap();
+    std::fs::remove_dir_all(&dir).unwrap();
+    assert_eq!(written, "Partial run\n\n");
+}
+
+#[cfg(feature = "profiling")]
+#[test]
+fn profiles_are_written_after_a_run() {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-profile-{}", std::process::id()));
+    std::fs::create_dir_all(&dir).unwrap();
+    std::fs::write(dir.join("main.rs"), "fn main() {}\n").unwrap();
+    let profiles = dir.with_extension("profiles");
+    std::fs::create_dir_all(&profiles).unwrap();
+    let cpu_profile = profiles.join("cpu.pb");
+    let mem_profile = profiles.join("heap.json");
+    let output = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(&dir)
+        .arg("-o")
+        .arg(profiles.join("combined.txt"))
+        .arg("--cpu-profile")
+        .arg(&cpu_profile)
+        .arg("--mem-profile")
+        .arg(&mem_profile)
+        .output()
+        .unwrap();
+
+    let cpu_size = std::fs::metadata(&cpu_profile).map(|m| m.len());
+    let mem_size = std::fs::metadata(&mem_profile).map(|m| m.len());
+    std::fs::remove_dir_all(&dir).unwrap();
+    std::fs::remove_dir_all(&profiles).unwrap();
+    assert!(output.status.success());
+    assert!(cpu_size.unwrap() > 0);
+    assert!(mem_size.unwrap() > 0);
+}
+
+#[cfg(not(feature = "profiling"))]
+#[test]
+fn profiling_flags_need_the_profiling_feature() {
+    let output = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .args(["--cpu-profile", "cpu.pb"])
+        .output()
+        .unwrap();
+
+    assert_eq!(output.status.code(), Some(1));
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    assert!(
+        stderr.contains("rebuild combiner with `--features profiling`"),
+        "stderr: {}",
+        stderr
+    );
+}
+
+// Runs combiner with --fail-on-skip over a directory holding `files`
+fn run_failing_on_skip(name: &str, files: &[(&str, &[u8])]) -> std::process::Output {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-{}-{}", name, std::process::id()));
+    std::fs::create_dir_all(&dir).unwrap();
+    for (path, contents) in files {
+        let path = dir.join(path);
+        std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+        std::fs::write(path, contents).unwrap();
+    }
+    let output_file = dir.with_extension("txt");
+    let output = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(&dir)
+        .arg("-o")
+        .arg(&output_file)
+        .arg("--fail-on-skip")
+        .output()
+        .unwrap();
+    std::fs::remove_dir_all(&dir).unwrap();
+    let _ = std::fs::remove_file(&output_file);
+    output
+}
+
+#[test]
+fn fail_on_skip_exits_with_4_when_a_binary_file_is_skipped() {
+    let output = run_failing_on_skip(
+        "binary-skip",
+        &[
+            ("main.rs", b"fn main() {}\n"),
+            ("image.png", b"\x89PNG\r\n"),
+        ],
+    );
+
+    assert_eq!(output.status.code(), Some(4));
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    assert!(
+        stdout.contains("1 files were skipped (1 non-text)"),
+        "stdout: {}",
+        stdout
+    );
+}
+
+#[test]
+fn fail_on_skip_exits_cleanly_when_nothing_is_skipped() {
+    let output = run_failing_on_skip("no-skip", &[("main.rs", b"fn main() {}\n")]);
+
+    assert_eq!(output.status.code(), Some(0));
+}
+
+#[test]
+fn fail_on_skip_ignores_non_text_files_left_out_on_purpose() {
+    let output = run_failing_on_skip(
+        "ignored-skip",
+        &[
+            ("main.rs", b"fn main() {}\n"),
+            ("image.png", b"\x89PNG\r\n"),
+            ("combiner.toml", b"ignore_patterns = [\"*.png\"]\n"),
+            (".git/index", b"DIRC\0\0\0\x02"),
+        ],
+    );
+
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    assert_eq!(output.status.code(), Some(0), "stdout: {}", stdout);
+}
+
+#[test]
+fn output_stats_only_writes_the_stats_file_and_no_output() {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-stats-{}", std::process::id()));
+    std::fs::create_dir_all(&dir).unwrap();
+    std::fs::write(dir.join("main.rs"), "fn main() {}\n").unwrap();
+    let output_file = dir.with_extension("txt");
+    let stats_file = dir.with_extension("json");
+    let output = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(&dir)
+        .arg("-o")
+        .arg(&output_file)
+        .arg("--output-stats-only")
+        .arg(&stats_file)
+        .output()
+        .unwrap();
+
+    let stats = std::fs::read_to_string(&stats_file);
+    let _ = std::fs::remove_file(&stats_file);
+    std::fs::remove_dir_all(&dir).unwrap();
+    assert!(output.status.success());
+    assert!(!output_file.exists());
+    let stats: serde_json::Value = serde_json::from_str(&stats.unwrap()).unwrap();
+    assert_eq!(stats["files_processed"], 1);
+    let main = dir.join("main.rs").to_string_lossy().into_owned();
+    assert!(stats["files"][main].as_u64().unwrap() > 0);
+}
+
+// Runs combiner with `args`, feeding `input` to its stdin, and returns the
+// exit status and the stats written with --output-stats-only
+fn run_for_stats(name: &str, args: &[&str], input: &str) -> (bool, serde_json::Value) {
+    let stats_file =
+        std::env::temp_dir().join(format!("combiner-cli-{}-{}.json", name, std::process::id()));
+    let mut child = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .args(args)
+        .arg("--output-stats-only")
+        .arg(&stats_file)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .spawn()
+        .unwrap();
+    child
+        .stdin
+        .take()
+        .unwrap()
+        .write_all(input.as_bytes())
+        .unwrap();
+    let status = child.wait().unwrap();
+    let stats = std::fs::read_to_string(&stats_file).unwrap();
+    std::fs::remove_file(&stats_file).unwrap();
+    (status.success(), serde_json::from_str(&stats).unwrap())
+}
+
+#[test]
+fn stdin_is_tokenized_like_a_file_with_the_same_contents() {
+    let text = "The quick brown fox\njumps over the lazy dog\n";
+    let dir = std::env::temp_dir().join(format!("combiner-cli-stdin-{}", std::process::id()));
+    std::fs::create_dir_all(&dir).unwrap();
+    let file = dir.join("fox.txt");
+    std::fs::write(&file, text).unwrap();
+
+    let (from_file, file_stats) = run_for_stats("stdin-file", &["-d", file.to_str().unwrap()], "");
+    let (from_stdin, stdin_stats) = run_for_stats(
+        "stdin",
+        &[
+            "-d",
+            dir.to_str().unwrap(),
+            "--stdin",
+            "--stdin-name",
+            "fox.txt",
+        ],
+        text,
+    );
+    std::fs::remove_dir_all(&dir).unwrap();
+
+    assert!(from_file && from_stdin);
+    assert_eq!(stdin_stats["files_processed"], 1);
+    assert_eq!(stdin_stats["total_tokens"], file_stats["total_tokens"]);
+    assert_eq!(
+        stdin_stats["files"]["fox.txt"],
+        file_stats["files"][file.to_str().unwrap()]
+    );
+}
+
+#[test]
+fn stdin_is_written_under_its_name() {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-stdin-name-{}", std::process::id()));
+    std::fs::create_dir_all(&dir).unwrap();
+    let output_file = dir.join("combined.txt");
+    let mut child = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(&dir)
+        .arg("-o")
+        .arg(&output_file)
+        .arg("--stdin")
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .spawn()
+        .unwrap();
+    child
+        .stdin
+        .take()
+        .unwrap()
+        .write_all(b"piped text\n")
+        .unwrap();
+    let status = child.wait().unwrap();
+    let written = std::fs::read_to_string(&output_file);
+    std::fs::remove_dir_all(&dir).unwrap();
+
+    assert!(status.success());
+    let written = written.unwrap();
+    assert!(written.starts_with("File: \"stdin\"\n"), "{}", written);
+    assert!(written.contains("piped text\n"));
+}
+
+// Runs combiner with --expect-tokens over a directory with one small file
+fn run_expecting_tokens(name: &str, range: &str) -> std::process::Output {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-{}-{}", name, std::process::id()));
+    std::fs::create_dir_all(&dir).unwrap();
+    std::fs::write(dir.join("main.rs"), "fn main() {}\n").unwrap();
+    let output_file = dir.with_extension("txt");
+    let output = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(&dir)
+        .arg("-o")
+        .arg(&output_file)
+        .args(["--expect-tokens", range])
+        .output()
+        .unwrap();
+    std::fs::remove_dir_all(&dir).unwrap();
+    let _ = std::fs::remove_file(&output_file);
+    output
+}
+
+#[test]
+fn expect_tokens_exits_cleanly_within_the_range() {
+    let output = run_expecting_tokens("tokens-in-range", "1:");
+    assert_eq!(output.status.code(), Some(0));
+}
+
+#[test]
+fn expect_tokens_exits_with_5_outside_the_range() {
+    let output = run_expecting_tokens("tokens-out-of-range", ":0");
+    assert_eq!(output.status.code(), Some(5));
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    assert!(
+        stdout.contains("is outside the expected range :0"),
+        "stdout: {}",
+        stdout
+    );
+}
+
+// Runs combiner over a directory with two source files at a --verbose level
+fn run_verbose(name: &str, verbose: &[&str]) -> String {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-{}-{}", name, std::process::id()));
+    std::fs::create_dir_all(dir.join("src")).unwrap();
+    std::fs::write(dir.join("main.rs"), "fn main() {}\n").unwrap();
+    std::fs::write(dir.join("src/lib.rs"), "pub fn f() {}\n").unwrap();
+    std::fs::write(dir.join("image.png"), "not text").unwrap();
+    let output_file = dir.with_extension("txt");
+    let output = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(&dir)
+        .arg("-o")
+        .arg(&output_file)
+        .args(verbose)
+        .output()
+        .unwrap();
+    std::fs::remove_dir_all(&dir).unwrap();
+    let _ = std::fs::remove_file(&output_file);
+    assert!(output.status.success());
+    String::from_utf8_lossy(&output.stdout).into_owned()
+}
+
+#[test]
+fn each_verbose_level_prints_more_detail() {
+    let quiet = run_verbose("verbose-0", &[]);
+    let summary = run_verbose("verbose-1", &["-v"]);
+    let files = run_verbose("verbose-2", &["-vv"]);
+
+    assert!(!quiet.contains("Input directories:"));
+    assert!(!quiet.contains("Combined 1 files"));
+
+    assert!(summary.contains("Input directories:"));
+    assert_eq!(summary.matches("Combined 1 files").count(), 2);
+    assert!(!summary.contains("Processing file:"));
+    assert!(!summary.contains("Skipping non-text file:"));
+
+    assert!(files.contains("Input directories:"));
+    assert_eq!(files.matches("Combined 1 files").count(), 2);
+    assert_eq!(files.matches("Processing file:").count(), 2);
+    assert!(files.contains("Skipping non-text file:"));
+
+    assert!(quiet.lines().count() < summary.lines().count());
+    assert!(summary.lines().count() < files.lines().count());
+}
+
+#[test]
+fn tables_have_no_ansi_escapes_when_stdout_is_not_a_terminal() {
+    for args in [
+        &["--list-tokenizers"][..],
+        &["--list-tokenizers", "--no-color"][..],
+    ] {
+        let output = Command::new(env!("CARGO_BIN_EXE_combiner"))
+            .args(args)
+            .env_remove("NO_COLOR")
+            .output()
+            .unwrap();
+
+        assert!(output.status.success());
+        let stdout = String::from_utf8_lossy(&output.stdout);
+        assert!(stdout.contains("cl100k_base"));
+        assert!(!stdout.contains('\x1b'), "{:?}", stdout);
+    }
+}
+
+// The tokenizer and output file a run settles on, as printed with -v, when
+// each is given by the flag, COMBINER_* variable, and config file present
+fn resolved_settings(name: &str, flag: bool, env: bool, config: bool) -> (String, String) {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-{}-{}", name, std::process::id()));
+    let input = dir.join("input");
+    std::fs::create_dir_all(&input).unwrap();
+    std::fs::write(input.join("main.rs"), "fn main() {}\n").unwrap();
+    if config {
+        std::fs::write(
+            input.join("combiner.toml"),
+            format!(
+                "tokenization_method = \"gpt4\"\noutput_file = {:?}\n",
+                dir.join("from-config.txt")
+            ),
+        )
+        .unwrap();
+    }
+    let mut command = Command::new(env!("CARGO_BIN_EXE_combiner"));
+    command.current_dir(&dir).arg("-d").arg(&input).arg("-v");
+    command
+        .env_remove("COMBINER_TOKENIZER")
+        .env_remove("COMBINER_OUTPUT");
+    if flag {
+        command
+            .args(["--tokenization-method", "gpt4o", "-o"])
+            .arg(dir.join("from-flag.txt"));
+    }
+    if env {
+        command
+            .env("COMBINER_TOKENIZER", "gpt2")
+            .env("COMBINER_OUTPUT", dir.join("from-env.txt"));
+    }
+    let output = command.output().unwrap();
+    std::fs::remove_dir_all(&dir).unwrap();
+    assert!(output.status.success(), "{:?}", output);
+
+    let stdout = String::from_utf8_lossy(&output.stdout).into_owned();
+    let setting = |prefix: &str| {
+        stdout
+            .lines()
+            .find_map(|line| line.strip_prefix(prefix))
+            .unwrap()
+            .to_string()
+    };
+    (setting("Tokenization method: "), setting("Output file: "))
+}
+
+#[test]
+fn flags_win_over_the_environment_which_wins_over_the_config_file() {
+    let (tokenizer, output) = resolved_settings("precedence-flag", true, true, true);
+    assert_eq!(tokenizer, "gpt4o");
+    assert!(output.ends_with("from-flag.txt\""), "{}", output);
+
+    let (tokenizer, output) = resolved_settings("precedence-env", false, true, true);
+    assert_eq!(tokenizer, "gpt2");
+    assert!(output.ends_with("from-env.txt\""), "{}", output);
+
+    let (tokenizer, output) = resolved_settings("precedence-config", false, false, true);
+    assert_eq!(tokenizer, "gpt4");
+    assert!(output.ends_with("from-config.txt\""), "{}", output);
+
+    let (tokenizer, output) = resolved_settings("precedence-default", false, false, false);
+    assert_eq!(tokenizer, "code");
+    assert!(output.contains("combiner_"), "{}", output);
+}
+
+// Runs combiner over `input` against the baseline file in the same directory
+fn run_with_baseline(input: &std::path::Path, args: &[&str]) -> std::process::Output {
+    let baseline = input.with_extension("baseline.json");
+    Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(input)
+        .arg("-o")
+        .arg(input.with_extension("txt"))
+        .arg("--baseline")
+        .arg(&baseline)
+        .args(args)
+        .output()
+        .unwrap()
+}
+
+#[test]
+fn baseline_growth_past_the_threshold_exits_with_6() {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-baseline-{}", std::process::id()));
+    std::fs::create_dir_all(&dir).unwrap();
+    std::fs::write(dir.join("main.rs"), "fn main() {}\n").unwrap();
+    let baseline = dir.with_extension("baseline.json");
+    let _ = std::fs::remove_file(&baseline);
+
+    let missing = run_with_baseline(&dir, &[]);
+    let created = run_with_baseline(&dir, &["--update-baseline"]);
+    let stored = std::fs::read_to_string(&baseline).unwrap();
+    std::fs::write(dir.join("lib.rs"), "pub fn grown() {}\n".repeat(50)).unwrap();
+    let grown = run_with_baseline(&dir, &["--update-baseline"]);
+    let kept = std::fs::read_to_string(&baseline).unwrap();
+    let allowed = run_with_baseline(&dir, &["--baseline-threshold", "100000"]);
+
+    std::fs::remove_dir_all(&dir).unwrap();
+    let _ = std::fs::remove_file(&baseline);
+    let _ = std::fs::remove_file(dir.with_extension("txt"));
+
+    assert_eq!(missing.status.code(), Some(0));
+    assert!(String::from_utf8_lossy(&missing.stdout).contains("No baseline found"));
+    assert_eq!(created.status.code(), Some(0));
+    assert_eq!(grown.status.code(), Some(6));
+    assert_eq!(kept, stored, "a failing run must not move the baseline");
+    assert_eq!(allowed.status.code(), Some(0));
+}
+
+// Runs combiner over a directory with one small file, with
+// COMBINER_TOKENIZER_THREADS set
+fn run_with_tokenizer_threads(name: &str, threads: &str) -> std::process::Output {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-{}-{}", name, std::process::id()));
+    std::fs::create_dir_all(&dir).unwrap();
+    std::fs::write(dir.join("main.rs"), "fn main() {}\n").unwrap();
+    let output_file = dir.with_extension("txt");
+    let output = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(&dir)
+        .arg("-o")
+        .arg(&output_file)
+        .env("COMBINER_TOKENIZER_THREADS", threads)
+        .output()
+        .unwrap();
+    std::fs::remove_dir_all(&dir).unwrap();
+    let _ = std::fs::remove_file(&output_file);
+    output
+}
+
+#[test]
+fn tokenizer_threads_are_read_from_the_environment() {
+    let output = run_with_tokenizer_threads("two-threads", "2");
+    assert_eq!(output.status.code(), Some(0));
+
+    for threads in ["0", "many"] {
+        let output = run_with_tokenizer_threads("bad-threads", threads);
+        assert_ne!(output.status.code(), Some(0));
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        assert!(stderr.contains("cpu-concurrency"), "stderr: {}", stderr);
+    }
+}
+
+#[test]
+fn dry_run_prints_the_token_tree_without_writing_the_output() {
+    let dir = std::env::temp_dir().join(format!("combiner-cli-dry-run-{}", std::process::id()));
+    std::fs::create_dir_all(dir.join("src")).unwrap();
+    std::fs::write(dir.join("src/main.rs"), "fn main() {}\n").unwrap();
+    std::fs::write(dir.join("src/lib.rs"), "pub fn f() {}\n").unwrap();
+    let output_file = dir.with_extension("txt");
+    let output = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(&dir)
+        .arg("-o")
+        .arg(&output_file)
+        .arg("--dry-run")
+        .output()
+        .unwrap();
+    std::fs::remove_dir_all(&dir).unwrap();
+
+    assert_eq!(output.status.code(), Some(0));
+    assert!(!output_file.exists());
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    assert!(stdout.contains("Token Tree:"), "stdout: {}", stdout);
+    assert!(stdout.contains("├── lib.rs ("), "stdout: {}", stdout);
+    assert!(stdout.contains("└── main.rs ("), "stdout: {}", stdout);
+    assert!(stdout.contains("None (not written)"), "stdout: {}", stdout);
+}
+
+#[test]
+fn list_skipped_prints_each_skipped_file_to_stderr() {
+    let dir =
+        std::env::temp_dir().join(format!("combiner-cli-list-skipped-{}", std::process::id()));
+    std::fs::create_dir_all(&dir).unwrap();
+    std::fs::write(dir.join("main.rs"), "fn main() {}\n").unwrap();
+    std::fs::write(dir.join("pixel.png"), b"\x89PNG\r\n\x1a\n\0\0\0\rIHDR").unwrap();
+    let output_file = dir.with_extension("txt");
+    let output = Command::new(env!("CARGO_BIN_EXE_combiner"))
+        .arg("-d")
+        .arg(&dir)
+        .arg("-o")
+        .arg(&output_file)
+        .arg("--list-skipped")
+        .output()
+        .unwrap();
+    std::fs::remove_dir_all(&dir).unwrap();
+    let _ = std::fs::remove_file(&output_file);
+
+    assert_eq!(output.status.code(), Some(0));
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    assert!(stderr.contains("Skipped Files:"), "stderr: {}", stderr);
+    assert!(stderr.contains("pixel.png: non-text"), "stderr: {}", stderr);
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    assert!(!stdout.contains("pixel.png"), "stdout: {}", stdout);
+}